@@ -0,0 +1,464 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The admin API lets other services, such as RAP, list the jobs, trigger them
+// and follow or cancel the runs they triggered. It is only available in
+// daemon mode, when APIAddr is set, and every request must have the
+// APIToken in an "Authorization: Bearer <token>" header.
+//
+//	GET  /jobs                   list the jobs
+//	POST /jobs/<job>/run         run a job, with {"params": {"Option": value}}
+//	GET  /runs                   list the runs triggered through the API
+//	GET  /runs/<id>              show a run
+//	GET  /runs/<id>/progress     stream the progress of a run, as JSON lines
+//	POST /runs/<id>/cancel       stop a run
+
+var apiLog = baseLog.with("component", "API")
+
+// apiOptions are the config options which can be overridden when triggering
+// a run: the ones the jobs read from the config of the run, with
+// configFromContext. The others apply to the whole process, or are read when
+// it starts, and overriding them would have no effect.
+var apiOptions = map[string]func(cfg *config) interface{}{
+	"ScanChunkSize": func(cfg *config) interface{} { return &cfg.ScanChunkSize },
+	"MaxErrors":     func(cfg *config) interface{} { return &cfg.MaxErrors },
+
+	"CacheRankedScore":        func(cfg *config) interface{} { return &cfg.CacheRankedScore },
+	"CacheTotalHits":          func(cfg *config) interface{} { return &cfg.CacheTotalHits },
+	"CachePlayTime":           func(cfg *config) interface{} { return &cfg.CachePlayTime },
+	"CacheMostPlayedBeatmaps": func(cfg *config) interface{} { return &cfg.CacheMostPlayedBeatmaps },
+
+	"IncrementalPP":          func(cfg *config) interface{} { return &cfg.IncrementalPP },
+	"PPHistoryRetentionDays": func(cfg *config) interface{} { return &cfg.PPHistoryRetentionDays },
+
+	"RecalculatePPWrite":     func(cfg *config) interface{} { return &cfg.RecalculatePPWrite },
+	"RecalculatePPMaxChange": func(cfg *config) interface{} { return &cfg.RecalculatePPMaxChange },
+	"RecalculatePPBeatmaps":  func(cfg *config) interface{} { return &cfg.RecalculatePPBeatmaps },
+	"RecalculatePPUsers":     func(cfg *config) interface{} { return &cfg.RecalculatePPUsers },
+	"RecalculatePPModes":     func(cfg *config) interface{} { return &cfg.RecalculatePPModes },
+}
+
+// apiMaxRuns is the number of finished runs kept for GET /runs.
+const apiMaxRuns = 100
+
+// apiRun is a run of a job triggered through the admin API.
+type apiRun struct {
+	id      string
+	job     Job
+	params  map[string]interface{}
+	created time.Time
+	cancel  context.CancelFunc
+	// done is closed once the run is over, after which jr doesn't change.
+	done chan struct{}
+
+	mu sync.Mutex
+	// jr is set as soon as the job starts. It stays nil if the job was
+	// already running.
+	jr *jobRun
+}
+
+var apiRuns = struct {
+	sync.Mutex
+	wg sync.WaitGroup
+	m  map[string]*apiRun
+	// ids contains the IDs of the runs in m, from the oldest.
+	ids []string
+}{m: make(map[string]*apiRun)}
+
+// apiRunStatus is the JSON representation of an apiRun.
+type apiRunStatus struct {
+	ID                 string                 `json:"id"`
+	Job                string                 `json:"job"`
+	Params             map[string]interface{} `json:"params,omitempty"`
+	Status             jobStatus              `json:"status"`
+	CreatedAt          time.Time              `json:"created_at"`
+	StartedAt          *time.Time             `json:"started_at,omitempty"`
+	EndedAt            *time.Time             `json:"ended_at,omitempty"`
+	RowsProcessed      int64                  `json:"rows_processed"`
+	OperationsQueued   int64                  `json:"operations_queued"`
+	OperationsExecuted int64                  `json:"operations_executed"`
+	OperationsFailed   int64                  `json:"operations_failed"`
+	QueryErrors        int64                  `json:"query_errors"`
+	Error              string                 `json:"error,omitempty"`
+}
+
+// statusWaiting is the status of an apiRun whose job hasn't started yet,
+// because it is waiting for its dependencies or for a lock.
+const statusWaiting jobStatus = "waiting"
+
+func (ar *apiRun) status() apiRunStatus {
+	s := apiRunStatus{
+		ID:        ar.id,
+		Job:       ar.job.Name(),
+		Params:    ar.params,
+		Status:    statusWaiting,
+		CreatedAt: ar.created,
+	}
+	ar.mu.Lock()
+	jr := ar.jr
+	ar.mu.Unlock()
+
+	var finished bool
+	select {
+	case <-ar.done:
+		finished = true
+	default:
+	}
+	if jr == nil {
+		if finished {
+			s.Status = "skipped, already running"
+		}
+		return s
+	}
+
+	start := jr.start
+	s.StartedAt = &start
+	s.Status = statusRunning
+	s.RowsProcessed = atomic.LoadInt64(&jr.rowsRead)
+	s.OperationsQueued = atomic.LoadInt64(&jr.opsQueued)
+	s.OperationsExecuted = atomic.LoadInt64(&jr.opsExecuted)
+	s.OperationsFailed = atomic.LoadInt64(&jr.opsFailed)
+	s.QueryErrors = atomic.LoadInt64(&jr.errors)
+	if finished {
+		end := jr.end
+		s.EndedAt = &end
+		s.Status = jr.status
+		if jr.err != nil {
+			s.Error = jr.err.Error()
+		}
+	}
+	return s
+}
+
+// serveAPI serves the admin API on APIAddr until ctx is done. The runs it
+// triggers are stopped when ctx is done; apiRuns.wg can be used to wait for
+// them.
+func serveAPI(ctx context.Context) {
+	if c.APIToken == "" {
+		apiLog.errorf("APIToken is empty, not starting the admin API")
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs", apiListJobs)
+	mux.HandleFunc("/jobs/", func(w http.ResponseWriter, r *http.Request) {
+		apiTriggerJob(ctx, w, r)
+	})
+	mux.HandleFunc("/runs", apiListRuns)
+	mux.HandleFunc("/runs/", apiRunHandler)
+	mux.HandleFunc("/pp-history/", apiPPHistory)
+	srv := &http.Server{Addr: c.APIAddr, Handler: apiAuth(mux)}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	apiLog.infof("serving the admin API on %s", c.APIAddr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		apiLog.errorf("couldn't serve the admin API: %v", err)
+	}
+}
+
+// apiAuth only lets through the requests with the right APIToken.
+func apiAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(c.APIToken)) != 1 {
+			apiError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+		apiLog.with("method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr).debugf("request")
+		next.ServeHTTP(w, r)
+	})
+}
+
+func apiJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func apiError(w http.ResponseWriter, code int, format string, args ...interface{}) {
+	apiJSON(w, code, map[string]string{"error": fmt.Sprintf(format, args...)})
+}
+
+func apiListJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	type apiJob struct {
+		Name         string   `json:"name"`
+		Command      string   `json:"command"`
+		Description  string   `json:"description"`
+		Enabled      bool     `json:"enabled"`
+		Dependencies []string `json:"dependencies"`
+		Running      bool     `json:"running"`
+	}
+	res := make([]apiJob, 0, len(jobs))
+	runningJobs.Lock()
+	for _, j := range jobs {
+		deps := j.Dependencies()
+		if deps == nil {
+			deps = []string{}
+		}
+		_, running := runningJobs.m[j]
+		res = append(res, apiJob{
+			Name:         j.Name(),
+			Command:      commandName(j.Name()),
+			Description:  j.Description(),
+			Enabled:      j.Enabled(&c),
+			Dependencies: deps,
+			Running:      running,
+		})
+	}
+	runningJobs.Unlock()
+	apiJSON(w, http.StatusOK, res)
+}
+
+// apiTriggerJob handles POST /jobs/<job>/run.
+func apiTriggerJob(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/"), "/")
+	if len(parts) != 2 || parts[1] != "run" {
+		apiError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if r.Method != http.MethodPost {
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	j := findJob(parts[0])
+	if j == nil {
+		apiError(w, http.StatusNotFound, "there is no job named %s", parts[0])
+		return
+	}
+	if ctx.Err() != nil {
+		apiError(w, http.StatusServiceUnavailable, "shutting down")
+		return
+	}
+
+	var body struct {
+		Params map[string]interface{} `json:"params"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			apiError(w, http.StatusBadRequest, "invalid body: %v", err)
+			return
+		}
+	}
+	cfg := c
+	if err := applyOverrides(&cfg, body.Params); err != nil {
+		apiError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	runningJobs.Lock()
+	_, running := runningJobs.m[j]
+	runningJobs.Unlock()
+	if running {
+		apiError(w, http.StatusConflict, "%s is already running", j.Name())
+		return
+	}
+
+	ar := startAPIRun(ctx, j, &cfg, body.Params)
+	apiJSON(w, http.StatusAccepted, ar.status())
+}
+
+// applyOverrides sets the given options of cfg, returning an error if any of
+// them can't be overridden or has an invalid value.
+func applyOverrides(cfg *config, params map[string]interface{}) error {
+	for name, value := range params {
+		var option func(*config) interface{}
+		for n, o := range apiOptions {
+			if strings.EqualFold(n, name) {
+				name, option = n, o
+				break
+			}
+		}
+		if option == nil {
+			return fmt.Errorf("%s can't be overridden", name)
+		}
+		switch field := option(cfg).(type) {
+		case *bool:
+			v, ok := value.(bool)
+			if !ok {
+				return fmt.Errorf("%s must be a boolean", name)
+			}
+			*field = v
+		case *int:
+			v, ok := value.(float64)
+			if !ok || v != float64(int(v)) {
+				return fmt.Errorf("%s must be an integer", name)
+			}
+			*field = int(v)
+		case *string:
+			v, ok := value.(string)
+			if !ok {
+				return fmt.Errorf("%s must be a string", name)
+			}
+			*field = v
+		}
+	}
+	if errs := validateConfig(cfg); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// startAPIRun runs j in the background with cfg, and keeps track of the run
+// in apiRuns.
+func startAPIRun(ctx context.Context, j Job, cfg *config, params map[string]interface{}) *apiRun {
+	historyID := startRunHistory()
+	ctx, cancel := context.WithCancel(ctx)
+	runCtx, cancelRun := ctx, cancel
+	if maxRunDuration > 0 {
+		runCtx, cancelRun = context.WithTimeout(ctx, maxRunDuration)
+	}
+	ar := &apiRun{
+		id:      newRunID(historyID),
+		job:     j,
+		params:  params,
+		created: time.Now(),
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	runCtx = withConfig(withRunID(runCtx, ar.id), cfg)
+
+	apiRuns.Lock()
+	apiRuns.m[ar.id] = ar
+	apiRuns.ids = append(apiRuns.ids, ar.id)
+	pruneAPIRuns()
+	apiRuns.wg.Add(1)
+	apiRuns.Unlock()
+
+	logFor(runCtx).with("params", params).infof("%s triggered through the API", j.Name())
+	go func() {
+		defer apiRuns.wg.Done()
+		defer cancel()
+		defer cancelRun()
+		jr := runJob(runCtx, j, func(jr *jobRun) {
+			ar.mu.Lock()
+			ar.jr = jr
+			ar.mu.Unlock()
+		})
+		close(ar.done)
+		if jr == nil {
+			logFor(runCtx).warnf("%s is already running, skipping this run", j.Name())
+			finishRunHistory(historyID, nil)
+			return
+		}
+		printRun(jr)
+		finishRunHistory(historyID, []*jobRun{jr})
+		notifyRun(runCtx, []*jobRun{jr})
+		if dryRun {
+			printDryRunReport(j.Name())
+		}
+	}()
+	return ar
+}
+
+// pruneAPIRuns forgets the oldest finished runs, so that at most apiMaxRuns
+// are kept. apiRuns must be locked.
+func pruneAPIRuns() {
+	for i := 0; len(apiRuns.ids) > apiMaxRuns && i < len(apiRuns.ids); {
+		ar := apiRuns.m[apiRuns.ids[i]]
+		select {
+		case <-ar.done:
+			delete(apiRuns.m, ar.id)
+			apiRuns.ids = append(apiRuns.ids[:i], apiRuns.ids[i+1:]...)
+		default:
+			i++
+		}
+	}
+}
+
+func apiListRuns(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	apiRuns.Lock()
+	res := make([]apiRunStatus, 0, len(apiRuns.ids))
+	for i := len(apiRuns.ids) - 1; i >= 0; i-- {
+		res = append(res, apiRuns.m[apiRuns.ids[i]].status())
+	}
+	apiRuns.Unlock()
+	apiJSON(w, http.StatusOK, res)
+}
+
+// apiRunHandler handles GET /runs/<id>, GET /runs/<id>/progress and
+// POST /runs/<id>/cancel.
+func apiRunHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/runs/"), "/"), "/")
+	apiRuns.Lock()
+	ar := apiRuns.m[parts[0]]
+	apiRuns.Unlock()
+	if ar == nil || len(parts) > 2 {
+		apiError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	var action string
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		apiJSON(w, http.StatusOK, ar.status())
+	case action == "progress" && r.Method == http.MethodGet:
+		apiStreamProgress(w, r, ar)
+	case action == "cancel" && r.Method == http.MethodPost:
+		logFor(withRunID(r.Context(), ar.id)).warnf("%s cancelled through the API", ar.job.Name())
+		ar.cancel()
+		apiJSON(w, http.StatusAccepted, ar.status())
+	case action == "" || action == "progress" || action == "cancel":
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+	default:
+		apiError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// apiStreamProgress writes the status of ar every second, as a JSON object
+// per line, until the run is over or the client goes away.
+func apiStreamProgress(w http.ResponseWriter, r *http.Request, ar *apiRun) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		var finished bool
+		select {
+		case <-ar.done:
+			finished = true
+		default:
+		}
+		if err := enc.Encode(ar.status()); err != nil || finished {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		select {
+		case <-ar.done:
+		case <-t.C:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
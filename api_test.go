@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestApplyOverrides(t *testing.T) {
+	tests := []struct {
+		params map[string]interface{}
+		err    string
+	}{
+		{params: map[string]interface{}{"CacheTotalHits": true, "scanchunksize": float64(500), "RecalculatePPModes": "std"}},
+		{params: map[string]interface{}{"CacheTotalHits": 1.0}, err: "CacheTotalHits must be a boolean"},
+		{params: map[string]interface{}{"ScanChunkSize": 1.5}, err: "ScanChunkSize must be an integer"},
+		{params: map[string]interface{}{"ScanChunkSize": 0.0}, err: "ScanChunkSize"},
+		{params: map[string]interface{}{"RecalculatePPModes": "ctb"}, err: "RecalculatePPModes"},
+		{params: map[string]interface{}{"NoSuchOption": true}, err: "NoSuchOption can't be overridden"},
+	}
+	for _, option := range []string{"Workers", "BatchSize", "Retries", "WriteRateLimit", "MaxThreadsRunning",
+		"MaxReplicationLag", "MaxReadLag", "PrunePendingVerificationAfter", "LockJobs", "DSN"} {
+		tests = append(tests, struct {
+			params map[string]interface{}
+			err    string
+		}{map[string]interface{}{option: 1.0}, option + " can't be overridden"})
+	}
+	for _, test := range tests {
+		cfg := c
+		err := applyOverrides(&cfg, test.params)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%v: %v", test.params, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%v: got error %v, want %q", test.params, err, test.err)
+		}
+	}
+
+	cfg := c
+	if err := applyOverrides(&cfg, map[string]interface{}{"cachetotalhits": true, "ScanChunkSize": 500.0}); err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.CacheTotalHits || cfg.ScanChunkSize != 500 || c.ScanChunkSize == 500 {
+		t.Errorf("the options weren't overridden in the copy only: %+v", cfg)
+	}
+}
+
+func TestAPIAuth(t *testing.T) {
+	oldToken := c.APIToken
+	defer func() { c.APIToken = oldToken }()
+	c.APIToken = "secret"
+	h := apiAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for header, want := range map[string]int{
+		"Bearer secret":  http.StatusOK,
+		"secret":         http.StatusUnauthorized,
+		"Bearer secret2": http.StatusUnauthorized,
+		"Bearer ":        http.StatusUnauthorized,
+		"Basic secret":   http.StatusUnauthorized,
+		"":               http.StatusUnauthorized,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/jobs", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("%q: got status %d, want %d", header, w.Code, want)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"sync/atomic"
+)
+
+// batchKind is the kind of statement a batchRow is part of.
+type batchKind int
+
+const (
+	batchUpdate batchKind = iota
+	batchUpsert
+	batchDelete
+)
+
+// batchRow describes an operation which writes a single row, so that it can
+// be merged with the operations writing other rows of the same table.
+type batchRow struct {
+	kind  batchKind
+	table string
+	// idCol is the primary key column, used by batchUpdate and batchDelete.
+	idCol string
+	id    interface{}
+	// cols are the columns set by batchUpdate and inserted by batchUpsert,
+	// and values their values.
+	cols   []string
+	values []interface{}
+	// updateCols are the columns batchUpsert updates if the row exists.
+	updateCols []string
+}
+
+// signature is the same for the rows which can be written by the same
+// statement.
+func (r *batchRow) signature() string {
+	return strings.Join([]string{
+		string(rune('0' + r.kind)), r.table, r.idCol,
+		strings.Join(r.cols, ","), strings.Join(r.updateCols, ","),
+	}, "|")
+}
+
+// placeholders is the largest number of placeholders the row adds to the
+// statement it's merged into.
+func (r *batchRow) placeholders() int {
+	switch r.kind {
+	case batchUpsert:
+		return len(r.cols)
+	case batchDelete:
+		return 1
+	}
+	// WHEN ? THEN ? for each column, and the id in IN (...)
+	return 2*len(r.cols) + 1
+}
+
+// maxPlaceholders is the largest number of placeholders MySQL accepts in a
+// prepared statement.
+const maxPlaceholders = 65535
+
+// opUpdate queues "UPDATE table SET col = ?, ... WHERE idCol = id". It's
+// merged with the other updates of the same columns into a single statement.
+func opUpdate(ctx context.Context, table, idCol string, id interface{}, cols []string, values ...interface{}) {
+	query := "UPDATE " + table + " SET " + strings.Join(cols, " = ?, ") + " = ? WHERE " + idCol + " = ?"
+	queueOperation(ctx, execOperations, operation{
+		query:  query,
+		params: append(append([]interface{}(nil), values...), id),
+		row:    &batchRow{kind: batchUpdate, table: table, idCol: idCol, id: id, cols: cols, values: values},
+	})
+}
+
+// opUpsert queues an INSERT of a row, which updates updateCols to the new
+// values if the row already exists. It's merged with the other upserts of the
+// same columns into a single statement.
+func opUpsert(ctx context.Context, table string, cols, updateCols []string, values ...interface{}) {
+	queueOperation(ctx, execOperations, operation{
+		query:  upsertQuery(table, cols, updateCols, 1),
+		params: values,
+		row:    &batchRow{kind: batchUpsert, table: table, cols: cols, values: values, updateCols: updateCols},
+	})
+}
+
+// opDelete queues "DELETE FROM table WHERE idCol = id". It's merged with the
+// other deletes from the same table into a single statement.
+func opDelete(ctx context.Context, table, idCol string, id interface{}) {
+	queueOperation(ctx, execOperations, operation{
+		query:  "DELETE FROM " + table + " WHERE " + idCol + " = ?",
+		params: []interface{}{id},
+		row:    &batchRow{kind: batchDelete, table: table, idCol: idCol, id: id},
+	})
+}
+
+func upsertQuery(table string, cols, updateCols []string, rows int) string {
+	row := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(cols)), ", ") + ")"
+	updates := make([]string, len(updateCols))
+	for i, col := range updateCols {
+		updates[i] = col + " = VALUES(" + col + ")"
+	}
+	return "INSERT INTO " + table + " (" + strings.Join(cols, ", ") + ") VALUES " +
+		strings.TrimSuffix(strings.Repeat(row+", ", rows), ", ") +
+		" ON DUPLICATE KEY UPDATE " + strings.Join(updates, ", ")
+}
+
+// collectBatch appends to ops the operations waiting in ch, until there are
+// BatchSize of them.
+func collectBatch(ch <-chan operation, ops []operation) []operation {
+	for len(ops) < c.BatchSize {
+		select {
+		case op, ok := <-ch:
+			if !ok {
+				return ops
+			}
+			ops = append(ops, op)
+		default:
+			return ops
+		}
+	}
+	return ops
+}
+
+// statement is a query executed as part of a batch, and the operations it
+// executes.
+type statement struct {
+	query  string
+	params []interface{}
+	ops    []operation
+}
+
+// mergeOperations turns ops into as few statements as possible. Operations
+// writing the same kind of row of the same table, queued by the same run, are
+// merged into a single statement, or several ones if it would have more than
+// maxPlaceholders; if several of them update the same row, the last one
+// wins, like it would if they were executed in order.
+func mergeOperations(ops []operation) []statement {
+	type key struct {
+		sig string
+		run *jobRun
+	}
+	var stmts []statement
+	// placeholders are the placeholders of each statement
+	var placeholders []int
+	groups := make(map[key]int)
+	for _, op := range ops {
+		if op.row == nil {
+			stmts = append(stmts, statement{op.query, op.params, []operation{op}})
+			placeholders = append(placeholders, len(op.params))
+			continue
+		}
+		k := key{op.row.signature(), op.run}
+		n := op.row.placeholders()
+		i, ok := groups[k]
+		if !ok || placeholders[i]+n > maxPlaceholders {
+			i = len(stmts)
+			groups[k] = i
+			stmts = append(stmts, statement{})
+			placeholders = append(placeholders, 0)
+		}
+		stmts[i].ops = append(stmts[i].ops, op)
+		placeholders[i] += n
+	}
+	for i := range stmts {
+		if stmts[i].query == "" {
+			stmts[i].query, stmts[i].params = mergeRows(stmts[i].ops)
+		}
+	}
+	return stmts
+}
+
+// mergeRows builds the statement writing the rows of ops, which all have the
+// same signature.
+func mergeRows(ops []operation) (string, []interface{}) {
+	if len(ops) == 1 {
+		return ops[0].query, ops[0].params
+	}
+	first := ops[0].row
+	if first.kind == batchUpsert {
+		var params []interface{}
+		for _, op := range ops {
+			params = append(params, op.row.values...)
+		}
+		return upsertQuery(first.table, first.cols, first.updateCols, len(ops)), params
+	}
+
+	// keep the last write of each row
+	last := make(map[interface{}]int, len(ops))
+	var ids []interface{}
+	for i, op := range ops {
+		if _, ok := last[op.row.id]; !ok {
+			ids = append(ids, op.row.id)
+		}
+		last[op.row.id] = i
+	}
+	in := " WHERE " + first.idCol + " IN (" + strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ") + ")"
+	if first.kind == batchDelete {
+		return "DELETE FROM " + first.table + in, ids
+	}
+
+	// UPDATE t SET a = CASE id WHEN ? THEN ? ... END, ... WHERE id IN (...)
+	var b strings.Builder
+	var params []interface{}
+	b.WriteString("UPDATE " + first.table + " SET ")
+	for i, col := range first.cols {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(col + " = CASE " + first.idCol)
+		for _, id := range ids {
+			b.WriteString(" WHEN ? THEN ?")
+			params = append(params, id, ops[last[id]].row.values[i])
+		}
+		b.WriteString(" END")
+	}
+	b.WriteString(in)
+	return b.String(), append(params, ids...)
+}
+
+// runBatch executes ops. A single operation is executed on its own; several
+// operations are merged by mergeOperations and executed in a transaction,
+// which is retried as a whole if it fails with a retryable error. If it
+// fails for good, the operations are executed again one by one, so that only
+// the ones which fail are reported and saved to DeadLetterFile.
+func runBatch(ops []operation) {
+	if len(ops) == 1 || dryRun {
+		for _, op := range ops {
+			runOperation(op)
+		}
+		return
+	}
+
+	stmts := mergeOperations(ops)
+	l := baseLog.with("component", "Batch")
+	var results []sql.Result
+	err := withRetry(l, "(batch)", func() error {
+		var err error
+		results, err = execStatements(l, stmts)
+		return err
+	})
+	if err != nil {
+		l.with("operations", len(ops), "error", err).warnf("the batch failed, executing the operations one by one")
+		for _, op := range ops {
+			runOperation(op)
+		}
+		return
+	}
+	for i, stmt := range stmts {
+		jr := stmt.ops[0].run
+		if jr == nil {
+			continue
+		}
+		if n, err := results[i].RowsAffected(); err == nil {
+			atomic.AddInt64(&jr.rowsAffected, n)
+		}
+	}
+}
+
+// execStatements executes stmts in a transaction.
+func execStatements(l logger, stmts []statement) ([]sql.Result, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	results := make([]sql.Result, len(stmts))
+	for i, stmt := range stmts {
+		if logEnabled(levelTrace) {
+			l.with("query", stmt.query, "params", stmt.params, "operations", len(stmt.ops)).tracef("executing query")
+		}
+		results[i], err = tx.Exec(stmt.query, stmt.params...)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	return results, tx.Commit()
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+)
+
+// testOps returns n updates of users_stats, queued by jr.
+func testOps(jr *jobRun, n int) []operation {
+	ops := make([]operation, n)
+	for i := range ops {
+		row := &batchRow{kind: batchUpdate, table: "users_stats", idCol: "id", id: i + 1,
+			cols: []string{"pp_std"}, values: []interface{}{float64(i * 100)}}
+		ops[i] = operation{
+			query:  "UPDATE users_stats SET pp_std = ? WHERE id = ?",
+			params: []interface{}{float64(i * 100), i + 1},
+			run:    jr,
+			row:    row,
+		}
+	}
+	return ops
+}
+
+// TestRunBatchRetry checks that the batches failing with a retryable error
+// are retried, even if it's the commit which failed, as the operations are
+// idempotent, and that the other ones are executed again one by one.
+func TestRunBatchRetry(t *testing.T) {
+	tests := []struct {
+		name      string
+		expect    func(mock sqlmock.Sqlmock, query string)
+		failedOps int64
+	}{
+		{"lost connection before the commit", func(mock sqlmock.Sqlmock, query string) {
+			mock.ExpectBegin()
+			mock.ExpectExec(query).WillReturnError(&mysql.MySQLError{Number: 2013})
+			mock.ExpectRollback()
+			mock.ExpectBegin()
+			mock.ExpectExec(query).WillReturnResult(sqlmock.NewResult(0, 2))
+			mock.ExpectCommit()
+		}, 0},
+		{"deadlock on commit", func(mock sqlmock.Sqlmock, query string) {
+			mock.ExpectBegin()
+			mock.ExpectExec(query).WillReturnResult(sqlmock.NewResult(0, 2))
+			mock.ExpectCommit().WillReturnError(&mysql.MySQLError{Number: 1213})
+			mock.ExpectBegin()
+			mock.ExpectExec(query).WillReturnResult(sqlmock.NewResult(0, 2))
+			mock.ExpectCommit()
+		}, 0},
+		{"lost connection on commit", func(mock sqlmock.Sqlmock, query string) {
+			mock.ExpectBegin()
+			mock.ExpectExec(query).WillReturnResult(sqlmock.NewResult(0, 2))
+			mock.ExpectCommit().WillReturnError(&mysql.MySQLError{Number: 2013})
+			mock.ExpectBegin()
+			mock.ExpectExec(query).WillReturnResult(sqlmock.NewResult(0, 2))
+			mock.ExpectCommit()
+		}, 0},
+		{"error which isn't retried", func(mock sqlmock.Sqlmock, query string) {
+			mock.ExpectBegin()
+			mock.ExpectExec(query).WillReturnError(errors.New("syntax error"))
+			mock.ExpectRollback()
+			// executed one by one
+			mock.ExpectExec(regexp.QuoteMeta("UPDATE users_stats SET pp_std = ? WHERE id = ?")).
+				WithArgs(0.0, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(regexp.QuoteMeta("UPDATE users_stats SET pp_std = ? WHERE id = ?")).
+				WithArgs(100.0, 2).WillReturnResult(sqlmock.NewResult(0, 1))
+		}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock := setupMockDB(t, 1)
+			c.DeadLetterFile = ""
+			jr := &jobRun{job: &basicJob{name: "TestRunBatchRetry"}, log: baseLog}
+			ops := testOps(jr, 2)
+			test.expect(mock, regexp.QuoteMeta(mergeOperations(ops)[0].query))
+			runBatch(ops)
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+			if n := atomic.LoadInt64(&jr.opsFailed); n != test.failedOps {
+				t.Errorf("got %d failed operations, want %d", n, test.failedOps)
+			}
+		})
+	}
+}
+
+func TestMergeOperationsPlaceholders(t *testing.T) {
+	// 3 placeholders per row: 21845 rows per statement
+	ops := testOps(nil, 30000)
+	stmts := mergeOperations(ops)
+	if len(stmts) != 2 {
+		t.Fatalf("got %d statements, want 2", len(stmts))
+	}
+	var merged int
+	for i, stmt := range stmts {
+		n := strings.Count(stmt.query, "?")
+		if n > maxPlaceholders || n != len(stmt.params) {
+			t.Errorf("statement %d: %d placeholders and %d params, want them equal and at most %d", i, n, len(stmt.params), maxPlaceholders)
+		}
+		merged += len(stmt.ops)
+	}
+	if merged != len(ops) || len(stmts[0].ops) != 21845 {
+		t.Errorf("got %d and %d operations, want 21845 and %d", len(stmts[0].ops), len(stmts[1].ops), len(ops)-21845)
+	}
+}
+
+// queued returns the operations queued by f.
+func queued(f func()) []operation {
+	f()
+	var ops []operation
+	for {
+		select {
+		case op := <-execOperations:
+			ops = append(ops, op)
+		default:
+			return ops
+		}
+	}
+}
+
+func TestUpsertQuery(t *testing.T) {
+	tests := []struct {
+		cols, updateCols []string
+		rows             int
+		want             string
+	}{
+		{[]string{"user_id", "pp"}, []string{"pp"}, 1,
+			"INSERT INTO pp_history (user_id, pp) VALUES (?, ?) ON DUPLICATE KEY UPDATE pp = VALUES(pp)"},
+		{[]string{"user_id", "mode", "pp", "rank"}, []string{"pp", "rank"}, 2,
+			"INSERT INTO pp_history (user_id, mode, pp, rank) VALUES (?, ?, ?, ?), (?, ?, ?, ?) " +
+				"ON DUPLICATE KEY UPDATE pp = VALUES(pp), rank = VALUES(rank)"},
+	}
+	for _, test := range tests {
+		if got := upsertQuery("pp_history", test.cols, test.updateCols, test.rows); got != test.want {
+			t.Errorf("got %q, want %q", got, test.want)
+		}
+	}
+}
+
+func TestMergeOperations(t *testing.T) {
+	ctx := context.Background()
+	jrA := &jobRun{job: &basicJob{name: "A"}}
+	jrB := &jobRun{job: &basicJob{name: "B"}}
+	pp := []string{"pp_std"}
+	type stmt struct {
+		query  string
+		params []interface{}
+		ops    int
+	}
+	tests := []struct {
+		name  string
+		queue func()
+		want  []stmt
+	}{
+		{"single update", func() {
+			opUpdate(ctx, "users_stats", "id", 1, pp, 10.0)
+		}, []stmt{
+			{"UPDATE users_stats SET pp_std = ? WHERE id = ?", []interface{}{10.0, 1}, 1},
+		}},
+		{"updates of the same columns", func() {
+			opUpdate(ctx, "users_stats", "id", 1, pp, 10.0)
+			opUpdate(ctx, "users_stats", "id", 2, pp, 20.0)
+		}, []stmt{
+			{"UPDATE users_stats SET pp_std = CASE id WHEN ? THEN ? WHEN ? THEN ? END WHERE id IN (?, ?)",
+				[]interface{}{1, 10.0, 2, 20.0, 1, 2}, 2},
+		}},
+		{"several updates of a row", func() {
+			opUpdate(ctx, "users_stats", "id", 1, []string{"pp_std", "avg_accuracy_std"}, 10.0, 0.9)
+			opUpdate(ctx, "users_stats", "id", 2, []string{"pp_std", "avg_accuracy_std"}, 20.0, 0.8)
+			opUpdate(ctx, "users_stats", "id", 1, []string{"pp_std", "avg_accuracy_std"}, 30.0, 0.95)
+		}, []stmt{
+			{"UPDATE users_stats SET pp_std = CASE id WHEN ? THEN ? WHEN ? THEN ? END, " +
+				"avg_accuracy_std = CASE id WHEN ? THEN ? WHEN ? THEN ? END WHERE id IN (?, ?)",
+				[]interface{}{1, 30.0, 2, 20.0, 1, 0.95, 2, 0.8, 1, 2}, 3},
+		}},
+		{"updates of other columns", func() {
+			opUpdate(ctx, "users_stats", "id", 1, pp, 10.0)
+			opUpdate(ctx, "users_stats", "id", 2, []string{"pp_taiko"}, 20.0)
+			opUpdate(ctx, "users_stats", "id", 3, pp, 30.0)
+			opUpdate(ctx, "users_stats_relax", "id", 4, pp, 40.0)
+		}, []stmt{
+			{"UPDATE users_stats SET pp_std = CASE id WHEN ? THEN ? WHEN ? THEN ? END WHERE id IN (?, ?)",
+				[]interface{}{1, 10.0, 3, 30.0, 1, 3}, 2},
+			{"UPDATE users_stats SET pp_taiko = ? WHERE id = ?", []interface{}{20.0, 2}, 1},
+			{"UPDATE users_stats_relax SET pp_std = ? WHERE id = ?", []interface{}{40.0, 4}, 1},
+		}},
+		{"deletes", func() {
+			opDelete(ctx, "scores", "id", 5)
+			opDelete(ctx, "scores", "id", 6)
+			opDelete(ctx, "scores", "id", 5)
+		}, []stmt{
+			{"DELETE FROM scores WHERE id IN (?, ?)", []interface{}{5, 6}, 3},
+		}},
+		{"upserts", func() {
+			// MySQL inserts the rows in order, so the last one wins
+			opUpsert(ctx, "pp_history", []string{"user_id", "pp"}, []string{"pp"}, 1, 100.0)
+			opUpsert(ctx, "pp_history", []string{"user_id", "pp"}, []string{"pp"}, 2, 200.0)
+			opUpsert(ctx, "pp_history", []string{"user_id", "pp"}, []string{"pp"}, 1, 300.0)
+		}, []stmt{
+			{"INSERT INTO pp_history (user_id, pp) VALUES (?, ?), (?, ?), (?, ?) ON DUPLICATE KEY UPDATE pp = VALUES(pp)",
+				[]interface{}{1, 100.0, 2, 200.0, 1, 300.0}, 3},
+		}},
+		{"raw operations", func() {
+			op(ctx, "UPDATE users SET privileges = 0 WHERE id = ?", 7)
+			opUpdate(ctx, "users_stats", "id", 1, pp, 10.0)
+			op(ctx, "DELETE FROM users WHERE id = ?", 8)
+			opUpdate(ctx, "users_stats", "id", 2, pp, 20.0)
+			opDelete(ctx, "scores", "id", 5)
+		}, []stmt{
+			{"UPDATE users SET privileges = 0 WHERE id = ?", []interface{}{7}, 1},
+			{"UPDATE users_stats SET pp_std = CASE id WHEN ? THEN ? WHEN ? THEN ? END WHERE id IN (?, ?)",
+				[]interface{}{1, 10.0, 2, 20.0, 1, 2}, 2},
+			{"DELETE FROM users WHERE id = ?", []interface{}{8}, 1},
+			{"DELETE FROM scores WHERE id = ?", []interface{}{5}, 1},
+		}},
+		{"operations of other runs", func() {
+			opUpdate(withJobRun(ctx, jrA), "users_stats", "id", 1, pp, 10.0)
+			opUpdate(withJobRun(ctx, jrB), "users_stats", "id", 2, pp, 20.0)
+			opUpdate(withJobRun(ctx, jrA), "users_stats", "id", 3, pp, 30.0)
+		}, []stmt{
+			{"UPDATE users_stats SET pp_std = CASE id WHEN ? THEN ? WHEN ? THEN ? END WHERE id IN (?, ?)",
+				[]interface{}{1, 10.0, 3, 30.0, 1, 3}, 2},
+			{"UPDATE users_stats SET pp_std = ? WHERE id = ?", []interface{}{20.0, 2}, 1},
+		}},
+	}
+	for _, test := range tests {
+		stmts := mergeOperations(queued(test.queue))
+		var got []stmt
+		for _, s := range stmts {
+			got = append(got, stmt{s.query, s.params, len(s.ops)})
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got\n%v\nwant\n%v", test.name, got, test.want)
+		}
+	}
+}
+
+// TestRunBatchTransaction checks that the merged and the raw operations of a
+// batch are executed in the same transaction.
+func TestRunBatchTransaction(t *testing.T) {
+	mock := setupMockDB(t, 0)
+	ctx := context.Background()
+	ops := queued(func() {
+		opUpdate(ctx, "users_stats", "id", 1, []string{"pp_std"}, 10.0)
+		op(ctx, "UPDATE users SET privileges = 0 WHERE id = ?", 7)
+		opUpdate(ctx, "users_stats", "id", 2, []string{"pp_std"}, 20.0)
+	})
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users_stats SET pp_std = CASE id WHEN ? THEN ? WHEN ? THEN ? END WHERE id IN (?, ?)")).
+		WithArgs(1, 10.0, 2, 20.0, 1, 2).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET privileges = 0 WHERE id = ?")).
+		WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	runBatch(ops)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
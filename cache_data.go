@@ -1,16 +1,36 @@
 package main
 
 import (
+	"context"
 	"strconv"
 
-	"github.com/fatih/color"
 	"zxq.co/ripple/ocl"
 )
 
+func init() {
+	registerJob(&basicJob{
+		name:        "CacheData",
+		description: "Caches ranked score, total hits, play time and most played beatmaps of every user, as enabled by the Cache* options.",
+		enabled:     cacheDataEnabled,
+		// both write the ranked score in users_stats
+		deps: []string{"FixStatsOverflow"},
+		run:  opCacheData,
+	})
+	registerJob(&basicJob{
+		name:        "CacheLevel",
+		description: "Caches the level of every user from their total score.",
+		enabled:     func(c *config) bool { return c.CacheLevel },
+		run:         opCacheLevel,
+	})
+}
+
+func cacheDataEnabled(c *config) bool {
+	return c.CacheTotalHits || c.CacheRankedScore || c.CachePlayTime || c.CacheMostPlayedBeatmaps
+}
+
 type s struct {
 	rankedScore int64
 	totalHits   int64
-	level       int
 	playTime    int64
 }
 
@@ -20,34 +40,31 @@ type mostPlayedK struct {
 	beatmapID int
 }
 
-func opCacheData() {
-	defer wg.Done()
+func opCacheData(ctx context.Context) error {
+	cfg := configFromContext(ctx)
 	// get data
-	const fetchQuery = `
-	SELECT
-		scores.userid, scores.play_mode,
+	rows := newScoreScanner(ctx, scanQuery{
+		cols: `scores.userid, scores.play_mode,
 		scores.score, scores.completed, scores.300_count,
-		scores.100_count, scores.50_count, scores.playtime, beatmaps.beatmap_id 
-	FROM scores JOIN beatmaps USING(beatmap_md5)`
-	rows, err := db.Query(fetchQuery)
-	if err != nil {
-		queryError(err, fetchQuery)
-		return
-	}
+		scores.100_count, scores.50_count, scores.playtime, beatmaps.beatmap_id`,
+		from: "scores JOIN beatmaps USING(beatmap_md5)",
+	}, 0)
+	defer rows.Close()
 
 	// set up end map where all the data is
 	data := make(map[int]*[4]*s)
 	var mostPlayedData map[mostPlayedK]int
-	if c.CacheMostPlayedBeatmaps {
+	if cfg.CacheMostPlayedBeatmaps {
 		mostPlayedData = make(map[mostPlayedK]int)
 	}
 
 	count := 0
 
-	// analyse every result row of fetchQuery
+	// analyse every score
 	for rows.Next() {
+		countRows(ctx, 1)
 		if count%1000 == 0 {
-			verboseln("> CacheData:", count)
+			logFor(ctx).with("rows_processed", count).debugf("processed")
 		}
 		var (
 			uid       int
@@ -64,7 +81,7 @@ func opCacheData() {
 			&uid, &playMode, &score, &completed, &count300, &count100, &count50, &playTime, &beatmapID,
 		)
 		if err != nil {
-			queryError(err, fetchQuery)
+			queryError(ctx, err, rows.Query())
 			continue
 		}
 		// silently ignore invalid modes
@@ -79,64 +96,29 @@ func opCacheData() {
 			}
 		}
 		// if the score counts as completed and top score, add it to the ranked score sum
-		if c.CacheRankedScore && completed == 3 {
+		if cfg.CacheRankedScore && completed == 3 {
 			data[uid][playMode].rankedScore += score
 		}
 		// add to the number of totalhits count of {300,100,50} hits
-		if c.CacheTotalHits {
+		if cfg.CacheTotalHits {
 			data[uid][playMode].totalHits += int64(count300) + int64(count100) + int64(count50)
 		}
 		// play time
-		if c.CachePlayTime {
+		if cfg.CachePlayTime {
 			data[uid][playMode].playTime += int64(playTime)
 		}
 		// most played beatmaps
-		if c.CacheMostPlayedBeatmaps {
+		if cfg.CacheMostPlayedBeatmaps {
 			mostPlayedData[mostPlayedK{uid, playMode, beatmapID}]++
 		}
 		count++
 	}
-	rows.Close()
-
-	if c.CacheLevel {
-		const totalScoreQuery = "SELECT id, total_score_std, total_score_taiko, total_score_ctb, total_score_mania FROM users_stats"
-		rows, err := db.Query(totalScoreQuery)
-		if err != nil {
-			queryError(err, totalScoreQuery)
-			return
-		}
-		count = 0
-		for rows.Next() {
-			if count%100 == 0 {
-				verboseln("> CacheLevel:", count)
-			}
-			var (
-				id    int
-				std   int64
-				taiko int64
-				ctb   int64
-				mania int64
-			)
-			err := rows.Scan(&id, &std, &taiko, &ctb, &mania)
-			if err != nil {
-				queryError(err, totalScoreQuery)
-				continue
-			}
-			if _, ex := data[id]; !ex {
-				data[id] = &[4]*s{}
-				for i := 0; i < 4; i++ {
-					data[id][i] = &s{}
-				}
-			}
-			data[id][0].level = ocl.GetLevel(std)
-			data[id][1].level = ocl.GetLevel(taiko)
-			data[id][2].level = ocl.GetLevel(ctb)
-			data[id][3].level = ocl.GetLevel(mania)
-			count++
-		}
-		rows.Close()
+	if err := rows.Err(); err != nil {
+		queryError(ctx, err, rows.Query())
+		return err
 	}
-	if c.CacheMostPlayedBeatmaps {
+
+	if cfg.CacheMostPlayedBeatmaps {
 		// Blocks until the table has been truncated
 		// verboseln("> MostPlayedBeatmaps: Truncating table")
 		// runOperation(operation{"TRUNCATE TABLE users_beatmap_playcount", nil})
@@ -145,23 +127,29 @@ func opCacheData() {
 		// Start populating the table once it's been truncated
 		done, ignored := 0, 0
 		for k, v := range mostPlayedData {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			if v < 3 {
 				ignored++
 				if ignored%1000 == 0 {
-					verboseln("> MostPlayedBeatmaps: Ignored", ignored)
+					logFor(ctx).with("ignored", ignored).debugf("MostPlayedBeatmaps: ignored")
 				}
 			} else {
-				op("INSERT INTO users_beatmap_playcount (user_id, beatmap_id, game_mode, playcount)"+
-					"VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE playcount = ?", k.userID, k.beatmapID, k.playMode, v, v)
+				opUpsert(ctx, "users_beatmap_playcount", []string{"user_id", "beatmap_id", "game_mode", "playcount"},
+					[]string{"playcount"}, k.userID, k.beatmapID, k.playMode, v)
 				done++
 				if done%1000 == 0 {
-					verboseln("> MostPlayedBeatmaps: Done", done)
+					logFor(ctx).with("done", done).debugf("MostPlayedBeatmaps: done")
 				}
 			}
 			delete(mostPlayedData, k)
 		}
 	}
 	for k, v := range data {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		if v == nil {
 			continue
 		}
@@ -169,40 +157,65 @@ func opCacheData() {
 			if modeData == nil {
 				continue
 			}
-			var setQ string
+			var cols []string
 			var params []interface{}
-			if c.CacheRankedScore {
-				setQ += "ranked_score_" + modeToString(modeInt) + " = ?"
+			if cfg.CacheRankedScore {
+				cols = append(cols, "ranked_score_"+modeToString(modeInt))
 				params = append(params, (*modeData).rankedScore)
 			}
-			if c.CacheTotalHits {
-				if setQ != "" {
-					setQ += ", "
-				}
-				setQ += "total_hits_" + modeToString(modeInt) + " = ?"
+			if cfg.CacheTotalHits {
+				cols = append(cols, "total_hits_"+modeToString(modeInt))
 				params = append(params, (*modeData).totalHits)
 			}
-			if c.CacheLevel {
-				if setQ != "" {
-					setQ += ", "
-				}
-				setQ += "level_" + modeToString(modeInt) + " = ?"
-				params = append(params, (*modeData).level)
-			}
-			if c.CachePlayTime {
-				if setQ != "" {
-					setQ += ", "
-				}
-				setQ += "playtime_" + modeToString(modeInt) + " = ?"
+			if cfg.CachePlayTime {
+				cols = append(cols, "playtime_"+modeToString(modeInt))
 				params = append(params, (*modeData).playTime)
 			}
-			if setQ != "" {
-				params = append(params, k)
-				op("UPDATE users_stats SET "+setQ+" WHERE id = ?", params...)
+			if len(cols) > 0 {
+				opUpdate(ctx, "users_stats", "id", k, cols, params...)
 			}
 		}
 	}
-	color.Green("> CacheData: done!")
+	logFor(ctx).infof("done!")
+	return nil
+}
+
+func opCacheLevel(ctx context.Context) error {
+	const totalScoreQuery = "SELECT id, total_score_std, total_score_taiko, total_score_ctb, total_score_mania FROM users_stats"
+	rows, err := readDB.QueryContext(ctx, totalScoreQuery)
+	if err != nil {
+		queryError(ctx, err, totalScoreQuery)
+		return err
+	}
+	defer rows.Close()
+	count := 0
+	for rows.Next() {
+		countRows(ctx, 1)
+		if count%100 == 0 {
+			logFor(ctx).with("rows_processed", count).debugf("processed")
+		}
+		var (
+			id    int
+			std   int64
+			taiko int64
+			ctb   int64
+			mania int64
+		)
+		err := rows.Scan(&id, &std, &taiko, &ctb, &mania)
+		if err != nil {
+			queryError(ctx, err, totalScoreQuery)
+			continue
+		}
+		opUpdate(ctx, "users_stats", "id", id, []string{"level_std", "level_taiko", "level_ctb", "level_mania"},
+			ocl.GetLevel(std), ocl.GetLevel(taiko), ocl.GetLevel(ctb), ocl.GetLevel(mania))
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		queryError(ctx, err, totalScoreQuery)
+		return err
+	}
+	logFor(ctx).infof("done!")
+	return nil
 }
 
 var modes = [...]string{
@@ -218,3 +231,14 @@ func modeToString(modeID int) string {
 	}
 	return strconv.Itoa(modeID)
 }
+
+// modeFromString returns the ID of the mode with the given name (std, taiko,
+// ctb or mania), or -1 if there is none.
+func modeFromString(name string) int {
+	for i, m := range modes {
+		if m == name {
+			return i
+		}
+	}
+	return -1
+}
@@ -1,25 +1,37 @@
 package main
 
 import (
+	"context"
 	"math"
-
-	"github.com/fatih/color"
 )
 
-func opCalculateAccuracy() {
-	defer wg.Done()
-	const initQuery = "SELECT id, 300_count, 100_count, 50_count, gekis_count, katus_count, misses_count, play_mode, accuracy FROM scores"
-	rows, err := db.Query(initQuery)
+func init() {
+	registerJob(&basicJob{
+		name:        "CalculateAccuracy",
+		description: "Re-calculates the accuracy of every score.",
+		enabled:     func(c *config) bool { return c.CalculateAccuracy },
+		run:         opCalculateAccuracy,
+	})
+}
+
+func opCalculateAccuracy(ctx context.Context) error {
+	cp := newCheckpointer(ctx, "")
+	cursor, err := cp.resume(nil)
 	if err != nil {
-		queryError(err, initQuery)
+		return err
 	}
+	rows := newScoreScanner(ctx, scanQuery{
+		cols: "300_count, 100_count, 50_count, gekis_count, katus_count, misses_count, play_mode, accuracy",
+		from: "scores",
+	}, cursor)
+	defer rows.Close()
 	count := 0
 	for rows.Next() {
+		countRows(ctx, 1)
 		if count%1000 == 0 {
-			verboseln("> CalculateAccuracy:", count)
+			logFor(ctx).with("rows_processed", count).debugf("processed")
 		}
 		var (
-			id        int
 			count300  int
 			count100  int
 			count50   int
@@ -29,9 +41,9 @@ func opCalculateAccuracy() {
 			playMode  int
 			accuracy  *float64
 		)
-		err := rows.Scan(&id, &count300, &count100, &count50, &countgeki, &countkatu, &countmiss, &playMode, &accuracy)
+		err := rows.Scan(&count300, &count100, &count50, &countgeki, &countkatu, &countmiss, &playMode, &accuracy)
 		if err != nil {
-			queryError(err, initQuery)
+			queryError(ctx, err, rows.Query())
 			continue
 		}
 		if accuracy == nil {
@@ -41,12 +53,19 @@ func opCalculateAccuracy() {
 		newAcc := calculateAccuracy(count300, count100, count50, countgeki, countkatu, countmiss, playMode)
 		// if accuracies are not accurate to the .001
 		if !math.IsNaN(newAcc) && math.Floor(newAcc*1000) != math.Floor((*accuracy)*1000) {
-			op("UPDATE scores SET accuracy = ? WHERE id = ?", newAcc, id)
+			opUpdate(ctx, "scores", "id", rows.Cursor(), []string{"accuracy"}, newAcc)
 		}
 		count++
+		cp.maybeSave(rows.Cursor(), nil)
+	}
+	if err := rows.Err(); err != nil {
+		queryError(ctx, err, rows.Query())
+		cp.save(rows.Cursor(), nil)
+		return err
 	}
-	rows.Close()
-	color.Green("> CalculateAccuracy: done!")
+	cp.clear()
+	logFor(ctx).infof("done!")
+	return nil
 }
 
 func calculateAccuracy(count300, count100, count50, countgeki, countkatu, countmiss, playMode int) float64 {
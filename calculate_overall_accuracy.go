@@ -1,13 +1,24 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"math"
 	"sort"
-
-	"github.com/fatih/color"
 )
 
+func init() {
+	registerJob(&basicJob{
+		name:        "CalculateOverallAccuracy",
+		description: "Re-calculates the average accuracy of every user.",
+		enabled:     func(c *config) bool { return c.CalculateOverallAccuracy },
+		// the average is weighted by the pp, and made of the accuracy, of
+		// the scores
+		deps: []string{"CalculateAccuracy", "RecalculateScoresPP"},
+		run:  opCalculateOverallAccuracy,
+	})
+}
+
 // CLUSTERFUCK AHEAD DO NOT TOUCH
 
 type calculateOverallAccuracyElement struct {
@@ -57,23 +68,23 @@ func (c *coaeCollectionCollection) Add(n calculateOverallAccuracyElement) error
 	return nil
 }
 
-func opCalculateOverallAccuracy() {
-	defer wg.Done()
+func opCalculateOverallAccuracy(ctx context.Context) error {
 	data := make(map[int]*coaeCollectionCollection)
-	const memeQuery = "SELECT users.id, scores.play_mode, scores.accuracy, scores.pp FROM scores INNER JOIN users ON users.id = scores.userid WHERE completed = '3'"
-	rows, err := db.Query(memeQuery)
-	if err != nil {
-		queryError(err, memeQuery)
-		return
-	}
+	rows := newScoreScanner(ctx, scanQuery{
+		cols:  "users.id, scores.play_mode, scores.accuracy, scores.pp",
+		from:  "scores INNER JOIN users ON users.id = scores.userid",
+		where: "completed = '3'",
+	}, 0)
+	defer rows.Close()
 	for rows.Next() {
+		countRows(ctx, 1)
 		var (
 			uid int
 			el  calculateOverallAccuracyElement
 		)
-		err = rows.Scan(&uid, &el.mode, &el.accuracy, &el.pp)
+		err := rows.Scan(&uid, &el.mode, &el.accuracy, &el.pp)
 		if err != nil {
-			queryError(err, memeQuery)
+			queryError(ctx, err, rows.Query())
 			continue
 		}
 		// silently ignore invalid modes, and null accuracies which for some
@@ -86,6 +97,10 @@ func opCalculateOverallAccuracy() {
 		}
 		data[uid].Add(el)
 	}
+	if err := rows.Err(); err != nil {
+		queryError(ctx, err, rows.Query())
+		return err
+	}
 
 	for _, v := range data {
 		// VARIABLE SHADOWING FTW
@@ -95,18 +110,18 @@ func opCalculateOverallAccuracy() {
 	}
 
 	for userid, info := range data {
-		var accuracies string
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var cols []string
 		var params []interface{}
 		for mode, scores := range info {
-			accuracies += "avg_accuracy_" + modes[mode] + " = ?"
+			cols = append(cols, "avg_accuracy_"+modes[mode])
 			params = append(params, scores.Weighten())
-			if mode != len(info)-1 {
-				accuracies += ", "
-			}
 		}
-		params = append(params, userid)
-		op("UPDATE users_stats SET "+accuracies+" WHERE id = ?", params...)
+		opUpdate(ctx, "users_stats", "id", userid, cols, params...)
 	}
 
-	color.Green("> CalculateOverallAccuracy: done!")
+	logFor(ctx).infof("done!")
+	return nil
 }
@@ -2,27 +2,45 @@ package main
 
 import (
 	"container/heap"
+	"context"
+	"fmt"
 	"math"
+	"strconv"
+	"sync/atomic"
+	"time"
 
-	"github.com/fatih/color"
+	"github.com/jmoiron/sqlx"
 )
 
-// Float64Heap is a max heap of float64s
-type Float64Heap []float64
+func init() {
+	registerJob(&basicJob{
+		name:        "CalculatePP",
+		description: "Re-calculates the total pp of every user from their scores.",
+		enabled:     func(c *config) bool { return c.CalculatePP },
+		// the jobs changing the scores in ways calculatePPIncremental can't
+		// see, whose users must be marked with markPPDirty
+		deps: []string{"RecalculateScoresPP", "FixCompletedScores", "FixMultipleCompletedScores",
+			"UnrankScoresOnInvalidBeatmaps", "FixScoreDuplicates"},
+		run:         opCalculatePP,
+	})
+}
+
+// Float64MinHeap is a min heap of float64s
+type Float64MinHeap []float64
 
-func (h Float64Heap) Len() int           { return len(h) }
-func (h Float64Heap) Less(i, j int) bool { return h[i] > h[j] }
-func (h Float64Heap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h Float64MinHeap) Len() int           { return len(h) }
+func (h Float64MinHeap) Less(i, j int) bool { return h[i] < h[j] }
+func (h Float64MinHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
 
 // Push golint pls stop
-func (h *Float64Heap) Push(x interface{}) {
+func (h *Float64MinHeap) Push(x interface{}) {
 	// Push and Pop use pointer receivers because they modify the slice's length,
 	// not just its contents.
 	*h = append(*h, x.(float64))
 }
 
 // Pop golint pls stop
-func (h *Float64Heap) Pop() interface{} {
+func (h *Float64MinHeap) Pop() interface{} {
 	old := *h
 	n := len(old)
 	x := old[n-1]
@@ -30,75 +48,390 @@ func (h *Float64Heap) Pop() interface{} {
 	return x
 }
 
-func opCalculatePP() {
-	defer wg.Done()
+// topPP keeps the n highest pp values added to it, and counts all of them, so
+// that the memory used by CalculatePP depends on the number of users and not
+// on the number of scores. The values are kept in a min-heap, whose lowest
+// value is replaced when a higher one is added.
+type topPP struct {
+	// n is 0 to keep every value.
+	n      int
+	count  int
+	values Float64MinHeap
+}
 
-	// We do not rely on MySQL to sort the scores by pp or
-	// the scores table will be locked for a (very) long time,
-	// so we fetch the scores in an arbitrary order and we
-	// let the cron sort them by pp (in this case, we use a max-heap).
-	const ppQuery = "SELECT scores.userid, pp, scores.play_mode, scores.is_relax FROM scores JOIN beatmaps USING(beatmap_md5) WHERE completed = 3 AND ranked >= 2 AND disable_pp = 0"
-	rows, err := db.Query(ppQuery)
+func (t *topPP) add(pp float64) {
+	t.count++
+	if t.n == 0 || len(t.values) < t.n {
+		heap.Push(&t.values, pp)
+	} else if pp > t.values[0] {
+		t.values[0] = pp
+		heap.Fix(&t.values, 0)
+	}
+}
+
+// best returns the values kept, from the highest. t is empty afterwards.
+func (t *topPP) best() []float64 {
+	best := make([]float64, len(t.values))
+	for i := len(best) - 1; i >= 0; i-- {
+		best[i] = heap.Pop(&t.values).(float64)
+	}
+	return best
+}
+
+// ppStateKey is the redis hash where CalculatePP saves, with IncrementalPP,
+// the id of the last score it has taken into account (last_score_id) and
+// when it last recomputed the pp of every user (last_full).
+const ppStateKey = "ripple:cron:calculate_pp"
+
+// ppState is the content of ppStateKey.
+type ppState struct {
+	lastScoreID int64
+	lastFull    time.Time
+}
+
+func loadPPState() (ppState, error) {
+	m, err := r.HGetAll(ppStateKey).Result()
 	if err != nil {
-		queryError(err, ppQuery)
+		return ppState{}, err
+	}
+	var st ppState
+	if v, ok := m["last_score_id"]; ok {
+		st.lastScoreID, _ = strconv.ParseInt(v, 10, 64)
+	}
+	if v, ok := m["last_full"]; ok {
+		unix, _ := strconv.ParseInt(v, 10, 64)
+		st.lastFull = time.Unix(unix, 0)
+	}
+	return st, nil
+}
+
+// ppDirtyUsersKey is the redis set of the users whose scores were changed by
+// other jobs in ways calculatePPIncremental can't see from the new scores,
+// such as their pp being recalculated or the scores being unranked. Their pp
+// is recomputed by the next run of CalculatePP.
+const ppDirtyUsersKey = "ripple:cron:calculate_pp:dirty_users"
+
+// ppDirtyChunk is the number of users added to or removed from
+// ppDirtyUsersKey with each command.
+const ppDirtyChunk = 1000
+
+// markPPDirty adds users to ppDirtyUsersKey. It must be called once the
+// changes of their scores have been executed, so that CalculatePP can't read
+// their scores before them and still consider them done.
+func markPPDirty(ctx context.Context, users map[int]bool) {
+	members := make([]interface{}, 0, len(users))
+	for id := range users {
+		members = append(members, id)
+	}
+	for len(members) > 0 {
+		chunk := members
+		if len(chunk) > ppDirtyChunk {
+			chunk = chunk[:ppDirtyChunk]
+		}
+		members = members[len(chunk):]
+		err := redisWrite(ctx, func() error {
+			return r.SAdd(ppDirtyUsersKey, chunk...).Err()
+		}, "SADD", append([]interface{}{ppDirtyUsersKey}, chunk...)...)
+		if err != nil {
+			logFor(ctx).errorf("couldn't mark the users whose pp must be recomputed: %v", err)
+			return
+		}
+	}
+	if len(users) > 0 {
+		logFor(ctx).with("users", len(users)).debugf("marked the users whose pp must be recomputed")
+	}
+}
+
+// savePPState saves the high-water mark once the pp of the users have been
+// updated, unless lastScoreID is 0, and removes dirty, the users whose pp
+// has been recomputed, from ppDirtyUsersKey. If some scores couldn't be read
+// or some updates failed or couldn't be queued, it's left as is, so that the
+// next run updates the same users again.
+func savePPState(ctx context.Context, lastScoreID int64, full bool, dirty []string) {
+	if !waitOperations(ctx) {
+		logFor(ctx).warnf("not saving the last score processed, as some queries were not queued")
 		return
 	}
+	if jr := jobRunFromContext(ctx); jr != nil {
+		failed, errors := atomic.LoadInt64(&jr.opsFailed), atomic.LoadInt64(&jr.errors)
+		if failed > 0 || errors > 0 {
+			logFor(ctx).with("failed_operations", failed, "errors", errors).
+				warnf("not saving the last score processed, as some queries failed")
+			return
+		}
+	}
+	if lastScoreID > 0 {
+		fields := map[string]string{"last_score_id": strconv.FormatInt(lastScoreID, 10)}
+		if full {
+			fields["last_full"] = strconv.FormatInt(time.Now().Unix(), 10)
+		}
+		err := redisWrite(ctx, func() error {
+			return r.HMSet(ppStateKey, fields).Err()
+		}, "HMSET", ppStateKey, fields)
+		if err != nil {
+			logFor(ctx).errorf("couldn't save the last score processed: %v", err)
+			return
+		}
+	}
+	for len(dirty) > 0 {
+		chunk := make([]interface{}, 0, ppDirtyChunk)
+		for _, id := range dirty {
+			if len(chunk) == ppDirtyChunk {
+				break
+			}
+			chunk = append(chunk, id)
+		}
+		dirty = dirty[len(chunk):]
+		err := redisWrite(ctx, func() error {
+			return r.SRem(ppDirtyUsersKey, chunk...).Err()
+		}, "SREM", append([]interface{}{ppDirtyUsersKey}, chunk...)...)
+		if err != nil {
+			logFor(ctx).errorf("couldn't remove the users whose pp was recomputed: %v", err)
+			return
+		}
+	}
+}
+
+// maxScoreID returns the id of the most recent score.
+func maxScoreID(ctx context.Context) (int64, error) {
+	const q = "SELECT COALESCE(MAX(id), 0) FROM scores"
+	var id int64
+	err := readDBFor(ctx).QueryRowContext(ctx, q).Scan(&id)
+	if err != nil {
+		queryError(ctx, err, q)
+	}
+	return id, err
+}
+
+func opCalculatePP(ctx context.Context) error {
+	cfg := configFromContext(ctx)
+	weights, err := parsePPWeighting(cfg.PPWeighting)
+	if err != nil {
+		return fmt.Errorf("PPWeighting is invalid: %v", err)
+	}
+	// the users marked before the run are removed from ppDirtyUsersKey
+	// once done, and the ones marked during it are kept for the next run
+	dirty, err := r.SMembers(ppDirtyUsersKey).Result()
+	if err != nil {
+		logFor(ctx).warnf("couldn't get the users whose pp must be recomputed, recomputing the pp of every user: %v", err)
+		return calculatePPFull(ctx, weights, cfg.IncrementalPP, nil)
+	}
+	if !cfg.IncrementalPP {
+		return calculatePPFull(ctx, weights, false, dirty)
+	}
+	st, err := loadPPState()
+	if err != nil {
+		logFor(ctx).warnf("couldn't get the last score processed, recomputing the pp of every user: %v", err)
+		return calculatePPFull(ctx, weights, true, dirty)
+	}
+	fullEvery, _ := parseDuration(cfg.FullPPRecomputeInterval)
+	switch {
+	case st.lastScoreID == 0:
+		logFor(ctx).infof("first incremental run, recomputing the pp of every user")
+	case fullEvery > 0 && time.Since(st.lastFull) >= fullEvery:
+		logFor(ctx).with("last_full", st.lastFull.Format(time.RFC3339)).infof("recomputing the pp of every user")
+	default:
+		return calculatePPIncremental(ctx, weights, st.lastScoreID, dirty)
+	}
+	return calculatePPFull(ctx, weights, true, dirty)
+}
+
+// calculatePPFull recomputes the pp of every user, and removes dirty from
+// ppDirtyUsersKey. If saveState is set, the high-water mark of IncrementalPP
+// is saved once it's done.
+func calculatePPFull(ctx context.Context, weights *ppWeightings, saveState bool, dirty []string) error {
+	var lastScoreID int64
+	if saveState {
+		var err error
+		// the scores submitted during the run are taken into account by
+		// the next one
+		if lastScoreID, err = maxScoreID(ctx); err != nil {
+			return err
+		}
+	}
+
+	// We do not rely on MySQL to sort the scores by pp or
+	// the scores table will be locked for a (very) long time,
+	// so we fetch the scores in chunks ordered by id and we
+	// let the cron keep the best ones of each user (in this case,
+	// we use a min-heap of the topN of the weighting).
+	rows := newScoreScanner(ctx, scanQuery{
+		cols:  "scores.userid, pp, scores.play_mode, scores.is_relax",
+		from:  "scores JOIN beatmaps USING(beatmap_md5)",
+		where: "completed = 3 AND ranked >= 2 AND disable_pp = 0",
+	}, 0)
+	defer rows.Close()
 
 	var count int
-	users := make(map[int]*[2]*[4]*Float64Heap)
+	users := make(map[int]*userPP)
 	for rows.Next() {
+		countRows(ctx, 1)
 		if count%100000 == 0 {
-			verboseln("> CalculatePP: fetched", count)
+			logFor(ctx).with("rows_processed", count).debugf("fetched")
 		}
 		count++
-		var (
-			userid   int
-			ppAmt    *float64
-			playMode int
-			isRelax  int8
-		)
-		err := rows.Scan(&userid, &ppAmt, &playMode, &isRelax)
+		if err := scanUserPP(rows, weights, users); err != nil {
+			queryError(ctx, err, rows.Query())
+		}
+	}
+	if err := rows.Err(); err != nil {
+		queryError(ctx, err, rows.Query())
+		return err
+	}
+	if err := updateUsersPP(ctx, weights, users); err != nil {
+		return err
+	}
+	savePPState(ctx, lastScoreID, saveState, dirty)
+
+	logFor(ctx).infof("done!")
+	return nil
+}
+
+// ppUsersChunk is the number of users whose scores calculatePPIncremental
+// fetches with each query.
+const ppUsersChunk = 1000
+
+// calculatePPIncremental recomputes the pp of the users who set a score since
+// the one with id lastScoreID, and of dirty, the users marked in
+// ppDirtyUsersKey.
+func calculatePPIncremental(ctx context.Context, weights *ppWeightings, lastScoreID int64, dirty []string) error {
+	maxID, err := maxScoreID(ctx)
+	if err != nil {
+		return err
+	}
+	if maxID <= lastScoreID && len(dirty) == 0 {
+		logFor(ctx).infof("no new scores, done!")
+		return nil
+	}
+
+	var userIDs []int
+	if maxID > lastScoreID {
+		const usersQuery = "SELECT DISTINCT userid FROM scores WHERE id > ? AND id <= ? AND completed = 3"
+		if err := readDBFor(ctx).SelectContext(ctx, &userIDs, usersQuery, lastScoreID, maxID); err != nil {
+			queryError(ctx, err, usersQuery, lastScoreID, maxID)
+			return err
+		}
+	}
+	userIDs = addDirtyUsers(userIDs, dirty)
+	logFor(ctx).with("users", len(userIDs), "dirty", len(dirty), "from_score_id", lastScoreID, "to_score_id", maxID).
+		debugf("recomputing the pp of the users with new or changed scores")
+
+	const ppQuery = "SELECT scores.userid, pp, scores.play_mode, scores.is_relax FROM scores JOIN beatmaps USING(beatmap_md5) " +
+		"WHERE completed = 3 AND ranked >= 2 AND disable_pp = 0 AND scores.userid IN (?)"
+	for len(userIDs) > 0 {
+		chunk := userIDs
+		if len(chunk) > ppUsersChunk {
+			chunk = chunk[:ppUsersChunk]
+		}
+		userIDs = userIDs[len(chunk):]
+
+		query, args, err := sqlx.In(ppQuery, chunk)
 		if err != nil {
-			queryError(err, ppQuery)
-			continue
+			return err
 		}
-		if ppAmt == nil || almostEqual(*ppAmt, 0) {
-			continue
+		rows, err := readDBFor(ctx).QueryContext(ctx, query, args...)
+		if err != nil {
+			queryError(ctx, err, ppQuery)
+			return err
 		}
-		if users[userid] == nil {
-			var arr [2]*[4]*Float64Heap
-			for relax := 0; relax <= 1; relax++ {
-				arr[relax] = &[4]*Float64Heap{
-					new(Float64Heap),
-					new(Float64Heap),
-					new(Float64Heap),
-					new(Float64Heap),
-				}
+		users := make(map[int]*userPP, len(chunk))
+		// the users may have no scores left giving pp
+		for _, id := range chunk {
+			users[id] = newUserPP(weights)
+		}
+		for rows.Next() {
+			countRows(ctx, 1)
+			if err := scanUserPP(rows, weights, users); err != nil {
+				queryError(ctx, err, ppQuery)
 			}
-			users[userid] = &arr
 		}
-		heap.Push(users[userid][isRelax][playMode], *ppAmt)
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			queryError(ctx, err, ppQuery)
+			return err
+		}
+		if err := updateUsersPP(ctx, weights, users); err != nil {
+			return err
+		}
 	}
-	rows.Close()
-	count = 0
+	savePPState(ctx, maxID, false, dirty)
+
+	logFor(ctx).infof("done!")
+	return nil
+}
+
+// addDirtyUsers adds the ids in dirty which aren't in userIDs to it.
+func addDirtyUsers(userIDs []int, dirty []string) []int {
+	seen := make(map[int]bool, len(userIDs))
+	for _, id := range userIDs {
+		seen[id] = true
+	}
+	for _, s := range dirty {
+		id, err := strconv.Atoi(s)
+		if err != nil || seen[id] {
+			continue
+		}
+		seen[id] = true
+		userIDs = append(userIDs, id)
+	}
+	return userIDs
+}
+
+// userPP holds the best pp values of a user, for each mode of classic ([0])
+// and relax ([1]) scores.
+type userPP [2][4]topPP
+
+func newUserPP(weights *ppWeightings) *userPP {
+	var u userPP
+	for relax := range u {
+		for mode := range u[relax] {
+			u[relax][mode].n = weights[relax][mode].topN()
+		}
+	}
+	return &u
+}
+
+// scanUserPP adds the pp of the score in rows, which has the user, pp, mode
+// and relax columns, to the best pp values of its user.
+func scanUserPP(rows interface{ Scan(...interface{}) error }, weights *ppWeightings, users map[int]*userPP) error {
+	var (
+		userid   int
+		ppAmt    *float64
+		playMode int
+		isRelax  int8
+	)
+	if err := rows.Scan(&userid, &ppAmt, &playMode, &isRelax); err != nil {
+		return err
+	}
+	if ppAmt == nil || almostEqual(*ppAmt, 0) || playMode < 0 || playMode > 3 || isRelax < 0 || isRelax > 1 {
+		return nil
+	}
+	if users[userid] == nil {
+		users[userid] = newUserPP(weights)
+	}
+	users[userid][isRelax][playMode].add(*ppAmt)
+	return nil
+}
+
+// updateUsersPP computes the total pp of the users from their best pp values,
+// and queues the updates.
+func updateUsersPP(ctx context.Context, weights *ppWeightings, users map[int]*userPP) error {
+	count := 0
 	for userID, relaxData := range users {
-		for isRelax, gameModeData := range relaxData {
-			for gameMode, ppData := range gameModeData {
-				var totalPP float64
-				heapSize := ppData.Len()
-				if heapSize > 500 {
-					heapSize = 500
-				}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		count++
+		if count%100000 == 0 {
+			logFor(ctx).with("users_processed", count).debugf("updated")
+		}
+		for isRelax := range relaxData {
+			for gameMode := range relaxData[isRelax] {
+				ppData := &relaxData[isRelax][gameMode]
 
-				// Calculate sum of weighted pp for the top 500 scores
-				for i := 0; i < heapSize; i++ {
-					count++
-					if count%100000 == 0 {
-						verboseln("> CalculatePP:", count)
-					}
-					pp := heap.Pop(ppData).(float64)
-					totalPP += round(round(pp) * math.Pow(0.95, float64(i)))
-				}
+				// Get the best scores, and weight them
+				totalPP := weights[isRelax][gameMode].total(ppData.best(), ppData.count)
 
 				// Calculated, now update in db
 				var table string
@@ -107,17 +440,11 @@ func opCalculatePP() {
 				} else {
 					table = "users_stats_relax"
 				}
-				op("UPDATE "+table+" SET pp_"+modeToString(gameMode)+" = ? WHERE id = ? LIMIT 1", totalPP, userID)
+				opUpdate(ctx, table, "id", userID, []string{"pp_" + modeToString(gameMode)}, totalPP)
 			}
 		}
 	}
-
-	color.Green("> CalculatePP: done!")
-
-	if c.PopulateRedis {
-		verboseln("Starting to populate redis")
-		go opPopulateRedis()
-	}
+	return nil
 }
 
 func round(a float64) float64 {
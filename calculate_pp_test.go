@@ -0,0 +1,176 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestTopPP(t *testing.T) {
+	tests := []struct {
+		n      int
+		values []float64
+		best   []float64
+	}{
+		{3, nil, []float64{}},
+		{3, []float64{5, 1}, []float64{5, 1}},
+		{3, []float64{5, 1, 7, 3, 9, 2}, []float64{9, 7, 5}},
+		// a value equal to the lowest one kept doesn't replace it
+		{2, []float64{4, 4, 8, 4}, []float64{8, 4}},
+		{1, []float64{1, 3, 2}, []float64{3}},
+		// 0 keeps every value
+		{0, []float64{5, 1, 7, 3}, []float64{7, 5, 3, 1}},
+	}
+	for _, test := range tests {
+		tp := topPP{n: test.n}
+		for _, v := range test.values {
+			tp.add(v)
+		}
+		if tp.count != len(test.values) {
+			t.Errorf("%v: got count %d, want %d", test.values, tp.count, len(test.values))
+		}
+		if got := tp.best(); !reflect.DeepEqual(got, test.best) {
+			t.Errorf("%v with n = %d: got %v, want %v", test.values, test.n, got, test.best)
+		}
+		if len(tp.values) != 0 {
+			t.Errorf("%v: %d values left after best", test.values, len(tp.values))
+		}
+	}
+}
+
+// TestTopPPRandom compares topPP to sorting every value.
+func TestTopPPRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1337))
+	all := topPP{}
+	top := topPP{n: 100}
+	for i := 0; i < 10000; i++ {
+		pp := r.Float64() * 1000
+		all.add(pp)
+		top.add(pp)
+		if len(top.values) > top.n {
+			t.Fatalf("%d values kept, more than %d", len(top.values), top.n)
+		}
+	}
+	if want, got := all.best()[:100], top.best(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestAddDirtyUsers(t *testing.T) {
+	got := addDirtyUsers([]int{1, 2}, []string{"2", "3", "x", "3"})
+	if want := []int{1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := addDirtyUsers(nil, []string{"1000"}); !reflect.DeepEqual(got, []int{1000}) {
+		t.Errorf("without new scores: got %v, want [1000]", got)
+	}
+}
+
+func TestSavePPState(t *testing.T) {
+	defer func(old bool) { dryRun = old }(dryRun)
+	dryRun = true
+	tests := []struct {
+		name           string
+		failed, errors int64
+		writes         int
+	}{
+		{name: "testSavePPStateOK", writes: 2},
+		{name: "testSavePPStateFailed", failed: 1, errors: 1},
+		{name: "testSavePPStateErrors", errors: 1},
+	}
+	for _, test := range tests {
+		jr := &jobRun{job: &basicJob{name: test.name}, opsFailed: test.failed, errors: test.errors}
+		// the high-water mark, and the removal of the dirty users
+		savePPState(withJobRun(context.Background(), jr), 1000, false, []string{"1"})
+		dryRunWrites.Lock()
+		got := dryRunWrites.m[test.name]["redis"]
+		dryRunWrites.Unlock()
+		if got != test.writes {
+			t.Errorf("%s: %d writes to redis, want %d", test.name, got, test.writes)
+		}
+	}
+}
+
+// float64MaxHeap is the max-heap CalculatePP used to keep every pp value of
+// each user in, Float64Heap, before topPP.
+type float64MaxHeap []float64
+
+func (h float64MaxHeap) Len() int            { return len(h) }
+func (h float64MaxHeap) Less(i, j int) bool  { return h[i] > h[j] }
+func (h float64MaxHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *float64MaxHeap) Push(x interface{}) { *h = append(*h, x.(float64)) }
+func (h *float64MaxHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// benchmarkScores calls add with scoresPerUser pp values for each of users
+// users, interleaved like the scores read ordered by id. The values are the
+// same at each call.
+func benchmarkScores(users, scoresPerUser int, add func(user int, pp float64)) {
+	r := rand.New(rand.NewSource(1337))
+	for i := 0; i < scoresPerUser; i++ {
+		for u := 0; u < users; u++ {
+			add(u, r.Float64()*1000)
+		}
+	}
+}
+
+// benchmarkFloat64Heap does what CalculatePP did before topPP: every pp value
+// is pushed to the max-heap of its user, from which the 500 best ones are
+// popped. The kept/op metric is the number of values held in memory once all
+// of them were added.
+func benchmarkFloat64Heap(users, scoresPerUser int, b *testing.B) {
+	b.ReportAllocs()
+	var kept int
+	for j := 0; j < b.N; j++ {
+		heaps := make([]*float64MaxHeap, users)
+		for u := range heaps {
+			heaps[u] = new(float64MaxHeap)
+		}
+		benchmarkScores(users, scoresPerUser, func(u int, pp float64) {
+			heap.Push(heaps[u], pp)
+		})
+		kept = 0
+		for _, h := range heaps {
+			kept += h.Len()
+			for i := 0; i < 500 && h.Len() > 0; i++ {
+				heap.Pop(h)
+			}
+		}
+	}
+	b.ReportMetric(float64(kept), "kept/op")
+}
+
+// benchmarkTopPP does the same as benchmarkFloat64Heap with topPP, keeping
+// the 500 best values of each user.
+func benchmarkTopPP(users, scoresPerUser int, b *testing.B) {
+	b.ReportAllocs()
+	var kept int
+	for j := 0; j < b.N; j++ {
+		tops := make([]topPP, users)
+		for u := range tops {
+			tops[u].n = 500
+		}
+		benchmarkScores(users, scoresPerUser, func(u int, pp float64) {
+			tops[u].add(pp)
+		})
+		kept = 0
+		for u := range tops {
+			kept += len(tops[u].values)
+			tops[u].best()
+		}
+	}
+	b.ReportMetric(float64(kept), "kept/op")
+}
+
+func BenchmarkFloat64Heap1000x100(b *testing.B)   { benchmarkFloat64Heap(1000, 100, b) }
+func BenchmarkFloat64Heap1000x1000(b *testing.B)  { benchmarkFloat64Heap(1000, 1000, b) }
+func BenchmarkFloat64Heap1000x10000(b *testing.B) { benchmarkFloat64Heap(1000, 10000, b) }
+func BenchmarkTopPP1000x100(b *testing.B)         { benchmarkTopPP(1000, 100, b) }
+func BenchmarkTopPP1000x1000(b *testing.B)        { benchmarkTopPP(1000, 1000, b) }
+func BenchmarkTopPP1000x10000(b *testing.B)       { benchmarkTopPP(1000, 10000, b) }
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/gob"
+	"fmt"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"gopkg.in/redis.v5"
+)
+
+// resume is set by -resume: the jobs saving checkpoints start from their last
+// checkpoint, instead of from scratch.
+var resume bool
+
+// checkpointTable is created when CheckpointStore is table, if it doesn't
+// exist.
+const checkpointTable = `CREATE TABLE IF NOT EXISTS cron_checkpoints (
+	job VARCHAR(64) NOT NULL,
+	saved_at INT UNSIGNED NOT NULL,
+	data LONGBLOB NOT NULL,
+	PRIMARY KEY (job)
+)`
+
+func checkCheckpointStore(s string) error {
+	switch s {
+	case "", "redis", "table":
+		return nil
+	}
+	return fmt.Errorf("unknown store %q, must be redis or table", s)
+}
+
+// checkpointsEnabled reports whether the jobs should save their progress.
+func checkpointsEnabled(cfg *config) bool {
+	return cfg.CheckpointStore != "" && !dryRun
+}
+
+func checkpointKey(job string) string {
+	return "ripple:cron:checkpoint:" + commandName(job)
+}
+
+// loadCheckpointData returns the data of the checkpoint of job, or nil if
+// there is none.
+func loadCheckpointData(cfg *config, job string) ([]byte, error) {
+	if cfg.CheckpointStore == "redis" {
+		data, err := r.Get(checkpointKey(job)).Bytes()
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return data, err
+	}
+	var data []byte
+	err := db.QueryRow("SELECT data FROM cron_checkpoints WHERE job = ?", job).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	// the table is only created when checkpoints are saved, which isn't the
+	// case with -dry-run
+	if merr, ok := err.(*mysql.MySQLError); ok && merr.Number == 1146 {
+		return nil, nil
+	}
+	return data, err
+}
+
+func saveCheckpointData(cfg *config, job string, data []byte) error {
+	if cfg.CheckpointStore == "redis" {
+		return r.Set(checkpointKey(job), data, 0).Err()
+	}
+	_, err := db.Exec(`INSERT INTO cron_checkpoints (job, saved_at, data) VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE saved_at = VALUES(saved_at), data = VALUES(data)`, job, time.Now().Unix(), data)
+	return err
+}
+
+func deleteCheckpointData(cfg *config, job string) error {
+	if cfg.CheckpointStore == "redis" {
+		return r.Del(checkpointKey(job)).Err()
+	}
+	_, err := db.Exec("DELETE FROM cron_checkpoints WHERE job = ?", job)
+	return err
+}
+
+// checkpointer saves the progress of a job every CheckpointInterval: the id
+// of the last score it scanned, and its partial results, which are encoded
+// with gob (so their fields must be exported). The partial results may be
+// nil, if the job only needs the cursor. The checkpoints are saved with a key
+// describing what the job goes through, such as its filters, and are only
+// resumed with the same key. A job using it looks like this:
+//
+//	cp := newCheckpointer(ctx, where)
+//	cursor, err := cp.resume(&state)
+//	rows := newScoreScanner(ctx, q, cursor)
+//	for rows.Next() {
+//		// ...
+//		cp.maybeSave(rows.Cursor(), &state)
+//	}
+//	if ctx.Err() != nil {
+//		cp.save(rows.Cursor(), &state)
+//	}
+//	// once it's done
+//	cp.clear()
+type checkpointer struct {
+	ctx      context.Context
+	cfg      *config
+	job      string
+	key      string
+	interval time.Duration
+	last     time.Time
+}
+
+func newCheckpointer(ctx context.Context, key string) *checkpointer {
+	cfg := configFromContext(ctx)
+	cp := &checkpointer{ctx: ctx, cfg: cfg, key: key, last: time.Now()}
+	if jr := jobRunFromContext(ctx); jr != nil {
+		cp.job = jr.job.Name()
+	}
+	cp.interval, _ = parseDuration(cfg.CheckpointInterval)
+	return cp
+}
+
+func (cp *checkpointer) enabled() bool {
+	return cp.job != "" && checkpointsEnabled(cp.cfg)
+}
+
+// resume decodes the partial results of the last checkpoint into state, and
+// returns the cursor to resume from. If -resume was not given, or there is no
+// checkpoint with the key of cp, it returns 0 and leaves state untouched.
+func (cp *checkpointer) resume(state interface{}) (int64, error) {
+	if !resume || cp.cfg.CheckpointStore == "" || cp.job == "" {
+		return 0, nil
+	}
+	l := logFor(cp.ctx)
+	data, err := loadCheckpointData(cp.cfg, cp.job)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't load the checkpoint: %v", err)
+	}
+	if data == nil {
+		l.infof("there is no checkpoint, starting from scratch")
+		return 0, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return 0, fmt.Errorf("couldn't read the checkpoint: %v", err)
+	}
+	dec := gob.NewDecoder(zr)
+	var cursor int64
+	if err := dec.Decode(&cursor); err != nil {
+		return 0, fmt.Errorf("couldn't read the checkpoint: %v", err)
+	}
+	// the checkpoints saved before the keys were added have none
+	var key string
+	if err := dec.Decode(&key); err != nil || key != cp.key {
+		l.warnf("the checkpoint was saved with other settings, starting from scratch")
+		return 0, nil
+	}
+	if state != nil {
+		if err := dec.Decode(state); err != nil {
+			return 0, fmt.Errorf("couldn't read the checkpoint: %v", err)
+		}
+	}
+	l.with("cursor", cursor).infof("resuming from the checkpoint")
+	return cursor, nil
+}
+
+// maybeSave saves a checkpoint if the last one is older than
+// CheckpointInterval.
+func (cp *checkpointer) maybeSave(cursor int64, state interface{}) {
+	if cp.enabled() && time.Since(cp.last) >= cp.interval {
+		cp.save(cursor, state)
+	}
+}
+
+// save saves a checkpoint. The operations queued by the job are executed
+// first, so that they aren't lost if the job is resumed; if some of them
+// couldn't be queued because the job was stopped, the previous checkpoint is
+// kept.
+func (cp *checkpointer) save(cursor int64, state interface{}) {
+	if !cp.enabled() {
+		return
+	}
+	cp.last = time.Now()
+	l := logFor(cp.ctx).with("cursor", cursor)
+	if !waitOperations(cp.ctx) {
+		l.warnf("not saving the checkpoint, as some queries were not queued")
+		return
+	}
+
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	enc := gob.NewEncoder(zw)
+	err := enc.Encode(cursor)
+	if err == nil {
+		err = enc.Encode(cp.key)
+	}
+	if err == nil && state != nil {
+		err = enc.Encode(state)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = saveCheckpointData(cp.cfg, cp.job, b.Bytes())
+	}
+	if err != nil {
+		l.errorf("couldn't save the checkpoint: %v", err)
+		return
+	}
+	l.with("bytes", b.Len()).debugf("saved the checkpoint")
+}
+
+// clear deletes the checkpoint of the job, which is done.
+func (cp *checkpointer) clear() {
+	if !cp.enabled() {
+		return
+	}
+	if err := deleteCheckpointData(cp.cfg, cp.job); err != nil {
+		logFor(cp.ctx).errorf("couldn't delete the checkpoint: %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+func init() {
+	registerJob(&basicJob{
+		name:        "DeleteOldPasswordResets",
+		description: "Deletes password reset requests older than a day.",
+		enabled:     func(c *config) bool { return c.DeleteOldPasswordResets },
+		run:         opDeleteOldPasswordResets,
+	})
+	registerJob(&basicJob{
+		name:        "FixCompletedScores",
+		description: "Set to completed = 2 all scores on beatmaps that aren't ranked.",
+		enabled:     func(c *config) bool { return c.FixCompletedScores },
+		run:         opFixCompletedScores,
+	})
+	registerJob(&basicJob{
+		name:        "DeleteOldPrivateTokens",
+		description: "Deletes private API tokens older than a month.",
+		enabled:     func(c *config) bool { return c.DeleteOldPrivateTokens },
+		run:         opDeleteOldPrivateTokens,
+	})
+	registerJob(&basicJob{
+		name:        "UnrankScoresOnInvalidBeatmaps",
+		description: "Deletes all scores on beatmaps that are not in the database.",
+		enabled:     func(c *config) bool { return c.UnrankScoresOnInvalidBeatmaps },
+		run:         opUnrankScoresOnInvalidBeatmaps,
+	})
+	registerJob(&basicJob{
+		name:        "PrunePendingVerification",
+		description: "Deletes users still pending verification after PrunePendingVerificationAfter days.",
+		enabled:     func(c *config) bool { return c.PrunePendingVerificationAfter > 0 },
+		run:         opPrunePendingVerification,
+	})
+	registerJob(&basicJob{
+		name:        "RemoveDonorOnExpired",
+		description: "Asks donorbot to remove donor privileges from users whose donor expired.",
+		enabled:     func(c *config) bool { return c.RemoveDonorOnExpired },
+		run:         opRemoveDonorOnExpired,
+	})
+}
+
+func opDeleteOldPasswordResets(ctx context.Context) error {
+	opSync(ctx, "DELETE FROM password_recovery WHERE t < (NOW() - INTERVAL 1 DAY);")
+	return nil
+}
+
+func opFixCompletedScores(ctx context.Context) error {
+	users, err := scoresUsers(ctx, `SELECT DISTINCT scores.userid FROM scores
+		INNER JOIN beatmaps ON beatmaps.beatmap_md5 = scores.beatmap_md5
+		WHERE scores.completed = 3 AND (beatmaps.ranked < 1 OR beatmaps.ranked > 5)`)
+	if err != nil {
+		return err
+	}
+	opSync(ctx, `UPDATE scores
+		INNER JOIN beatmaps ON beatmaps.beatmap_md5 = scores.beatmap_md5
+		SET completed = '2'
+		WHERE beatmaps.ranked < 1 OR beatmaps.ranked > 5;`)
+	waitOperations(ctx)
+	markPPDirty(ctx, users)
+	return nil
+}
+
+func opDeleteOldPrivateTokens(ctx context.Context) error {
+	opSync(ctx, `DELETE FROM tokens WHERE private = 1 AND last_updated < ?`, time.Now().Add(-time.Hour*24*30))
+	return nil
+}
+
+func opUnrankScoresOnInvalidBeatmaps(ctx context.Context) error {
+	users, err := scoresUsers(ctx, `SELECT DISTINCT scores.userid FROM scores
+	LEFT JOIN beatmaps ON scores.beatmap_md5 = beatmaps.beatmap_md5
+	WHERE beatmaps.beatmap_md5 IS NULL AND scores.completed = 3`)
+	if err != nil {
+		return err
+	}
+	opSync(ctx, `DELETE scores.* FROM scores
+	LEFT JOIN beatmaps ON scores.beatmap_md5 = beatmaps.beatmap_md5
+	WHERE beatmaps.beatmap_md5 IS NULL`)
+	waitOperations(ctx)
+	markPPDirty(ctx, users)
+	return nil
+}
+
+// scoresUsers returns the users returned by query, whose scores are about to
+// be changed, so that CalculatePP recomputes their pp. It reads from the
+// primary, where the scores are then changed.
+func scoresUsers(ctx context.Context, query string) (map[int]bool, error) {
+	var ids []int
+	if err := db.SelectContext(ctx, &ids, query); err != nil {
+		queryError(ctx, err, query)
+		return nil, err
+	}
+	users := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		users[id] = true
+	}
+	return users, nil
+}
+
+func opPrunePendingVerification(ctx context.Context) error {
+	days := configFromContext(ctx).PrunePendingVerificationAfter
+	if days <= 0 {
+		return nil
+	}
+	opSync(ctx, `DELETE users, users_stats FROM users
+	INNER JOIN users_stats
+	WHERE users.id = users_stats.id AND users.latest_activity = 0
+	AND users.privileges = 1048576 AND users.register_datetime < ?`,
+		time.Now().Add(-time.Hour*24*time.Duration(days)).Unix())
+	return nil
+}
+
+func opRemoveDonorOnExpired(ctx context.Context) error {
+	if dryRun {
+		reportContextWrite(ctx, "http", "call %s/discord/unlink_expired.php", c.DonorbotBaseApiUrl)
+		return nil
+	}
+	resp, err := http.Get(c.DonorbotBaseApiUrl + "/discord/unlink_expired.php?k=" + c.DonorbotSecret)
+	if err != nil {
+		logFor(ctx).errorf("couldn't call donorbot: %v", err)
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
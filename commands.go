@@ -0,0 +1,223 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/fatih/color"
+	"github.com/go-sql-driver/mysql"
+	"github.com/thehowl/conf"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: %s [flags] [command]
+
+Commands:
+  (none)               run all the jobs enabled in the config file
+  run <job>...         run only the given jobs, e.g. run calculate-pp populate-redis
+  list                 list all the jobs
+  config validate      check the config file for errors
+  history [job]        show the most recent runs, or the most recent runs of a job
+  dead-letter list     show the queries which failed and were saved to DeadLetterFile
+  dead-letter replay   run the queries in DeadLetterFile again
+  pp-history <user> [mode] [classic|relax]
+                       export the pp and rank history of a user as CSV
+
+Flags:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
+// cmdList lists all the jobs, along with their description and whether they
+// are enabled in the config file.
+func cmdList() {
+	haveConfig := conf.Load(&c, configFile) == nil
+
+	sorted := make([]Job, len(jobs))
+	copy(sorted, jobs)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name() < sorted[j].Name()
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, j := range sorted {
+		var enabled string
+		if haveConfig && j.Enabled(&c) {
+			enabled = "enabled"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", commandName(j.Name()), enabled, j.Description())
+		if deps := j.Dependencies(); len(deps) > 0 {
+			names := make([]string, len(deps))
+			for i, d := range deps {
+				names[i] = commandName(d)
+			}
+			fmt.Fprintf(w, "\t\truns after %s\n", strings.Join(names, ", "))
+		}
+	}
+	w.Flush()
+}
+
+func cmdConfig(args []string) int {
+	if len(args) != 1 || args[0] != "validate" {
+		color.Red("Usage: config validate")
+		return exitConfig
+	}
+
+	err := conf.Load(&c, configFile)
+	if err != nil {
+		color.Red("%s couldn't be loaded: %v.", configFile, err)
+		return exitConfig
+	}
+
+	errs := validateConfig(&c)
+	if len(errs) == 0 {
+		color.Green("%s is valid!", configFile)
+		return exitOK
+	}
+	for _, err := range errs {
+		color.Red("> %v", err)
+	}
+	return exitConfig
+}
+
+// validateConfig returns all the problems found in cfg.
+func validateConfig(cfg *config) []error {
+	var errs []error
+	if _, err := mysql.ParseDSN(cfg.DSN); err != nil {
+		errs = append(errs, fmt.Errorf("DSN: %v", err))
+	}
+	if cfg.ReadDSN != "" {
+		if _, err := mysql.ParseDSN(cfg.ReadDSN); err != nil {
+			errs = append(errs, fmt.Errorf("ReadDSN: %v", err))
+		}
+	}
+	if cfg.MaxReadLag < 0 {
+		errs = append(errs, fmt.Errorf("MaxReadLag: can't be negative"))
+	}
+	if cfg.ScanChunkSize < 1 {
+		errs = append(errs, fmt.Errorf("ScanChunkSize: must be at least 1"))
+	}
+	if cfg.Workers < 1 {
+		errs = append(errs, fmt.Errorf("Workers: must be at least 1"))
+	}
+	if _, err := parseSchedule(cfg.Schedule); err != nil {
+		errs = append(errs, fmt.Errorf("Schedule: %v", err))
+	}
+	if _, err := parseTimeouts(cfg.Timeouts); err != nil {
+		errs = append(errs, fmt.Errorf("Timeouts: %v", err))
+	}
+	if _, err := parseDuration(cfg.MaxRunDuration); err != nil {
+		errs = append(errs, fmt.Errorf("MaxRunDuration: %v", err))
+	}
+	if err := checkLogFormat(cfg.LogFormat); err != nil {
+		errs = append(errs, fmt.Errorf("LogFormat: %v", err))
+	}
+	if _, err := parseLogLevel(cfg.LogLevel); err != nil {
+		errs = append(errs, fmt.Errorf("LogLevel: %v", err))
+	}
+	if cfg.APIAddr != "" && cfg.APIToken == "" {
+		errs = append(errs, fmt.Errorf("APIToken: must be set to use APIAddr"))
+	}
+	if _, err := parseWebhooks(cfg.Webhooks); err != nil {
+		errs = append(errs, fmt.Errorf("Webhooks: %v", err))
+	}
+	if err := checkNotifyOn(cfg.NotifyOn); err != nil {
+		errs = append(errs, fmt.Errorf("NotifyOn: %v", err))
+	}
+	if cfg.Retries < 0 {
+		errs = append(errs, fmt.Errorf("Retries: can't be negative"))
+	}
+	if _, err := parseDuration(cfg.RetryBackoff); err != nil {
+		errs = append(errs, fmt.Errorf("RetryBackoff: %v", err))
+	}
+	if cfg.BatchSize < 1 {
+		errs = append(errs, fmt.Errorf("BatchSize: must be at least 1"))
+	}
+	if _, err := parseTableRateLimits(cfg.TableRateLimits); err != nil {
+		errs = append(errs, fmt.Errorf("TableRateLimits: %v", err))
+	}
+	if cfg.WriteRateLimit < 0 {
+		errs = append(errs, fmt.Errorf("WriteRateLimit: can't be negative"))
+	}
+	if cfg.MaxReplicationLag > 0 && cfg.ThrottleReplicaDSN == "" && cfg.ReadDSN == "" {
+		errs = append(errs, fmt.Errorf("ThrottleReplicaDSN: must be set to use MaxReplicationLag without ReadDSN"))
+	}
+	if d, err := parseDuration(cfg.ThrottleCheckInterval); err != nil {
+		errs = append(errs, fmt.Errorf("ThrottleCheckInterval: %v", err))
+	} else if throttleEnabled(cfg) && d <= 0 {
+		errs = append(errs, fmt.Errorf("ThrottleCheckInterval: must be set to use MaxThreadsRunning or MaxReplicationLag"))
+	}
+	if err := checkCheckpointStore(cfg.CheckpointStore); err != nil {
+		errs = append(errs, fmt.Errorf("CheckpointStore: %v", err))
+	}
+	// with no interval, a checkpoint would be saved after every row
+	if d, err := parseDuration(cfg.CheckpointInterval); err != nil {
+		errs = append(errs, fmt.Errorf("CheckpointInterval: %v", err))
+	} else if cfg.CheckpointStore != "" && d <= 0 {
+		errs = append(errs, fmt.Errorf("CheckpointInterval: must be set to use CheckpointStore"))
+	}
+	if _, err := parsePPWeighting(cfg.PPWeighting); err != nil {
+		errs = append(errs, fmt.Errorf("PPWeighting: %v", err))
+	}
+	if _, err := parseDuration(cfg.FullPPRecomputeInterval); err != nil {
+		errs = append(errs, fmt.Errorf("FullPPRecomputeInterval: %v", err))
+	}
+	if _, err := recalculatePPWhere(cfg); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.RecalculateScoresPP {
+		if err := checkDir(cfg.BeatmapFolder); err != nil {
+			errs = append(errs, fmt.Errorf("BeatmapFolder: %v", err))
+		}
+	}
+	if cfg.RecalculatePPMaxChange < 0 {
+		errs = append(errs, fmt.Errorf("RecalculatePPMaxChange: can't be negative"))
+	}
+	if err := checkPPHistoryStore(cfg.PPHistoryStore); err != nil {
+		errs = append(errs, fmt.Errorf("PPHistoryStore: %v", err))
+	}
+	if cfg.PPHistoryRetentionDays < 0 {
+		errs = append(errs, fmt.Errorf("PPHistoryRetentionDays: can't be negative"))
+	}
+	if cfg.MaxErrors < 0 {
+		errs = append(errs, fmt.Errorf("MaxErrors: can't be negative"))
+	}
+	if _, err := parseDuration(cfg.LockTTL); err != nil {
+		errs = append(errs, fmt.Errorf("LockTTL: %v", err))
+	}
+	if _, err := sortJobs(jobs); err != nil {
+		errs = append(errs, fmt.Errorf("job dependencies: %v", err))
+	}
+	if cfg.CleanReplays {
+		if err := checkDir(cfg.ReplayFolder); err != nil {
+			errs = append(errs, fmt.Errorf("ReplayFolder: %v", err))
+		}
+	}
+	if cfg.ClearExpiredProfileBackgrounds {
+		if err := checkDir(cfg.HanayoFolder); err != nil {
+			errs = append(errs, fmt.Errorf("HanayoFolder: %v", err))
+		}
+	}
+	if cfg.RemoveDonorOnExpired && cfg.DonorbotBaseApiUrl == "" {
+		errs = append(errs, fmt.Errorf("DonorbotBaseApiUrl: must be set to use RemoveDonorOnExpired"))
+	}
+	return errs
+}
+
+func checkDir(path string) error {
+	if path == "" {
+		return fmt.Errorf("is empty")
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+	return nil
+}
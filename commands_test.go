@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateConfigCheckpointInterval(t *testing.T) {
+	tests := []struct {
+		store, interval string
+		err             string
+	}{
+		{"redis", "1m", ""},
+		{"", "", ""},
+		{"table", "", "CheckpointInterval: must be set"},
+		{"table", "0s", "CheckpointInterval: must be set"},
+		{"redis", "soon", "CheckpointInterval"},
+	}
+	for _, test := range tests {
+		cfg := c
+		cfg.CheckpointStore, cfg.CheckpointInterval = test.store, test.interval
+		var got []string
+		for _, err := range validateConfig(&cfg) {
+			if strings.HasPrefix(err.Error(), "CheckpointInterval") {
+				got = append(got, err.Error())
+			}
+		}
+		if test.err == "" && len(got) > 0 {
+			t.Errorf("%+v: got errors %v", test, got)
+		} else if test.err != "" && (len(got) != 1 || !strings.HasPrefix(got[0], test.err)) {
+			t.Errorf("%+v: got errors %v, want %q", test, got, test.err)
+		}
+	}
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"fmt"
-	"net/http"
+	"os"
+	"os/signal"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/fatih/color"
@@ -21,6 +24,14 @@ type config struct {
 	RedisAddr     string
 	RedisPassword string
 
+	ReadDSN    string `description:"DSN of a replica the jobs read the scores and the stats from, while the writes go to DSN. If empty, DSN is used for both."`
+	MaxReadLag int    `description:"Refuse to start if the replica at ReadDSN is more than this many seconds behind. 0 disables the check."`
+
+	ScanChunkSize int `description:"The number of scores read by each query of the jobs going through the whole scores table."`
+
+	CheckpointStore    string `description:"Where the long jobs save their progress, so that they can be resumed with -resume: redis, table (cron_checkpoints) or empty to disable checkpoints."`
+	CheckpointInterval string `description:"How often the long jobs save their progress. Must be set to use CheckpointStore."`
+
 	CalculateAccuracy       bool
 	CacheRankedScore        bool
 	CacheTotalHits          bool
@@ -47,193 +58,505 @@ type config struct {
 	CalculateServerWiseStats       bool `description:"Re-calculates some server-wise cached stats (mostly displayed in RAP)"`
 	FixStatsOverflow               bool `description:"Re-calculates ranked & total score for users whose values have overflowed. Faster than CacheData if there's an overflow issue. This will be ignored if CacheData=true."`
 
+	PPWeighting             string `description:"How CalculatePP adds up the pp of the scores of a user. Semicolon-separated list of target:options, where target is default, a mode (std, taiko, ctb, mania) or relax_ followed by a mode, and options are comma-separated key=value: decay (0.95), top (500), round (each, total or none), bonus (true to award 416.6667 * (1 - 0.9994^n) pp for n scores). E.g. default:bonus=true;relax_std:top=100"`
+	IncrementalPP           bool   `description:"Make CalculatePP only recompute the pp of the users who set new scores since its last run."`
+	FullPPRecomputeInterval string `description:"With IncrementalPP, how often CalculatePP still recomputes the pp of every user (e.g. 24h). Empty to only do it the first time."`
+
+	RecalculateScoresPP    bool   `description:"Re-calculate the pp of each score from the .osu files in BeatmapFolder, with the calculator of ripple-cron-go, and report the ones which changed. std, taiko and mania are supported, ctb isn't. The relax scores are left untouched."`
+	BeatmapFolder          string `description:"The folder of the .osu files read by RecalculateScoresPP, named <beatmap id>.osu."`
+	RecalculatePPWrite     bool   `description:"Make RecalculateScoresPP update the pp of the scores which changed. Without it, it only reports the changes."`
+	RecalculatePPMaxChange int    `description:"The scores whose pp would change by more than this many pp are logged and skipped by RecalculateScoresPP, as the calculator is more likely to be wrong than the old pp. 0 disables the limit."`
+	RecalculatePPBeatmaps  string `description:"Comma-separated list of beatmap IDs. If set, RecalculateScoresPP only re-calculates the scores on these beatmaps."`
+	RecalculatePPUsers     string `description:"Comma-separated list of user IDs. If set, RecalculateScoresPP only re-calculates the scores of these users."`
+	RecalculatePPModes     string `description:"Comma-separated list of modes (std, taiko, mania; ctb isn't supported). If set, RecalculateScoresPP only re-calculates the scores in these modes."`
+
+	SnapshotPPHistory      bool   `description:"Save the pp and the ranks of every active user once a day, so that they can be graphed. Meant to be run daily, after CalculatePP."`
+	PPHistoryStore         string `description:"Where SnapshotPPHistory saves the snapshots: table (users_pp_history, created if it doesn't exist) or redis (a sorted set per user and mode)."`
+	PPHistoryRetentionDays int    `description:"The number of days the snapshots are kept for. 0 keeps them forever."`
+
+	MaxErrors int `description:"The number of failed queries a job can have before it's considered failed, making ripple-cron-go exit with status 1."`
+
+	Retries        int    `description:"How many times a query failing because of a deadlock, a lock wait timeout or a lost connection is retried."`
+	RetryBackoff   string `description:"How long to wait before retrying a query the first time. It doubles after each attempt."`
+	DeadLetterFile string `description:"File to which the queries which still failed after being retried are saved, so that they can be run again with the dead-letter replay command."`
+
+	BatchSize int `description:"The largest number of queued queries a worker executes at once, in a single transaction. Queries updating a single row of the same table are merged into multi-row statements. 1 disables batching."`
+
+	WriteRateLimit        int    `description:"The largest number of queued writes executed per second, across all the workers. 0 means no limit."`
+	TableRateLimits       string `description:"Semicolon-separated list of table=N, limiting the queued writes to a table to N per second (e.g. users_stats=500;scores=200)."`
+	MaxThreadsRunning     int    `description:"Pause the writes while the Threads_running of MySQL is above this. 0 disables the check."`
+	MaxReplicationLag     int    `description:"Pause the writes while the replica at ThrottleReplicaDSN is more than this many seconds behind. 0 disables the check."`
+	ThrottleReplicaDSN    string `description:"DSN of the replica whose lag is checked for MaxReplicationLag. If empty, ReadDSN is used."`
+	ThrottleCheckInterval string `description:"How often MaxThreadsRunning and MaxReplicationLag are checked."`
+
 	Workers int `description:"The number of goroutines which should execute queries. Increasing it may make cron faster, depending on your system."`
+
+	Schedule string `description:"Only used with -daemon. Semicolon-separated list of Job=spec, where Job is the name of the job (e.g. CalculatePP) and spec is a cron expression (0 4 * * *) or an interval (@every 1h)."`
+
+	Timeouts       string `description:"Semicolon-separated list of Job=duration (e.g. CalculatePP=30m; CacheData=1h). A job running for longer than its duration is stopped, and its queries are cancelled."`
+	MaxRunDuration string `description:"If set (e.g. 2h), every job still running after this long is stopped. In daemon mode, this applies to each scheduled run."`
+
+	LockJobs bool   `description:"Take a lock in redis (ripple:cron:lock:<job>) while running each job, so that multiple instances of ripple-cron-go never run the same job at the same time."`
+	LockRun  bool   `description:"Take a lock in redis (ripple:cron:lock:run) for the whole run. Not used in daemon mode."`
+	LockWait bool   `description:"When a lock is held by another instance, wait for it to be released instead of skipping the job (or the run)."`
+	LockTTL  string `description:"How long a lock is kept if the instance holding it dies. It is renewed while it's held."`
+
+	LogFormat string `description:"How log messages are written: text (colored, for terminals), json or logfmt."`
+	LogLevel  string `description:"The least severe messages which are logged: trace (every query), debug (the progress of each job), info, warn or error. -v and -vv are shortcuts for debug and trace."`
+
+	MetricsAddr    string `description:"Only used with -daemon. If set (e.g. :9100), Prometheus metrics are served on /metrics at this address."`
+	PushgatewayURL string `description:"If set, the metrics are pushed to this Prometheus pushgateway at the end of each run. Not used in daemon mode."`
+	PushgatewayJob string `description:"The job name under which the metrics are pushed to PushgatewayURL."`
+
+	APIAddr  string `description:"Only used with -daemon. If set (e.g. 127.0.0.1:9200), the admin API, which can list, run and cancel jobs, is served at this address."`
+	APIToken string `description:"The token which must be sent to the admin API, in an Authorization: Bearer <token> header. The API is not started if it's empty."`
+
+	Webhooks string `description:"Semicolon-separated list of format=url, where format is discord, slack or json. A summary of each run is sent to every URL."`
+	NotifyOn string `description:"When to send the summary to Webhooks: always, or only on failure."`
+
+	RunHistory bool `description:"Save every run, and the outcome of each of its jobs, in the cron_runs and cron_job_runs tables, which are created if they don't exist."`
 }
 
 var db *sqlx.DB
 var c = config{
-	DSN:     "root@/ripple",
-	Workers: 8,
+	DSN:        "root@/ripple",
+	MaxReadLag: 60,
+
+	ScanChunkSize: 10000,
+
+	CheckpointInterval: "1m",
+
+	FullPPRecomputeInterval: "24h",
+
+	RecalculatePPMaxChange: 100,
+
+	PPHistoryStore:         "table",
+	PPHistoryRetentionDays: 365,
+
+	Workers:   8,
+	BatchSize: 500,
+
+	ThrottleCheckInterval: "1s",
+
+	Retries:        3,
+	RetryBackoff:   "200ms",
+	DeadLetterFile: "dead_letter.jsonl",
+
+	LockTTL:   "1m",
+	LogFormat: "text",
+	LogLevel:  "info",
+
+	PushgatewayJob: "ripple_cron",
+	NotifyOn:       "always",
 }
 var r *redis.Client
-var wg sync.WaitGroup
 var chanWg sync.WaitGroup
 var v bool
 var vv bool
+var daemon bool
+var dryRun bool
 var configFile string
 
 func init() {
-	flag.BoolVar(&v, "v", false, "verbose")
-	flag.BoolVar(&vv, "vv", false, "very verbose (LogQueries)")
-	configFlag := flag.String("config", "cron.conf", "Configuration file")
-	flag.Parse()
-	configFile = string(*configFlag)
-
-	v = vv || v
+	flag.BoolVar(&v, "v", false, "verbose (LogLevel=debug)")
+	flag.BoolVar(&vv, "vv", false, "very verbose (LogLevel=trace, logs every query)")
+	flag.BoolVar(&daemon, "daemon", false, "keep running, and run each job as specified in Schedule")
+	flag.BoolVar(&dryRun, "dry-run", false, "report every write to the database, redis and files without doing it")
+	flag.BoolVar(&resume, "resume", false, "resume the jobs from their last checkpoint, if they have one (see CheckpointStore)")
+	flag.StringVar(&configFile, "config", "cron.conf", "Configuration file")
+	flag.Usage = usage
 }
 
+// Exit codes of ripple-cron-go.
+const (
+	exitOK = 0
+	// exitFailed means that at least one job failed or timed out.
+	exitFailed = 1
+	// exitConfig means that the config file or the command line is invalid.
+	exitConfig = 2
+	// exitConnection means that MySQL or redis couldn't be reached.
+	exitConnection = 3
+	// exitInterrupted means that the run was interrupted by a signal before
+	// all the jobs were done.
+	exitInterrupted = 130
+)
+
 func main() {
 	// Set up the configuration.
 	flag.Parse()
+	v = vv || v
+	os.Exit(realMain())
+}
 
-	err := conf.Load(&c, configFile)
-	switch {
-	case err == conf.ErrNoFile:
-		color.Yellow("No %s was found. Creating it", configFile)
-		err := conf.Export(&c, configFile)
-		if err != nil {
-			color.Red("Couldn't create %s: %v.", configFile, err)
-		} else {
-			color.Green("%s has been created!", configFile)
+// realMain runs ripple-cron-go, and returns its exit code.
+func realMain() int {
+	args := flag.Args()
+	var command string
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+	switch command {
+	case "", "run":
+	case "list":
+		cmdList()
+		return exitOK
+	case "config":
+		return cmdConfig(args)
+	case "history":
+		return cmdHistory(args)
+	case "dead-letter":
+		return cmdDeadLetter(args)
+	case "pp-history":
+		return cmdPPHistory(args)
+	default:
+		color.Red("Unknown command %q.", command)
+		flag.Usage()
+		return exitConfig
+	}
+
+	if !loadConfig() {
+		return exitConfig
+	}
+	if err := setupLogging(&c); err != nil {
+		color.Red("LogFormat or LogLevel is invalid: %v.", err)
+		return exitConfig
+	}
+	if errs := validateConfig(&c); len(errs) > 0 {
+		for _, err := range errs {
+			baseLog.errorf("%s is invalid: %v.", configFile, err)
 		}
-		return
-	case err != nil:
-		color.Red("%s couldn't be loaded: %v.", configFile, err)
-		return
+		return exitConfig
 	}
 
-	verboseln("Starting MySQL connection")
+	var err error
+	jobTimeouts, err = parseTimeouts(c.Timeouts)
+	if err != nil {
+		baseLog.errorf("Timeouts is invalid: %v.", err)
+		return exitConfig
+	}
+	maxRunDuration, err = parseDuration(c.MaxRunDuration)
+	if err != nil {
+		baseLog.errorf("MaxRunDuration is invalid: %v.", err)
+		return exitConfig
+	}
+	retryBackoff, err = parseDuration(c.RetryBackoff)
+	if err != nil {
+		baseLog.errorf("RetryBackoff is invalid: %v.", err)
+		return exitConfig
+	}
+	if err := setupRateLimits(&c); err != nil {
+		baseLog.errorf("TableRateLimits is invalid: %v.", err)
+		return exitConfig
+	}
+	if err := checkCheckpointStore(c.CheckpointStore); err != nil {
+		baseLog.errorf("CheckpointStore is invalid: %v.", err)
+		return exitConfig
+	}
+	throttleInterval, err := parseDuration(c.ThrottleCheckInterval)
+	if err != nil {
+		baseLog.errorf("ThrottleCheckInterval is invalid: %v.", err)
+		return exitConfig
+	}
+	webhooks, err = parseWebhooks(c.Webhooks)
+	if err != nil {
+		baseLog.errorf("Webhooks is invalid: %v.", err)
+		return exitConfig
+	}
+	if err := checkNotifyOn(c.NotifyOn); err != nil {
+		baseLog.errorf("NotifyOn is invalid: %v.", err)
+		return exitConfig
+	}
+	if _, err := sortJobs(jobs); err != nil {
+		baseLog.errorf("invalid job dependencies: %v.", err)
+		return exitConfig
+	}
+
+	var toRun []Job
+	if command == "run" {
+		if daemon {
+			baseLog.errorf("-daemon can't be used with run.")
+			return exitConfig
+		}
+		if len(args) == 0 {
+			baseLog.errorf("No job to run was given. Use list to see the available jobs.")
+			return exitConfig
+		}
+		for _, name := range args {
+			j := findJob(name)
+			if j == nil {
+				baseLog.errorf("There is no job named %s. Use list to see the available jobs.", name)
+				return exitConfig
+			}
+			toRun = append(toRun, j)
+		}
+	} else {
+		for _, j := range jobs {
+			if j.Enabled(&c) {
+				toRun = append(toRun, j)
+			}
+		}
+	}
+
+	baseLog.debugf("Starting MySQL connection")
 	// start database connection
 	db, err = sqlx.Open("mysql", c.DSN)
 	if err != nil {
-		color.Red("couldn't start MySQL connection: %v.", err)
-		return
+		baseLog.errorf("couldn't start MySQL connection: %v.", err)
+		return exitConfig
 	}
 	defer db.Close()
+	if err := db.Ping(); err != nil {
+		baseLog.errorf("couldn't connect to MySQL: %v.", err)
+		return exitConnection
+	}
+	if err := openReadDB(); err != nil {
+		baseLog.errorf("couldn't use the replica at ReadDSN: %v.", err)
+		return exitConnection
+	}
+	if readDB != db {
+		defer readDB.Close()
+	}
 
 	r = redis.NewClient(&redis.Options{
 		Addr:     c.RedisAddr,
 		Password: c.RedisPassword,
 	})
+	if c.LockJobs || c.LockRun {
+		if err := r.Ping().Err(); err != nil {
+			baseLog.errorf("couldn't connect to redis, which is needed for locks: %v.", err)
+			return exitConnection
+		}
+	}
+	if c.CheckpointStore == "redis" {
+		if err := r.Ping().Err(); err != nil {
+			baseLog.errorf("couldn't connect to redis, which is needed for checkpoints: %v.", err)
+			return exitConnection
+		}
+	}
+	if c.CheckpointStore == "table" && checkpointsEnabled(&c) {
+		if _, err := db.Exec(checkpointTable); err != nil {
+			baseLog.errorf("couldn't create the checkpoints table: %v.", err)
+			return exitConnection
+		}
+	}
+
+	if historyEnabled() {
+		if err := createHistoryTables(); err != nil {
+			baseLog.errorf("couldn't create the run history tables: %v.", err)
+			return exitConnection
+		}
+	}
 
 	// spawn some workers
-	verboseln("Spawning necessary workers")
+	baseLog.debugf("Spawning necessary workers")
 	for i := 0; i < c.Workers; i++ {
 		chanWg.Add(1)
-		go worker(execOperations)
+		go worker(execOperations, true)
 	}
 	chanWg.Add(1)
-	go worker(syncOperations)
+	go worker(syncOperations, false)
+	defer func() {
+		close(execOperations)
+		close(syncOperations)
+		chanWg.Wait()
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go handleSignals(cancel)
+
+	if throttleEnabled(&c) && !dryRun {
+		// the writes are resumed once interrupted, so that the workers
+		// waiting for them don't keep the jobs from stopping
+		throttleCtx, stopThrottle := context.WithCancel(ctx)
+		defer stopThrottle()
+		go monitorThrottle(throttleCtx, throttleInterval)
+	}
+
+	if daemon {
+		if c.MetricsAddr != "" {
+			go serveMetrics(ctx)
+		}
+		if c.APIAddr != "" {
+			go serveAPI(ctx)
+		}
+		err := runDaemon(ctx)
+		cancel()
+		apiRuns.wg.Wait()
+		if err != nil {
+			baseLog.errorf("%v.", err)
+			return exitConfig
+		}
+		return exitOK
+	}
 
 	timeAtStart := time.Now()
 
-	if c.CalculateAccuracy {
-		verboseln("Starting accuracy calculator worker")
-		wg.Add(1)
-		go opCalculateAccuracy()
-	}
-	if c.DeleteOldPasswordResets {
-		verboseln("Starting deleting old password resets")
-		go opSync("DELETE FROM password_recovery WHERE t < (NOW() - INTERVAL 1 DAY);")
-	}
-	if c.FixCompletedScores {
-		verboseln("Starting fixing completed = 3 scores on not ranked beatmaps")
-		go opSync(`UPDATE scores
-			INNER JOIN beatmaps ON beatmaps.beatmap_md5 = scores.beatmap_md5
-			SET completed = '2'
-			WHERE beatmaps.ranked < 1 OR beatmaps.ranked > 5;`)
-	}
-	if c.DeleteOldPrivateTokens {
-		verboseln("Deleting old private API tokens")
-		go opSync(`DELETE FROM tokens WHERE private = 1 AND last_updated < ?`, time.Now().Add(-time.Hour*24*30))
-	}
-	if c.UnrankScoresOnInvalidBeatmaps {
-		verboseln("Unranking scores on invalid beatmaps")
-		go opSync(`DELETE scores.* FROM scores
-		LEFT JOIN beatmaps ON scores.beatmap_md5 = beatmaps.beatmap_md5
-		WHERE beatmaps.beatmap_md5 IS NULL`)
-	}
-	if c.PrunePendingVerificationAfter > 0 {
-		verboseln("Pruning users pending verification...")
-		go opSync(`DELETE users, users_stats FROM users
-		INNER JOIN users_stats
-		WHERE users.id = users_stats.id AND users.latest_activity = 0
-		AND users.privileges = 1048576 AND users.register_datetime < ?`,
-			time.Now().Add(-time.Hour*24*time.Duration(c.PrunePendingVerificationAfter)).Unix())
-	}
-	if c.RemoveDonorOnExpired {
-		verboseln("Removing donor privileges on users where donor expired")
-		go func() {
-			_, err := http.Get(c.DonorbotBaseApiUrl+"/discord/unlink_expired.php?k="+c.DonorbotSecret)
-			if err != nil {
-				color.Red("%v", err)
-			}
-		}()
-	}
-	cacheData := c.CacheLevel || c.CacheTotalHits || c.CacheRankedScore || c.CachePlayTime || c.CacheMostPlayedBeatmaps
-	if cacheData {
-		verboseln("Starting caching of various user stats")
-		wg.Add(1)
-		go opCacheData()
-	}
-	if cacheData && c.FixStatsOverflow {
-		color.Yellow("> Ignoring FixStatsOverflow because CacheData is already enabled")
-	} else if c.FixStatsOverflow {
-		verboseln("Starting fixing total scores and ranked scores overflow")
-		wg.Add(1)
-		go opFixStatsOverflow()
-	}
-	if c.CleanReplays {
-		verboseln("Starting cleaning useless replays")
-		wg.Add(1)
-		go opCleanReplays()
-	}
-	if c.CalculatePP {
-		verboseln("Starting calculating pp")
-		wg.Add(2)
-		go opCalculatePP()
-	}
-	if c.FixScoreDuplicates {
-		verboseln("Starting fixing score duplicates")
-		wg.Add(1)
-		go opFixScoreDuplicates()
-	}
-	if c.CalculateOverallAccuracy {
-		verboseln("Starting calculating overall accuracy")
-		wg.Add(1)
-		go opCalculateOverallAccuracy()
-	}
-	if c.FixMultipleCompletedScores {
-		verboseln("Starting fixing multiple completed scores")
-		wg.Add(1)
-		go opFixMultipleCompletedScores()
-	}
-	if c.ClearExpiredProfileBackgrounds {
-		verboseln("Removing profile backgrounds of expired donors")
-		wg.Add(1)
-		go opClearExpiredProfileBackgrounds()
-	}
-	if c.SetOnlineUsers {
-		wg.Add(1)
-		go opSetOnlineUsers()
-	}
-	if c.CalculateServerWiseStats {
-		verboseln("Starting calculating server-wise stats")
-		wg.Add(1)
-		go opServerwiseStats()
-	}
-
-	wg.Wait()
-	color.Green("Data elaboration has finished")
-	color.Green("Execution time: %.4fs", time.Now().Sub(timeAtStart).Seconds())
-	color.Yellow("Waiting for workers to finish")
-	close(execOperations)
-	close(syncOperations)
-	chanWg.Wait()
-	conf.Export(c, configFile)
+	for _, j := range toRun {
+		baseLog.with("job", j.Name()).debugf("Starting")
+	}
+	runCtx := ctx
+	if maxRunDuration > 0 {
+		var cancelRun context.CancelFunc
+		runCtx, cancelRun = context.WithTimeout(ctx, maxRunDuration)
+		defer cancelRun()
+	}
+	if c.LockRun && !dryRun {
+		lock, lockCtx, err := acquireLock(runCtx, "run")
+		switch err.(type) {
+		case nil:
+		case errLocked:
+			baseLog.warnf("Skipping the run: %v.", err)
+			return exitOK
+		default:
+			baseLog.errorf("Couldn't take the run lock: %v.", err)
+			return exitConnection
+		}
+		defer lock.release()
+		runCtx = lockCtx
+	}
+	runID := startRunHistory()
+	runCtx = withRunID(runCtx, newRunID(runID))
+	runs, err := runJobs(runCtx, toRun)
+	if err != nil {
+		baseLog.errorf("%v.", err)
+		return exitConfig
+	}
+	printSummary(runs)
+	finishRunHistory(runID, runs)
+	notifyRun(runCtx, runs)
+
+	if dryRun {
+		names := make([]string, len(toRun))
+		for i, j := range toRun {
+			names[i] = j.Name()
+		}
+		printDryRunReport(names...)
+	}
+
+	baseLog.with("duration", time.Now().Sub(timeAtStart)).infof("Data elaboration has finished")
+	baseLog.debugf("Waiting for workers to finish")
+	// Add any new option to the config file, unless only some jobs were
+	// picked on the command line.
+	if !dryRun && command == "" {
+		conf.Export(c, configFile)
+	}
+	if c.PushgatewayURL != "" && !dryRun {
+		pushMetrics()
+	}
+	return exitCode(runs)
+}
+
+// exitCode returns the exit code for a run which ended with runs.
+func exitCode(runs []*jobRun) int {
+	code := exitOK
+	for _, jr := range runs {
+		if jr == nil {
+			continue
+		}
+		switch jr.status {
+		case statusFailed, statusTimedOut:
+			return exitFailed
+		case statusInterrupted, statusNotStarted:
+			code = exitInterrupted
+		}
+	}
+	return code
+}
+
+// handleSignals cancels the run when SIGINT or SIGTERM is received, so that
+// jobs stop and the operations already queued are executed. If a second
+// signal is received, ripple-cron-go quits straight away.
+func handleSignals(cancel context.CancelFunc) {
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+
+	<-sig
+	baseLog.warnf("Interrupted: stopping jobs and executing the operations already queued. Interrupt again to quit immediately.")
+	cancel()
+
+	<-sig
+	runningJobs.Lock()
+	running := make([]string, 0, len(runningJobs.m))
+	for j := range runningJobs.m {
+		running = append(running, j.Name())
+	}
+	runningJobs.Unlock()
+	baseLog.with("operations_queued", len(execOperations)+len(syncOperations), "running_jobs", running).
+		errorf("Quitting with operations still queued")
+	os.Exit(exitInterrupted)
+}
+
+// loadConfig loads the config file into c. If it doesn't exist, it is created
+// instead. It returns whether ripple-cron-go can go on.
+func loadConfig() bool {
+	err := conf.Load(&c, configFile)
+	switch {
+	case err == conf.ErrNoFile:
+		baseLog.warnf("No %s was found. Creating it", configFile)
+		err := conf.Export(&c, configFile)
+		if err != nil {
+			baseLog.errorf("Couldn't create %s: %v.", configFile, err)
+		} else {
+			baseLog.infof("%s has been created!", configFile)
+		}
+		return false
+	case err != nil:
+		baseLog.errorf("%s couldn't be loaded: %v.", configFile, err)
+		return false
+	}
+	return true
 }
 
 // db operation to be made, generally used for execOperations
 type operation struct {
 	query  string
 	params []interface{}
+	// run is the job run which queued the operation, if any.
+	run *jobRun
+	// row is set if the operation writes a single row, and can therefore be
+	// merged with similar operations into a single statement.
+	row *batchRow
 }
 
-func op(query string, params ...interface{}) {
-	execOperations <- operation{query, params}
+// queueOperation sends op to ch, unless ctx is done before it can be queued.
+func queueOperation(ctx context.Context, ch chan<- operation, op operation) {
+	jr := jobRunFromContext(ctx)
+	op.run = jr
+	if jr == nil {
+		select {
+		case ch <- op:
+		case <-ctx.Done():
+		}
+		return
+	}
+
+	jr.ops.Add(1)
+	select {
+	case ch <- op:
+		atomic.AddInt64(&jr.opsQueued, 1)
+	case <-ctx.Done():
+		atomic.AddInt64(&jr.opsDropped, 1)
+		jr.ops.Done()
+	}
 }
-func opSync(query string, params ...interface{}) {
-	syncOperations <- operation{query, params}
+
+// waitOperations waits until the operations queued by the job running with ctx
+// have been executed. It reports whether all of them could be queued, which is
+// not the case if the job was stopped.
+func waitOperations(ctx context.Context) bool {
+	jr := jobRunFromContext(ctx)
+	if jr == nil {
+		return true
+	}
+	jr.ops.Wait()
+	return atomic.LoadInt64(&jr.opsDropped) == 0
+}
+
+func op(ctx context.Context, query string, params ...interface{}) {
+	queueOperation(ctx, execOperations, operation{query: query, params: params})
+}
+func opSync(ctx context.Context, query string, params ...interface{}) {
+	queueOperation(ctx, syncOperations, operation{query: query, params: params})
 }
 
 // Operations that can be executed with a simple db.Exec, distributed across 8 workers.
@@ -242,48 +565,78 @@ var execOperations = make(chan operation, 100000)
 // Operations that must be executed in order and synchronously.
 var syncOperations = make(chan operation, 20)
 
-func worker(c <-chan operation) {
+// worker executes the operations sent to c. If exec is set, the operations
+// waiting in c are executed together, as explained in runBatch, and are
+// subject to the rate limits.
+func worker(c <-chan operation, exec bool) {
 	for op := range c {
-		runOperation(op)
+		ops := []operation{op}
+		if exec {
+			if op.row != nil {
+				ops = collectBatch(c, ops)
+			}
+			throttleWrites(ops)
+		}
+		runBatch(ops)
+		for _, op := range ops {
+			operationsExecutedTotal.WithLabelValues(jobLabel(op.run)).Inc()
+			if op.run != nil {
+				atomic.AddInt64(&op.run.opsExecuted, 1)
+				op.run.ops.Done()
+			}
+		}
 	}
 	chanWg.Done()
 }
 
 func runOperation(op operation) {
-	logquery(op.query, op.params)
-	_, err := db.Exec(op.query, op.params...)
+	if dryRun {
+		reportWrite(op.run, queryTarget(op.query), "execute %s | params: %v", op.query, op.params)
+		return
+	}
+	l := baseLog
+	if op.run != nil {
+		l = op.run.log
+	}
+	if logEnabled(levelTrace) {
+		l.with("query", op.query, "params", op.params).tracef("executing query")
+	}
+	res, err := execWithRetry(l, jobLabel(op.run), op.query, op.params...)
 	if err != nil {
-		queryError(err, op.query, op.params...)
+		failOperation(l, op, err)
+		return
 	}
-}
-
-func queryError(err error, query string, params ...interface{}) {
-	color.Red(`==> Query error!
-===> %s
-===> params: %v
-===> error: %v`, query, params, err)
-}
-
-func logquery(q string, params []interface{}) {
-	if vv {
-		// porcodio go se sei odioso
-		a := []interface{}{
-			"=>",
-			q,
-			"| params:",
+	if op.run != nil {
+		if n, err := res.RowsAffected(); err == nil {
+			atomic.AddInt64(&op.run.rowsAffected, n)
 		}
-		a = append(a, params...)
-		fmt.Println(a...)
 	}
 }
 
-func verbosef(format string, args ...interface{}) {
-	if v {
-		fmt.Printf(format, args...)
+// failOperation reports that op failed with err, and saves it to
+// DeadLetterFile.
+func failOperation(l logger, op operation, err error) {
+	logQueryError(l, err, op.query, op.params...)
+	if op.run != nil {
+		atomic.AddInt64(&op.run.opsFailed, 1)
+		op.run.addError(err, op.query)
 	}
+	deadLetterOperation(l, op, err)
 }
-func verboseln(args ...interface{}) {
-	if v {
-		fmt.Println(args...)
+
+// queryError reports an error of a query made by the job running with ctx.
+func queryError(ctx context.Context, err error, query string, params ...interface{}) {
+	// the job has been interrupted or has timed out, which is reported at
+	// the end of the run
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return
+	}
+	logQueryError(logFor(ctx), err, query, params...)
+	if jr := jobRunFromContext(ctx); jr != nil {
+		jr.addError(err, query)
 	}
 }
+
+func logQueryError(l logger, err error, query string, params ...interface{}) {
+	l.with("query", query, "params", params, "error", err).errorf("Query error!")
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron"
+)
+
+// parseSchedule parses the Schedule config option, returning the schedule
+// of every job in it.
+func parseSchedule(s string) (map[Job]cron.Schedule, error) {
+	specs, err := parseJobOptions(s)
+	if err != nil {
+		return nil, err
+	}
+	schedules := make(map[Job]cron.Schedule, len(specs))
+	for j, spec := range specs {
+		sched, err := cron.ParseStandard(spec)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", j.Name(), err)
+		}
+		schedules[j] = sched
+	}
+	return schedules, nil
+}
+
+var daemonLog = baseLog.with("component", "Daemon")
+
+// runDaemon runs the jobs in Schedule until ctx is done, and then waits for
+// the running jobs to stop. It returns an error if Schedule is invalid.
+func runDaemon(ctx context.Context) error {
+	schedules, err := parseSchedule(c.Schedule)
+	if err != nil {
+		return fmt.Errorf("invalid Schedule: %v", err)
+	}
+	if len(schedules) == 0 && c.APIAddr == "" {
+		daemonLog.warnf("no job is in Schedule, nothing to do")
+		return nil
+	}
+
+	// closed is set once the daemon is stopping, after which the jobs which
+	// are triggered don't start, so that wg.Add isn't called during wg.Wait
+	var running struct {
+		sync.Mutex
+		closed bool
+		wg     sync.WaitGroup
+	}
+	cr := cron.New()
+	for j, sched := range schedules {
+		j := j
+		cr.Schedule(sched, cron.FuncJob(func() {
+			running.Lock()
+			if running.closed || ctx.Err() != nil {
+				running.Unlock()
+				return
+			}
+			running.wg.Add(1)
+			running.Unlock()
+			defer running.wg.Done()
+			runCtx := ctx
+			if maxRunDuration > 0 {
+				var cancel context.CancelFunc
+				runCtx, cancel = context.WithTimeout(ctx, maxRunDuration)
+				defer cancel()
+			}
+			runScheduled(runCtx, j)
+		}))
+		daemonLog.with("next_run", sched.Next(time.Now())).debugf("scheduled %s", j.Name())
+	}
+	cr.Start()
+	daemonLog.infof("started with %d jobs", len(schedules))
+
+	<-ctx.Done()
+	cr.Stop()
+	running.Lock()
+	running.closed = true
+	running.Unlock()
+	daemonLog.debugf("waiting for running jobs to stop")
+	running.wg.Wait()
+	return nil
+}
+
+func runScheduled(ctx context.Context, j Job) {
+	runID := startRunHistory()
+	ctx = withRunID(ctx, newRunID(runID))
+	logFor(ctx).with("component", "Daemon").debugf("starting %s", j.Name())
+	jr := runJob(ctx, j, nil)
+	if jr == nil {
+		logFor(ctx).with("component", "Daemon").warnf("%s is still running, skipping this run", j.Name())
+		finishRunHistory(runID, nil)
+		return
+	}
+	printRun(jr)
+	finishRunHistory(runID, []*jobRun{jr})
+	notifyRun(ctx, []*jobRun{jr})
+	if dryRun {
+		printDryRunReport(j.Name())
+	}
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRunDaemonInvalidSchedule(t *testing.T) {
+	oldSchedule := c.Schedule
+	defer func() { c.Schedule = oldSchedule }()
+	for _, schedule := range []string{"CacheData=every day", "NoSuchJob=@daily"} {
+		c.Schedule = schedule
+		if err := runDaemon(context.Background()); err == nil {
+			t.Errorf("%q: no error", schedule)
+		}
+	}
+}
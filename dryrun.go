@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// dryRunWrites counts the writes which have been skipped because of -dry-run,
+// by job and then by target (a table, "files", "redis" or "http").
+var dryRunWrites = struct {
+	sync.Mutex
+	m map[string]map[string]int
+}{m: make(map[string]map[string]int)}
+
+// reportWrite reports a write of jr, which may be nil, which is not being done
+// because of -dry-run.
+func reportWrite(jr *jobRun, target, format string, args ...interface{}) {
+	job := "(none)"
+	l := baseLog.with("job", job)
+	if jr != nil {
+		job = jr.job.Name()
+		l = jr.log
+	}
+	dryRunWrites.Lock()
+	if dryRunWrites.m[job] == nil {
+		dryRunWrites.m[job] = make(map[string]int)
+	}
+	dryRunWrites.m[job][target]++
+	dryRunWrites.Unlock()
+
+	l.with("target", target).infof("[dry-run] would %s", fmt.Sprintf(format, args...))
+}
+
+// reportContextWrite is like reportWrite, but takes the job from ctx.
+func reportContextWrite(ctx context.Context, target, format string, args ...interface{}) {
+	reportWrite(jobRunFromContext(ctx), target, format, args...)
+}
+
+// removeFile removes the file at path, or only reports it with -dry-run.
+func removeFile(ctx context.Context, path string) error {
+	if dryRun {
+		reportContextWrite(ctx, "files", "remove %s", path)
+		return nil
+	}
+	err := os.Remove(path)
+	if err == nil {
+		filesDeletedTotal.WithLabelValues(jobLabel(jobRunFromContext(ctx))).Inc()
+	}
+	return err
+}
+
+// redisWrite runs write, which must write to redis, unless -dry-run is set.
+// In that case, the command and its arguments are reported instead.
+func redisWrite(ctx context.Context, write func() error, command string, args ...interface{}) error {
+	if dryRun {
+		reportContextWrite(ctx, "redis", "run %s %v", command, args)
+		return nil
+	}
+	return write()
+}
+
+// queryTarget returns the name of the table(s) written by the given query.
+func queryTarget(query string) string {
+	fields := strings.Fields(strings.ToLower(query))
+	if len(fields) < 2 {
+		return "unknown"
+	}
+	switch fields[0] {
+	case "update":
+		return strings.Trim(fields[1], "`;")
+	case "insert", "replace":
+		if fields[1] == "into" && len(fields) > 2 {
+			return strings.Trim(fields[2], "`;(")
+		}
+		return strings.Trim(fields[1], "`;(")
+	case "delete":
+		// either DELETE FROM table or DELETE t1, t2 FROM ...
+		if fields[1] == "from" && len(fields) > 2 {
+			return strings.Trim(fields[2], "`;")
+		}
+		var tables []string
+		for _, f := range fields[1:] {
+			if f == "from" {
+				break
+			}
+			tables = append(tables, strings.TrimSuffix(strings.Trim(f, "`,"), ".*"))
+		}
+		return strings.Join(tables, ", ")
+	}
+	return fields[0]
+}
+
+// printDryRunReport prints how many writes have been skipped for each of the
+// given jobs, or for all of them if none is passed, and then forgets them.
+func printDryRunReport(jobNames ...string) {
+	dryRunWrites.Lock()
+	defer dryRunWrites.Unlock()
+
+	if len(jobNames) == 0 {
+		for name := range dryRunWrites.m {
+			jobNames = append(jobNames, name)
+		}
+		sort.Strings(jobNames)
+	}
+
+	for _, name := range jobNames {
+		targets := dryRunWrites.m[name]
+		l := baseLog.with("job", name)
+		if targets == nil {
+			l.infof("[dry-run] no writes")
+			continue
+		}
+		keys := make([]string, 0, len(targets))
+		total := 0
+		for k, v := range targets {
+			keys = append(keys, k)
+			total += v
+		}
+		sort.Strings(keys)
+		l = l.with("writes", total)
+		for _, k := range keys {
+			l = l.with("writes_"+k, targets[k])
+		}
+		l.infof("[dry-run] writes")
+		delete(dryRunWrites.m, name)
+	}
+}
@@ -1,33 +1,59 @@
 package main
 
-import "github.com/fatih/color"
+import (
+	"context"
+)
 
-func opFixMultipleCompletedScores() {
-	defer wg.Done()
-	const initQuery = "SELECT id, userid, beatmap_md5, play_mode, score FROM scores WHERE completed = 3 ORDER BY id DESC"
+func init() {
+	registerJob(&basicJob{
+		name:        "FixMultipleCompletedScores",
+		description: "Set completed=2 if multiple completed=3 scores for same beatmap and user are present.",
+		enabled:     func(c *config) bool { return c.FixMultipleCompletedScores },
+		run:         opFixMultipleCompletedScores,
+	})
+}
+
+func opFixMultipleCompletedScores(ctx context.Context) error {
 	scores := []score{}
-	rows, err := db.Query(initQuery)
-	if err != nil {
-		queryError(err, initQuery)
-		return
-	}
+	rows := newScoreScanner(ctx, scanQuery{
+		cols:  "userid, beatmap_md5, play_mode, score",
+		from:  "scores",
+		where: "completed = 3",
+		desc:  true,
+	}, 0)
+	defer rows.Close()
 	for rows.Next() {
+		countRows(ctx, 1)
 		currentScore := score{}
 		rows.Scan(
-			&currentScore.id,
 			&currentScore.userid,
 			&currentScore.beatmapMD5,
 			&currentScore.score,
 			&currentScore.playMode,
 		)
+		currentScore.id = int(rows.Cursor())
 		scores = append(scores, currentScore)
 	}
-	verboseln("> FixMultipleCompletedScores: Fetched, now finding bugged completed scores...")
+	if err := rows.Err(); err != nil {
+		queryError(ctx, err, rows.Query())
+		return err
+	}
+	logFor(ctx).debugf("fetched, now finding bugged completed scores...")
 
 	fixed := []int{}
+	users := make(map[int]bool)
+	defer func() {
+		if len(users) > 0 {
+			waitOperations(ctx)
+			markPPDirty(ctx, users)
+		}
+	}()
 	for i := 0; i < len(scores); i++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		if i%1000 == 0 {
-			verboseln("> FixMultipleCompletedScores:", i)
+			logFor(ctx).with("rows_processed", i).debugf("processed")
 		}
 		if contains(fixed, scores[i].id) {
 			continue
@@ -37,16 +63,18 @@ func opFixMultipleCompletedScores() {
 				continue
 			}
 			if scores[j].id != scores[i].id && scores[j].beatmapMD5 == scores[i].beatmapMD5 && scores[j].userid == scores[i].userid && scores[j].playMode == scores[i].playMode {
-				verbosef("> FixMultipleCompletedScores: Found duplicated completed score (%d/%d)\n", scores[i].id, scores[j].id)
+				logFor(ctx).debugf("found duplicated completed score (%d/%d)", scores[i].id, scores[j].id)
 				if scores[j].score > scores[i].score {
-					op("UPDATE scores SET completed = 2 WHERE id = ?", scores[i].id)
+					opUpdate(ctx, "scores", "id", scores[i].id, []string{"completed"}, 2)
 				} else {
-					op("UPDATE scores SET completed = 2 WHERE id = ?", scores[j].id)
+					opUpdate(ctx, "scores", "id", scores[j].id, []string{"completed"}, 2)
 				}
 				fixed = append(fixed, scores[i].id, scores[j].id)
+				users[scores[i].userid] = true
 			}
 		}
 	}
 
-	color.Green("> FixMultipleCompletedScores: done!")
+	logFor(ctx).infof("done!")
+	return nil
 }
@@ -1,6 +1,18 @@
 package main
 
-import "github.com/fatih/color"
+import (
+	"context"
+	"database/sql"
+)
+
+func init() {
+	registerJob(&basicJob{
+		name:        "FixScoreDuplicates",
+		description: "Deletes duplicated scores. Might take a long time, but can be resumed with -resume.",
+		enabled:     func(c *config) bool { return c.FixScoreDuplicates },
+		run:         opFixScoreDuplicates,
+	})
+}
 
 type score struct {
 	id         int
@@ -13,65 +25,92 @@ type score struct {
 	accuracy   float64
 }
 
-func (s score) sameAs(t score) bool {
-	return s.beatmapMD5 == t.beatmapMD5 &&
-		s.userid == t.userid &&
-		s.score == t.score &&
-		s.maxCombo == t.maxCombo &&
-		s.mods == t.mods &&
-		s.playMode == t.playMode &&
-		s.accuracy == t.accuracy
-}
+// duplicatesQuery returns the duplicated scores of the users whose id is in
+// (?, ?], with their user and the id of the first score having the same
+// fields, which is the one that's kept. The duplicates are found by MySQL rather than kept in
+// memory, so the job only needs to save the last user it went through to be
+// resumed, and finds nothing in the users it already fixed.
+const duplicatesQuery = `SELECT s.id, s.userid, d.kept FROM scores s JOIN (
+	SELECT beatmap_md5, userid, score, max_combo, mods, play_mode, accuracy, MIN(id) AS kept
+	FROM scores
+	WHERE completed = '3' AND userid > ? AND userid <= ?
+	GROUP BY beatmap_md5, userid, score, max_combo, mods, play_mode, accuracy
+	HAVING COUNT(*) > 1
+) d USING (beatmap_md5, userid, score, max_combo, mods, play_mode, accuracy)
+WHERE s.completed = '3' AND s.id > d.kept`
 
-func opFixScoreDuplicates() {
-	defer wg.Done()
-	const initQuery = "SELECT id, beatmap_md5, userid, score, max_combo, mods, play_mode, accuracy FROM scores WHERE completed = '3'"
-	scores := []score{}
-	rows, err := db.Query(initQuery)
+// duplicatesUsersChunk is the number of user ids whose duplicates are
+// looked for by each query.
+const duplicatesUsersChunk = 1000
+
+func opFixScoreDuplicates(ctx context.Context) error {
+	cp := newCheckpointer(ctx, duplicatesQuery)
+	cursor, err := cp.resume(nil)
 	if err != nil {
-		queryError(err, initQuery)
-		return
-	}
-	for rows.Next() {
-		currentScore := score{}
-		rows.Scan(
-			&currentScore.id,
-			&currentScore.beatmapMD5,
-			&currentScore.userid,
-			&currentScore.score,
-			&currentScore.maxCombo,
-			&currentScore.mods,
-			&currentScore.playMode,
-			&currentScore.accuracy,
-		)
-		scores = append(scores, currentScore)
+		return err
 	}
 
-	verboseln("> FixScoreDuplicates: Fetched, now finding duplicates")
+	const maxQuery = "SELECT COALESCE(MAX(userid), 0) FROM scores"
+	var maxUser int64
+	if err := readDBFor(ctx).QueryRowContext(ctx, maxQuery).Scan(&maxUser); err != nil {
+		queryError(ctx, err, maxQuery)
+		return err
+	}
 
-	// duplicate removing
-	remove := []int{}
-	var ops int64
-	for i := 0; i < len(scores); i++ {
-		if contains(remove, scores[i].id) {
-			continue
+	l := logFor(ctx).with("query", duplicatesQuery)
+	job := jobLabel(jobRunFromContext(ctx))
+	var found int
+	// the users whose scores were deleted, whose pp CalculatePP recomputes
+	users := make(map[int]bool)
+	defer func() {
+		if len(users) > 0 {
+			waitOperations(ctx)
+			markPPDirty(ctx, users)
 		}
-		for j := i + 1; j < len(scores); j++ {
-			if ops%5000000 == 0 {
-				verboseln("> FixScoreDuplicates:", ops)
-			}
-			if scores[i].sameAs(scores[j]) && !contains(remove, scores[j].id) {
-				verboseln("> FixScoreDuplicates: found one!")
-				remove = append(remove, scores[j].id)
+	}()
+	for from := cursor; from < maxUser; from += duplicatesUsersChunk {
+		if err := ctx.Err(); err != nil {
+			cp.save(from, nil)
+			return err
+		}
+		logFor(ctx).with("users_after", from, "duplicates", found).debugf("processing")
+		var rows *sql.Rows
+		err := withRetry(l, job, func() error {
+			var err error
+			rows, err = readDBFor(ctx).QueryContext(ctx, duplicatesQuery, from, from+duplicatesUsersChunk)
+			return err
+		})
+		if err != nil {
+			queryError(ctx, err, duplicatesQuery)
+			cp.save(from, nil)
+			return err
+		}
+		for rows.Next() {
+			countRows(ctx, 1)
+			var id, kept int64
+			var userID int
+			if err := rows.Scan(&id, &userID, &kept); err != nil {
+				queryError(ctx, err, duplicatesQuery)
+				continue
 			}
-			ops++
+			logFor(ctx).with("score_id", id, "duplicate_of", kept).debugf("found one!")
+			opDelete(ctx, "scores", "id", id)
+			users[userID] = true
+			found++
 		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			queryError(ctx, err, duplicatesQuery)
+			cp.save(from, nil)
+			return err
+		}
+		cp.maybeSave(from+duplicatesUsersChunk, nil)
 	}
 
-	for _, v := range remove {
-		op("DELETE FROM scores WHERE id = ?", v)
-	}
-	color.Green("> FixScoreDuplicates: done!")
+	cp.clear()
+	logFor(ctx).with("duplicates", found).infof("done!")
+	return nil
 }
 
 func contains(arr []int, i int) bool {
@@ -1,13 +1,26 @@
 package main
 
 import (
+	"context"
 	"fmt"
-
-	"github.com/fatih/color"
 )
 
-func fixStatsOverflow(relax bool) {
-	defer wg.Done()
+func init() {
+	registerJob(&basicJob{
+		name:        "FixStatsOverflow",
+		description: "Re-calculates ranked score for users whose values have overflowed.",
+		enabled: func(c *config) bool {
+			if c.FixStatsOverflow && cacheDataEnabled(c) {
+				baseLog.with("job", "FixStatsOverflow").warnf("ignored because CacheData is already enabled")
+				return false
+			}
+			return c.FixStatsOverflow
+		},
+		run: opFixStatsOverflow,
+	})
+}
+
+func fixStatsOverflow(ctx context.Context, relax bool) error {
 	var table string
 	if relax {
 		table = "users_stats_relax"
@@ -19,37 +32,39 @@ func fixStatsOverflow(relax bool) {
 	ranked_score_taiko < 0 OR 
 	ranked_score_ctb < 0 OR 
 	ranked_score_mania < 0`, table)
-	rows, err := db.Query(initQuery)
+	rows, err := readDB.QueryContext(ctx, initQuery)
 	if err != nil {
-		queryError(err, initQuery)
-		return
+		queryError(ctx, err, initQuery)
+		return err
 	}
 	var scoresCount int
 	var usersCount int
 	rankedScores := make(map[int][]int)
 	for rows.Next() {
+		countRows(ctx, 1)
 		var uid int
 		err = rows.Scan(&uid)
 		if err != nil {
-			queryError(err, initQuery)
+			queryError(ctx, err, initQuery)
 			continue
 		}
 		if usersCount%1000 == 0 {
-			verboseln("> FixStatsOverflow::users:", usersCount)
+			logFor(ctx).with("users_processed", usersCount).debugf("fetching users")
 		}
 		const fetchQuery = "SELECT score, play_mode FROM scores JOIN beatmaps USING(beatmap_md5) WHERE userid = ? AND completed = 3 AND is_relax = ?"
 		var relaxV int
 		if relax {
 			relaxV = 1
 		}
-		scoreRows, err := db.Query(fetchQuery, uid, relaxV)
+		scoreRows, err := readDB.QueryContext(ctx, fetchQuery, uid, relaxV)
 		if err != nil {
-			queryError(err, fetchQuery, uid)
+			queryError(ctx, err, fetchQuery, uid)
 			continue
 		}
 		for scoreRows.Next() {
+			countRows(ctx, 1)
 			if scoresCount%1000 == 0 {
-				verboseln("> FixStatsOverflow::scores:", scoresCount)
+				logFor(ctx).with("scores_processed", scoresCount).debugf("fetching scores")
 			}
 
 			var score int
@@ -65,24 +80,30 @@ func fixStatsOverflow(relax bool) {
 			rankedScores[uid][mode] += score
 			scoresCount++
 			if rankedScores[uid][mode] < 0 {
-				verboseln("> FixStatsOverflow: overflow for user", uid, "(hax)! Breaking out of the loop.")
+				logFor(ctx).with("user_id", uid).debugf("overflow (hax)! Breaking out of the loop.")
 				rankedScores[uid] = nil
 				break
 			}
 		}
-		verboseln("> FixStatsOverflow: done", uid)
+		logFor(ctx).with("user_id", uid).debugf("done")
 		usersCount++
 	}
 	for uid, v := range rankedScores {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		if v == nil {
 			v = make([]int, 4)
 		}
-		op(fmt.Sprintf("UPDATE %s SET ranked_score_std = ?, ranked_score_taiko = ?, ranked_score_ctb = ?, ranked_score_mania = ? WHERE id = ? LIMIT 1", table), v[0], v[1], v[2], v[3], uid)
+		opUpdate(ctx, table, "id", uid, []string{"ranked_score_std", "ranked_score_taiko", "ranked_score_ctb", "ranked_score_mania"}, v[0], v[1], v[2], v[3])
 	}
-	color.Green("> FixStatsOverflow: done!")
+	logFor(ctx).infof("done!")
+	return nil
 }
 
-func opFixStatsOverflow() {
-	fixStatsOverflow(false)
-	fixStatsOverflow(true)
+func opFixStatsOverflow(ctx context.Context) error {
+	if err := fixStatsOverflow(ctx, false); err != nil {
+		return err
+	}
+	return fixStatsOverflow(ctx, true)
 }
@@ -0,0 +1,30 @@
+module github.com/osuripple/ripple-cron-go
+
+go 1.20
+
+// github.com/thehowl/conf and zxq.co/ripple/ocl have no tagged releases:
+// their pseudo-versions are added by go mod tidy.
+
+require (
+	github.com/DATA-DOG/go-sqlmock v1.5.2
+	github.com/fatih/color v1.13.0
+	github.com/go-sql-driver/mysql v1.7.1
+	github.com/jmoiron/sqlx v1.3.5
+	github.com/prometheus/client_golang v1.14.0
+	github.com/prometheus/client_model v0.3.0
+	github.com/prometheus/common v0.37.0
+	github.com/robfig/cron v1.2.0
+	gopkg.in/redis.v5 v5.2.9
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.2 // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/mattn/go-colorable v0.1.13 // indirect
+	github.com/mattn/go-isatty v0.0.20 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/procfs v0.8.0 // indirect
+	golang.org/x/sys v0.13.0 // indirect
+	google.golang.org/protobuf v1.28.1 // indirect
+)
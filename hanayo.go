@@ -1,25 +1,36 @@
 package main
 
 import (
+	"context"
 	"io/ioutil"
-	"os"
-
-	"github.com/fatih/color"
 )
 
-func opClearExpiredProfileBackgrounds() {
-	defer wg.Done()
+func init() {
+	registerJob(&basicJob{
+		name:        "ClearExpiredProfileBackgrounds",
+		description: "Removes the profile backgrounds of expired donors from the hanayo folder.",
+		enabled:     func(c *config) bool { return c.ClearExpiredProfileBackgrounds },
+		run:         opClearExpiredProfileBackgrounds,
+	})
+	registerJob(&basicJob{
+		name:        "SetOnlineUsers",
+		description: "Stores the number of registered users in redis.",
+		enabled:     func(c *config) bool { return c.SetOnlineUsers },
+		run:         opSetOnlineUsers,
+	})
+}
 
+func opClearExpiredProfileBackgrounds(ctx context.Context) error {
 	if c.HanayoFolder == "" {
-		color.Red("> ClearExpiredProfileBackgrounds: HanayoFolder is empty. ignoring")
-		return
+		logFor(ctx).errorf("HanayoFolder is empty. ignoring")
+		return nil
 	}
 
 	// get all the backgrounds
 	elementsRaw, err := ioutil.ReadDir(c.HanayoFolder + "/static/profbackgrounds")
 	if err != nil {
-		color.Red("> ClearExpiredProfileBackgrounds: failed to get profile backgrounds: %v", err)
-		return
+		logFor(ctx).errorf("failed to get profile backgrounds: %v", err)
+		return err
 	}
 
 	// convert to []string
@@ -33,18 +44,20 @@ func opClearExpiredProfileBackgrounds() {
 
 	// get profile backgrounds in db
 	const q = "SELECT uid FROM profile_backgrounds WHERE type = 1"
-	inDB, err := db.Query(q)
+	inDB, err := db.QueryContext(ctx, q)
 	if err != nil {
-		queryError(err, q)
+		queryError(ctx, err, q)
+		return err
 	}
 
 	// remove from elements every background that does actually exist in the database
 	for inDB.Next() {
+		countRows(ctx, 1)
 		var i string
 		err := inDB.Scan(&i)
 		if err != nil {
-			queryError(err, q)
-			return
+			queryError(ctx, err, q)
+			return err
 		}
 		for pos, e := range elements {
 			if e == i+".jpg" {
@@ -58,20 +71,26 @@ func opClearExpiredProfileBackgrounds() {
 
 	// remove all elements still left
 	for _, e := range elements {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		if e == "" {
 			continue
 		}
-		err := os.Remove(c.HanayoFolder + "/static/profbackgrounds/" + e)
+		err := removeFile(ctx, c.HanayoFolder+"/static/profbackgrounds/"+e)
 		if err != nil {
-			color.Red("> ClearExpiredProfileBackgrounds: failed to delete a background: %v", err)
+			logFor(ctx).errorf("failed to delete a background: %v", err)
 		}
 	}
+	return nil
 }
 
-func opSetOnlineUsers() {
-	defer wg.Done()
+func opSetOnlineUsers(ctx context.Context) error {
 	var users int
-	db.QueryRow("SELECT COUNT(*) FROM users").Scan(&users)
-	r.Set("ripple:registered_users", users, 0)
-	color.Green("> SetOnlineUsers: done!")
+	db.QueryRowContext(ctx, "SELECT COUNT(*) FROM users").Scan(&users)
+	redisWrite(ctx, func() error {
+		return r.Set("ripple:registered_users", users, 0).Err()
+	}, "SET", "ripple:registered_users", users)
+	logFor(ctx).infof("done!")
+	return nil
 }
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/jmoiron/sqlx"
+)
+
+// historyTables are created when RunHistory is enabled, if they don't exist.
+// Times are UNIX timestamps.
+var historyTables = [...]string{
+	`CREATE TABLE IF NOT EXISTS cron_runs (
+		id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+		started_at INT UNSIGNED NOT NULL,
+		ended_at INT UNSIGNED NULL,
+		status VARCHAR(32) NOT NULL,
+		host VARCHAR(255) NOT NULL,
+		PRIMARY KEY (id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS cron_job_runs (
+		id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+		run_id INT UNSIGNED NOT NULL,
+		job VARCHAR(64) NOT NULL,
+		started_at INT UNSIGNED NOT NULL,
+		ended_at INT UNSIGNED NOT NULL,
+		status VARCHAR(32) NOT NULL,
+		rows_read BIGINT UNSIGNED NOT NULL,
+		operations_queued BIGINT UNSIGNED NOT NULL,
+		operations_failed BIGINT UNSIGNED NOT NULL,
+		error_samples TEXT NOT NULL,
+		PRIMARY KEY (id),
+		KEY run_id (run_id),
+		KEY job (job, started_at)
+	)`,
+}
+
+// historyEnabled reports whether runs should be saved to the database.
+func historyEnabled() bool {
+	return c.RunHistory && !dryRun
+}
+
+func createHistoryTables() error {
+	for _, q := range historyTables {
+		if _, err := db.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var historyLog = baseLog.with("component", "History")
+
+// startRunHistory saves a new run to cron_runs, returning its ID. If the run
+// couldn't be saved, or RunHistory is disabled, 0 is returned.
+func startRunHistory() int64 {
+	if !historyEnabled() {
+		return 0
+	}
+	res, err := db.Exec("INSERT INTO cron_runs (started_at, status, host) VALUES (?, ?, ?)",
+		time.Now().Unix(), statusRunning, lockOwner())
+	if err != nil {
+		historyLog.errorf("couldn't save the run: %v", err)
+		return 0
+	}
+	id, _ := res.LastInsertId()
+	return id
+}
+
+// finishRunHistory saves the outcome of the run with the given ID, and of
+// each of its jobs. If no job was run, the run is saved as skipped.
+func finishRunHistory(runID int64, runs []*jobRun) {
+	if runID == 0 {
+		return
+	}
+	status := jobStatus("skipped")
+	for _, jr := range runs {
+		if jr == nil {
+			continue
+		}
+		if status == "skipped" {
+			status = statusFinished
+		}
+		switch {
+		case jr.status == statusFailed:
+			status = statusFailed
+		case jr.status != statusFinished && status != statusFailed:
+			status = "incomplete"
+		}
+		jr.errorsMu.Lock()
+		samples := encodeErrorSamples(jr.errorSamples)
+		jr.errorsMu.Unlock()
+		_, err := db.Exec(`INSERT INTO cron_job_runs
+			(run_id, job, started_at, ended_at, status, rows_read, operations_queued, operations_failed, error_samples)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			runID, jr.job.Name(), jr.start.Unix(), jr.end.Unix(), jr.status,
+			atomic.LoadInt64(&jr.rowsRead), atomic.LoadInt64(&jr.opsQueued),
+			atomic.LoadInt64(&jr.opsFailed), samples)
+		if err != nil {
+			jr.log.errorf("couldn't save the run to the history: %v", err)
+		}
+	}
+	_, err := db.Exec("UPDATE cron_runs SET ended_at = ?, status = ? WHERE id = ?",
+		time.Now().Unix(), status, runID)
+	if err != nil {
+		historyLog.errorf("couldn't save the run: %v", err)
+	}
+}
+
+// encodeErrorSamples encodes the error samples of a job run as a JSON array,
+// as the queries they contain may have newlines. It's empty if there are
+// none.
+func encodeErrorSamples(samples []string) string {
+	if len(samples) == 0 {
+		return ""
+	}
+	b, _ := json.Marshal(samples)
+	return string(b)
+}
+
+// decodeErrorSamples decodes the error samples saved by encodeErrorSamples.
+// The ones saved before they were encoded as JSON are separated by newlines.
+func decodeErrorSamples(s string) []string {
+	if s == "" {
+		return nil
+	}
+	var samples []string
+	if err := json.Unmarshal([]byte(s), &samples); err != nil {
+		return strings.Split(s, "\n")
+	}
+	return samples
+}
+
+type historyJobRun struct {
+	RunID            int64  `db:"run_id"`
+	Job              string `db:"job"`
+	StartedAt        int64  `db:"started_at"`
+	EndedAt          int64  `db:"ended_at"`
+	Status           string `db:"status"`
+	RowsRead         int64  `db:"rows_read"`
+	OperationsQueued int64  `db:"operations_queued"`
+	OperationsFailed int64  `db:"operations_failed"`
+	ErrorSamples     string `db:"error_samples"`
+}
+
+// cmdHistory prints the most recent runs, or the most recent runs of a job if
+// its name is given.
+func cmdHistory(args []string) int {
+	if len(args) > 1 {
+		color.Red("Usage: history [job]")
+		return exitConfig
+	}
+	if !loadConfig() {
+		return exitConfig
+	}
+	var err error
+	db, err = sqlx.Open("mysql", c.DSN)
+	if err != nil {
+		color.Red("couldn't start MySQL connection: %v.", err)
+		return exitConfig
+	}
+	defer db.Close()
+
+	const limit = 20
+	var jobRuns []historyJobRun
+	const fields = "run_id, job, started_at, ended_at, status, rows_read, operations_queued, operations_failed, error_samples"
+	if len(args) == 1 {
+		j := findJob(args[0])
+		if j == nil {
+			color.Red("There is no job named %s. Use list to see the available jobs.", args[0])
+			return exitConfig
+		}
+		err = db.Select(&jobRuns, "SELECT "+fields+" FROM cron_job_runs WHERE job = ? ORDER BY id DESC LIMIT ?", j.Name(), limit)
+	} else {
+		err = db.Select(&jobRuns, "SELECT "+fields+" FROM cron_job_runs WHERE run_id IN "+
+			"(SELECT id FROM (SELECT id FROM cron_runs ORDER BY id DESC LIMIT ?) AS r) ORDER BY run_id DESC, id", limit)
+	}
+	if err != nil {
+		color.Red("couldn't get the history: %v.", err)
+		return exitConnection
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "RUN\tJOB\tSTARTED\tDURATION\tSTATUS\tROWS READ\tOPS QUEUED\tOPS FAILED")
+	for _, jr := range jobRuns {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%d\t%d\t%d\n",
+			jr.RunID, commandName(jr.Job),
+			time.Unix(jr.StartedAt, 0).Format("2006-01-02 15:04:05"),
+			time.Duration(jr.EndedAt-jr.StartedAt)*time.Second,
+			jr.Status, jr.RowsRead, jr.OperationsQueued, jr.OperationsFailed)
+		for _, e := range decodeErrorSamples(jr.ErrorSamples) {
+			fmt.Fprintln(w, "\t\terror: "+strconv.Quote(e))
+		}
+	}
+	w.Flush()
+	return exitOK
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestErrorSamples(t *testing.T) {
+	tests := [][]string{
+		nil,
+		{"SELECT 1: error"},
+		// the queries of the jobs are often on several lines
+		{"UPDATE scores\n\t\tSET completed = '2': Error 1205", "DELETE FROM tokens: Error 2013"},
+	}
+	for _, samples := range tests {
+		s := encodeErrorSamples(samples)
+		if got := decodeErrorSamples(s); !reflect.DeepEqual(got, samples) {
+			t.Errorf("%q: decoded %q from %q", samples, got, s)
+		}
+	}
+	if got, want := decodeErrorSamples("a: error\nb: error"), []string{"a: error", "b: error"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q from the samples separated by newlines, want %q", got, want)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Job is a single task of ripple-cron-go, such as CalculatePP.
+type Job interface {
+	// Name is the name of the job, which is the same as the name of the
+	// config option enabling it, when there is one.
+	Name() string
+	Description() string
+	// Enabled reports whether the job should be run with the given config.
+	Enabled(c *config) bool
+	// Dependencies returns the names of the jobs which must be finished
+	// before this one can start.
+	Dependencies() []string
+	Run(ctx context.Context) error
+}
+
+// basicJob is a Job built out of its fields.
+type basicJob struct {
+	name        string
+	description string
+	enabled     func(c *config) bool
+	deps        []string
+	run         func(ctx context.Context) error
+}
+
+func (j *basicJob) Name() string           { return j.name }
+func (j *basicJob) Description() string    { return j.description }
+func (j *basicJob) Enabled(c *config) bool { return j.enabled(c) }
+func (j *basicJob) Dependencies() []string { return j.deps }
+
+func (j *basicJob) Run(ctx context.Context) error {
+	return j.run(ctx)
+}
+
+// jobs contains all the jobs registered through registerJob.
+var jobs []Job
+
+// registerJob adds j to the jobs ripple-cron-go can run. It is meant to be
+// called in the init function of the file implementing the job.
+func registerJob(j Job) {
+	if findJob(j.Name()) != nil {
+		panic("registerJob: job " + j.Name() + " registered twice")
+	}
+	jobs = append(jobs, j)
+}
+
+// findJob returns the job with the given name, or nil if there is none.
+// Case, dashes and underscores are ignored, so that both CalculatePP and
+// calculate-pp can be used.
+func findJob(name string) Job {
+	name = normaliseJobName(name)
+	for _, j := range jobs {
+		if normaliseJobName(j.Name()) == name {
+			return j
+		}
+	}
+	return nil
+}
+
+// parseJobOptions parses config options in the form of a semicolon-separated
+// list of Job=value, such as Schedule, returning the value for each job.
+func parseJobOptions(s string) (map[Job]string, error) {
+	opts := make(map[Job]string)
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q: expected Job=value", entry)
+		}
+		j := findJob(strings.TrimSpace(parts[0]))
+		if j == nil {
+			return nil, fmt.Errorf("%q: no such job", parts[0])
+		}
+		opts[j] = strings.TrimSpace(parts[1])
+	}
+	return opts, nil
+}
+
+func normaliseJobName(name string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", "_", "").Replace(name))
+}
+
+// commandName converts the name of a job to the form used on the command
+// line, e.g. CalculatePP to calculate-pp.
+func commandName(name string) string {
+	var b strings.Builder
+	for i, ch := range name {
+		if i > 0 && unicode.IsUpper(ch) {
+			prev := rune(name[i-1])
+			nextLower := i+1 < len(name) && unicode.IsLower(rune(name[i+1]))
+			if unicode.IsLower(prev) || (unicode.IsUpper(prev) && nextLower) {
+				b.WriteByte('-')
+			}
+		}
+		b.WriteRune(unicode.ToLower(ch))
+	}
+	return b.String()
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// redisLock is a lock held in redis, which prevents other instances of
+// ripple-cron-go from running the same job at the same time. Its TTL is
+// renewed until it is released, so that it expires if the instance holding
+// it dies.
+type redisLock struct {
+	key   string
+	token string
+	ttl   time.Duration
+	stop  chan struct{}
+	done  chan struct{}
+	log   logger
+}
+
+// errLocked is returned by acquireLock when another instance holds the lock.
+type errLocked struct {
+	holder string
+}
+
+func (e errLocked) Error() string {
+	return "lock held by " + e.holder
+}
+
+// renewScript renews the lock, only if it's still held by us.
+const renewScript = `if redis.call('get', KEYS[1]) == ARGV[1] then
+	return redis.call('pexpire', KEYS[1], ARGV[2])
+end
+return 0`
+
+// releaseScript deletes the lock, only if it's still held by us.
+const releaseScript = `if redis.call('get', KEYS[1]) == ARGV[1] then
+	return redis.call('del', KEYS[1])
+end
+return 0`
+
+func lockKey(name string) string {
+	return "ripple:cron:lock:" + commandName(name)
+}
+
+// lockOwner identifies this instance of ripple-cron-go in the locks it holds.
+func lockOwner() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
+
+// acquireLock takes the lock with the given name. If it is held by another
+// instance, acquireLock either returns errLocked or, if LockWait is set, waits
+// for it to be released. The returned context is cancelled if the lock is
+// lost while held.
+func acquireLock(ctx context.Context, name string) (*redisLock, context.Context, error) {
+	ttl, err := parseDuration(c.LockTTL)
+	if err != nil || ttl == 0 {
+		ttl = time.Minute
+	}
+	l := &redisLock{
+		key:   lockKey(name),
+		token: fmt.Sprintf("%s:%d", lockOwner(), time.Now().UnixNano()),
+		ttl:   ttl,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	l.log = logFor(ctx).with("lock", l.key)
+
+	var acquired time.Time
+	for {
+		acquired = time.Now()
+		ok, err := r.SetNX(l.key, l.token, l.ttl).Result()
+		if err != nil {
+			return nil, nil, err
+		}
+		if ok {
+			break
+		}
+		holder, _ := r.Get(l.key).Result()
+		if !c.LockWait {
+			return nil, nil, errLocked{holder}
+		}
+		l.log.debugf("waiting for the lock held by %s", holder)
+		select {
+		case <-time.After(l.ttl / 4):
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+
+	lockCtx, cancel := context.WithCancel(ctx)
+	go l.renew(cancel, acquired)
+	return l, lockCtx, nil
+}
+
+// renew renews the lock until it's released, or lost. last is when it was
+// acquired: if it couldn't be renewed for ttl since then, it may have
+// expired and been taken by another instance, so it's considered lost.
+func (l *redisLock) renew(cancel context.CancelFunc, last time.Time) {
+	defer close(l.done)
+	defer cancel()
+	t := time.NewTicker(l.ttl / 3)
+	defer t.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-t.C:
+		}
+		start := time.Now()
+		res, err := r.Eval(renewScript, []string{l.key}, l.token, int64(l.ttl/time.Millisecond)).Result()
+		if err != nil {
+			if time.Since(last) >= l.ttl {
+				l.log.errorf("couldn't renew the lock for %s, stopping as it may have expired: %v", l.ttl, err)
+				return
+			}
+			l.log.errorf("couldn't renew the lock: %v", err)
+			continue
+		}
+		last = start
+		if n, _ := res.(int64); n == 0 {
+			l.log.errorf("lost the lock, stopping")
+			return
+		}
+	}
+}
+
+// release stops renewing the lock and deletes it.
+func (l *redisLock) release() {
+	close(l.stop)
+	<-l.done
+	err := r.Eval(releaseScript, []string{l.key}, l.token).Err()
+	if err != nil {
+		l.log.errorf("couldn't release the lock: %v", err)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gopkg.in/redis.v5"
+)
+
+func TestLockRenewFailing(t *testing.T) {
+	oldR := r
+	defer func() { r = oldR }()
+	// nothing listens on port 1: every renewal fails
+	r = redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", DialTimeout: 10 * time.Millisecond, MaxRetries: 0})
+	defer r.Close()
+
+	l := &redisLock{key: lockKey("test"), token: "token", ttl: 60 * time.Millisecond,
+		stop: make(chan struct{}), done: make(chan struct{}), log: baseLog}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	start := time.Now()
+	go l.renew(cancel, start)
+	select {
+	case <-ctx.Done():
+		if d := time.Since(start); d < l.ttl {
+			t.Errorf("the lock was considered lost after %s, before its TTL of %s", d, l.ttl)
+		}
+	case <-time.After(time.Second):
+		close(l.stop)
+		t.Fatal("the lock wasn't considered lost while it couldn't be renewed")
+	}
+	<-l.done
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// logLevel is the severity of a log message.
+type logLevel int
+
+const (
+	// levelTrace is used for every query executed (-vv).
+	levelTrace logLevel = iota
+	// levelDebug is used for the progress of the jobs (-v).
+	levelDebug
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = [...]string{"trace", "debug", "info", "warn", "error"}
+
+func (l logLevel) String() string {
+	return levelNames[l]
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	if s == "" {
+		return levelInfo, nil
+	}
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return logLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown level %q, must be one of %s", s, strings.Join(levelNames[:], ", "))
+}
+
+// logFormats are the possible values of LogFormat. text is the colored output
+// meant for terminals.
+var logFormats = [...]string{"text", "json", "logfmt"}
+
+func checkLogFormat(s string) error {
+	if s == "" {
+		return nil
+	}
+	for _, f := range logFormats {
+		if s == f {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown format %q, must be one of %s", s, strings.Join(logFormats[:], ", "))
+}
+
+// logOutput is where, and how, the log messages are written. It's set up by
+// setupLogging once the config has been loaded; until then, messages are
+// written as text at info level.
+var logOutput = struct {
+	sync.Mutex
+	w      io.Writer
+	format string
+	level  logLevel
+}{w: os.Stdout, format: "text", level: levelInfo}
+
+// setupLogging applies the LogFormat and LogLevel options of cfg. -v and -vv
+// lower the level to debug and trace respectively.
+func setupLogging(cfg *config) error {
+	if err := checkLogFormat(cfg.LogFormat); err != nil {
+		return err
+	}
+	level, err := parseLogLevel(cfg.LogLevel)
+	if err != nil {
+		return err
+	}
+	if v && level > levelDebug {
+		level = levelDebug
+	}
+	if vv {
+		level = levelTrace
+	}
+	logOutput.Lock()
+	defer logOutput.Unlock()
+	if cfg.LogFormat != "" {
+		logOutput.format = cfg.LogFormat
+	}
+	logOutput.level = level
+	return nil
+}
+
+// logEnabled reports whether messages of the given level are written.
+func logEnabled(level logLevel) bool {
+	logOutput.Lock()
+	defer logOutput.Unlock()
+	return level >= logOutput.level
+}
+
+// logger writes log messages along with its fields, which are key/value
+// pairs. Its zero value has no fields.
+type logger struct {
+	fields []interface{}
+}
+
+// baseLog is the logger used for messages which are not about a job.
+var baseLog logger
+
+// with returns a copy of l with the given key/value pairs added to its fields.
+func (l logger) with(kv ...interface{}) logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return logger{fields}
+}
+
+// logFor returns a logger with the run ID and the job stored in ctx, if any.
+func logFor(ctx context.Context) logger {
+	l := baseLog
+	if id := runIDFromContext(ctx); id != "" {
+		l = l.with("run_id", id)
+	}
+	if jr := jobRunFromContext(ctx); jr != nil {
+		l = l.with("job", jr.job.Name())
+	}
+	return l
+}
+
+func (l logger) tracef(format string, args ...interface{}) { l.log(levelTrace, format, args...) }
+func (l logger) debugf(format string, args ...interface{}) { l.log(levelDebug, format, args...) }
+func (l logger) infof(format string, args ...interface{})  { l.log(levelInfo, format, args...) }
+func (l logger) warnf(format string, args ...interface{})  { l.log(levelWarn, format, args...) }
+func (l logger) errorf(format string, args ...interface{}) { l.log(levelError, format, args...) }
+
+func (l logger) log(level logLevel, format string, args ...interface{}) {
+	logOutput.Lock()
+	defer logOutput.Unlock()
+	if level < logOutput.level {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	switch logOutput.format {
+	case "json":
+		writeJSON(logOutput.w, level, msg, l.fields)
+	case "logfmt":
+		writeLogfmt(logOutput.w, level, msg, l.fields)
+	default:
+		writeText(logOutput.w, level, msg, l.fields)
+	}
+}
+
+// writeText writes the message as "> Job: message key=value", colored by
+// level. The run ID is left out.
+func writeText(w io.Writer, level logLevel, msg string, fields []interface{}) {
+	var prefix string
+	var b strings.Builder
+	for i := 0; i+1 < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		switch key {
+		case "run_id":
+			continue
+		case "job", "component":
+			if prefix == "" {
+				prefix = "> " + fmt.Sprint(fields[i+1]) + ": "
+			}
+			continue
+		}
+		b.WriteString(" " + key + "=" + logfmtValue(fields[i+1]))
+	}
+	line := prefix + msg + b.String()
+	switch level {
+	case levelInfo:
+		color.New(color.FgGreen).Fprintln(w, line)
+	case levelWarn:
+		color.New(color.FgYellow).Fprintln(w, line)
+	case levelError:
+		color.New(color.FgRed).Fprintln(w, line)
+	default:
+		fmt.Fprintln(w, line)
+	}
+}
+
+func writeJSON(w io.Writer, level logLevel, msg string, fields []interface{}) {
+	var b bytes.Buffer
+	b.WriteString(`{"time":`)
+	writeJSONValue(&b, time.Now().Format(time.RFC3339Nano))
+	b.WriteString(`,"level":`)
+	writeJSONValue(&b, level.String())
+	b.WriteString(`,"msg":`)
+	writeJSONValue(&b, msg)
+	for i := 0; i+1 < len(fields); i += 2 {
+		b.WriteByte(',')
+		writeJSONValue(&b, fmt.Sprint(fields[i]))
+		b.WriteByte(':')
+		writeJSONValue(&b, fieldValue(fields[i+1]))
+	}
+	b.WriteString("}\n")
+	w.Write(b.Bytes())
+}
+
+func writeJSONValue(b *bytes.Buffer, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.Write(data)
+}
+
+func writeLogfmt(w io.Writer, level logLevel, msg string, fields []interface{}) {
+	var b strings.Builder
+	b.WriteString("time=" + time.Now().Format(time.RFC3339Nano))
+	b.WriteString(" level=" + level.String())
+	b.WriteString(" msg=" + logfmtValue(msg))
+	for i := 0; i+1 < len(fields); i += 2 {
+		b.WriteString(" " + fmt.Sprint(fields[i]) + "=" + logfmtValue(fields[i+1]))
+	}
+	b.WriteString("\n")
+	io.WriteString(w, b.String())
+}
+
+// fieldValue converts the values which wouldn't be encoded as expected to
+// JSON, such as errors and durations, to strings.
+func fieldValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func logfmtValue(v interface{}) string {
+	s := fmt.Sprint(fieldValue(v))
+	if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+type runIDKey struct{}
+
+// withRunID returns a copy of ctx carrying the ID of the run, which is logged
+// along with every message about it.
+func withRunID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, runIDKey{}, id)
+}
+
+// runIDFromContext returns the ID of the run stored in ctx, or an empty string
+// if there is none.
+func runIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(runIDKey{}).(string)
+	return id
+}
+
+// newRunID returns the ID of a new run: its ID in cron_runs if it has one,
+// or else a unique ID based on the current time.
+func newRunID(historyID int64) string {
+	if historyID != 0 {
+		return strconv.FormatInt(historyID, 10)
+	}
+	return strconv.FormatInt(time.Now().UnixNano(), 36)
+}
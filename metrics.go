@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// metricsRegistry holds the metrics of ripple-cron-go. It is served on
+// /metrics in daemon mode, and pushed to PushgatewayURL at the end of a
+// one-shot run. The jobs are in the cron_job label, as the pushgateway uses
+// job for the name of the pusher.
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	jobRunsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ripple_cron_job_runs_total",
+		Help: "Number of runs of each job, by status.",
+	}, []string{"cron_job", "status"})
+	jobDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ripple_cron_job_duration_seconds",
+		Help:    "How long each job took, including the execution of the queries it queued.",
+		Buckets: []float64{1, 5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600, 7200},
+	}, []string{"cron_job", "status"})
+	jobLastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ripple_cron_job_last_success_timestamp_seconds",
+		Help: "When each job last finished successfully, as a UNIX timestamp.",
+	}, []string{"cron_job"})
+	rowsProcessedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ripple_cron_rows_processed_total",
+		Help: "Number of rows read from the database by each job.",
+	}, []string{"cron_job"})
+	operationsExecutedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ripple_cron_operations_executed_total",
+		Help: "Number of queued queries executed for each job.",
+	}, []string{"cron_job"})
+	queryErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ripple_cron_query_errors_total",
+		Help: "Number of failed queries of each job.",
+	}, []string{"cron_job"})
+	queryRetriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ripple_cron_query_retries_total",
+		Help: "Number of queries of each job retried after a transient error.",
+	}, []string{"cron_job"})
+	filesDeletedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ripple_cron_files_deleted_total",
+		Help: "Number of files deleted by each job, such as the replays deleted by CleanReplays.",
+	}, []string{"cron_job"})
+	writesPaused = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ripple_cron_writes_paused",
+		Help: "1 while the writes are paused because MySQL is under load, 0 otherwise.",
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		jobRunsTotal, jobDuration, jobLastSuccess, rowsProcessedTotal,
+		operationsExecutedTotal, queryErrorsTotal, queryRetriesTotal, filesDeletedTotal, writesPaused,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "ripple_cron_operations_queued",
+			Help:        "Number of queries waiting to be executed.",
+			ConstLabels: prometheus.Labels{"queue": "exec"},
+		}, func() float64 { return float64(len(execOperations)) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "ripple_cron_operations_queued",
+			Help:        "Number of queries waiting to be executed.",
+			ConstLabels: prometheus.Labels{"queue": "sync"},
+		}, func() float64 { return float64(len(syncOperations)) }),
+	)
+}
+
+// jobLabel returns the name of the job of jr, which may be nil, to be used as
+// the cron_job label of a metric.
+func jobLabel(jr *jobRun) string {
+	if jr == nil {
+		return "(none)"
+	}
+	return jr.job.Name()
+}
+
+// observeRun records the outcome of jr in the metrics.
+func observeRun(jr *jobRun) {
+	name := jr.job.Name()
+	jobRunsTotal.WithLabelValues(name, string(jr.status)).Inc()
+	if jr.status == statusNotStarted || jr.status == statusLocked {
+		return
+	}
+	jobDuration.WithLabelValues(name, string(jr.status)).Observe(jr.end.Sub(jr.start).Seconds())
+	if jr.status == statusFinished {
+		jobLastSuccess.WithLabelValues(name).Set(float64(jr.end.Unix()))
+	}
+}
+
+// serveMetrics serves the metrics on MetricsAddr until ctx is done.
+func serveMetrics(ctx context.Context) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	srv := &http.Server{Addr: c.MetricsAddr, Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	baseLog.infof("serving metrics on %s/metrics", c.MetricsAddr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		baseLog.errorf("couldn't serve metrics: %v", err)
+	}
+}
+
+// pushMetrics pushes the metrics to PushgatewayURL, replacing the ones pushed
+// by the previous run.
+func pushMetrics() {
+	job := c.PushgatewayJob
+	if job == "" {
+		job = "ripple_cron"
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	err = push.New(c.PushgatewayURL, job).
+		Gatherer(metricsRegistry).
+		Grouping("instance", host).
+		Push()
+	if err != nil {
+		baseLog.errorf("couldn't push metrics to %s: %v", c.PushgatewayURL, err)
+		return
+	}
+	baseLog.debugf("pushed metrics to %s", c.PushgatewayURL)
+}
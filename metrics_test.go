@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestPushMetrics(t *testing.T) {
+	type request struct {
+		method, path string
+		families     map[string]*dto.MetricFamily
+	}
+	requests := make(chan request, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := request{method: r.Method, path: r.URL.Path, families: make(map[string]*dto.MetricFamily)}
+		dec := expfmt.NewDecoder(r.Body, expfmt.ResponseFormat(r.Header))
+		for {
+			mf := &dto.MetricFamily{}
+			if err := dec.Decode(mf); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Error(err)
+				break
+			}
+			req.families[mf.GetName()] = mf
+		}
+		requests <- req
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	oldC := c
+	defer func() { c = oldC }()
+	c.PushgatewayURL = srv.URL
+	c.PushgatewayJob = "ripple_cron_test"
+	now := time.Now()
+	observeRun(&jobRun{job: &basicJob{name: "TestPushMetrics"}, status: statusFinished, start: now.Add(-time.Second), end: now})
+	pushMetrics()
+
+	var req request
+	select {
+	case req = <-requests:
+	default:
+		t.Fatal("nothing was pushed")
+	}
+	host, _ := os.Hostname()
+	// Push replaces the metrics of the group
+	if req.method != http.MethodPut {
+		t.Errorf("got method %s, want PUT", req.method)
+	}
+	if want := "/metrics/job/ripple_cron_test/instance/" + host; req.path != want {
+		t.Errorf("got path %s, want %s", req.path, want)
+	}
+	for _, name := range []string{
+		"ripple_cron_job_runs_total", "ripple_cron_job_duration_seconds",
+		"ripple_cron_job_last_success_timestamp_seconds", "ripple_cron_operations_queued",
+		"ripple_cron_writes_paused",
+	} {
+		if req.families[name] == nil {
+			t.Errorf("%s wasn't pushed", name)
+		}
+	}
+	runs := req.families["ripple_cron_job_runs_total"]
+	if runs == nil {
+		return
+	}
+	found := false
+	for _, m := range runs.GetMetric() {
+		labels := make(map[string]string)
+		for _, l := range m.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		if _, ok := labels["job"]; ok {
+			t.Errorf("the job label is set on %v, it must be left to the pushgateway", labels)
+		}
+		if labels["cron_job"] == "TestPushMetrics" && labels["status"] == string(statusFinished) {
+			found = true
+			if m.GetCounter().GetValue() != 1 {
+				t.Errorf("got %v runs, want 1", m.GetCounter().GetValue())
+			}
+		}
+	}
+	if !found {
+		t.Error("the run of TestPushMetrics wasn't pushed with its cron_job and status labels")
+	}
+}
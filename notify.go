@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// webhook is a target of the Webhooks config option.
+type webhook struct {
+	// format is discord, slack or json.
+	format string
+	url    string
+}
+
+var webhookFormats = [...]string{"discord", "slack", "json"}
+
+var notifyLog = baseLog.with("component", "Notify")
+
+// parseWebhooks parses the Webhooks config option, a semicolon-separated list
+// of format=url.
+func parseWebhooks(s string) ([]webhook, error) {
+	var hooks []webhook
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q: expected format=url", entry)
+		}
+		h := webhook{
+			format: strings.ToLower(strings.TrimSpace(parts[0])),
+			url:    strings.TrimSpace(parts[1]),
+		}
+		known := false
+		for _, f := range webhookFormats {
+			known = known || h.format == f
+		}
+		if !known {
+			return nil, fmt.Errorf("%q: unknown format %q, must be one of %s",
+				entry, h.format, strings.Join(webhookFormats[:], ", "))
+		}
+		hooks = append(hooks, h)
+	}
+	return hooks, nil
+}
+
+func checkNotifyOn(s string) error {
+	switch s {
+	case "", "always", "failure":
+		return nil
+	}
+	return fmt.Errorf("unknown value %q, must be always or failure", s)
+}
+
+// webhooks is the parsed Webhooks config option.
+var webhooks []webhook
+
+// runSummary is the summary of a run sent to the webhooks, which is also the
+// payload of the json format.
+type runSummary struct {
+	RunID  string          `json:"run_id"`
+	Host   string          `json:"host"`
+	Failed bool            `json:"failed"`
+	Jobs   []jobRunSummary `json:"jobs"`
+	Time   time.Time       `json:"time"`
+}
+
+type jobRunSummary struct {
+	Job                string    `json:"job"`
+	Status             jobStatus `json:"status"`
+	DurationSeconds    float64   `json:"duration_seconds"`
+	RowsRead           int64     `json:"rows_read"`
+	RowsAffected       int64     `json:"rows_affected"`
+	OperationsExecuted int64     `json:"operations_executed"`
+	OperationsFailed   int64     `json:"operations_failed"`
+	QueryErrors        int64     `json:"query_errors"`
+	Error              string    `json:"error,omitempty"`
+	ErrorSamples       []string  `json:"error_samples,omitempty"`
+}
+
+func summariseRun(runID string, runs []*jobRun) runSummary {
+	s := runSummary{RunID: runID, Host: lockOwner(), Time: time.Now()}
+	for _, jr := range runs {
+		if jr == nil {
+			continue
+		}
+		js := jobRunSummary{
+			Job:                jr.job.Name(),
+			Status:             jr.status,
+			DurationSeconds:    jr.end.Sub(jr.start).Seconds(),
+			RowsRead:           atomic.LoadInt64(&jr.rowsRead),
+			RowsAffected:       atomic.LoadInt64(&jr.rowsAffected),
+			OperationsExecuted: atomic.LoadInt64(&jr.opsExecuted),
+			OperationsFailed:   atomic.LoadInt64(&jr.opsFailed),
+			QueryErrors:        atomic.LoadInt64(&jr.errors),
+		}
+		if jr.err != nil {
+			js.Error = jr.err.Error()
+		}
+		jr.errorsMu.Lock()
+		js.ErrorSamples = append([]string(nil), jr.errorSamples...)
+		jr.errorsMu.Unlock()
+		switch jr.status {
+		case statusFinished, statusLocked:
+		default:
+			s.Failed = true
+		}
+		s.Jobs = append(s.Jobs, js)
+	}
+	return s
+}
+
+func (s runSummary) title() string {
+	if s.Failed {
+		return fmt.Sprintf("ripple-cron-go: run %s on %s failed", s.RunID, s.Host)
+	}
+	return fmt.Sprintf("ripple-cron-go: run %s on %s finished", s.RunID, s.Host)
+}
+
+// text describes the outcome of a job in a few lines, for discord and slack.
+func (js jobRunSummary) text() string {
+	text := fmt.Sprintf("%s in %s\nrows read: %d, rows affected: %d\nqueries executed: %d, failed: %d",
+		js.Status, time.Duration(js.DurationSeconds*float64(time.Second)).Round(time.Millisecond),
+		js.RowsRead, js.RowsAffected, js.OperationsExecuted, js.QueryErrors)
+	if js.Error != "" {
+		text += "\nerror: " + js.Error
+	}
+	return text
+}
+
+// discordMaxFields is the number of fields a discord embed can have.
+const discordMaxFields = 25
+
+// discordMaxValue and slackMaxValue are the number of characters of the value
+// of a field, above which discord rejects the embed, and slack cuts it.
+const (
+	discordMaxValue = 1024
+	slackMaxValue   = 3000
+)
+
+// truncate cuts s to n characters, ending it with an ellipsis if it was
+// longer.
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n-1]) + "…"
+}
+
+func discordPayload(s runSummary) interface{} {
+	type field struct {
+		Name   string `json:"name"`
+		Value  string `json:"value"`
+		Inline bool   `json:"inline"`
+	}
+	color := 0x2ecc71
+	if s.Failed {
+		color = 0xe74c3c
+	}
+	fields := make([]field, 0, len(s.Jobs))
+	for i, js := range s.Jobs {
+		if i == discordMaxFields {
+			break
+		}
+		fields = append(fields, field{Name: js.Job, Value: truncate(js.text(), discordMaxValue)})
+	}
+	return map[string]interface{}{
+		"username": "ripple-cron-go",
+		"embeds": []interface{}{map[string]interface{}{
+			"title":     s.title(),
+			"color":     color,
+			"fields":    fields,
+			"timestamp": s.Time.Format(time.RFC3339),
+		}},
+	}
+}
+
+func slackPayload(s runSummary) interface{} {
+	type field struct {
+		Title string `json:"title"`
+		Value string `json:"value"`
+		Short bool   `json:"short"`
+	}
+	color := "good"
+	if s.Failed {
+		color = "danger"
+	}
+	fields := make([]field, 0, len(s.Jobs))
+	for _, js := range s.Jobs {
+		fields = append(fields, field{Title: js.Job, Value: truncate(js.text(), slackMaxValue)})
+	}
+	return map[string]interface{}{
+		"text": s.title(),
+		"attachments": []interface{}{map[string]interface{}{
+			"color":  color,
+			"fields": fields,
+			"ts":     s.Time.Unix(),
+		}},
+	}
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// notifyRun sends the summary of runs to every webhook, unless NotifyOn is
+// failure and none of the jobs failed.
+func notifyRun(ctx context.Context, runs []*jobRun) {
+	if len(webhooks) == 0 {
+		return
+	}
+	s := summariseRun(runIDFromContext(ctx), runs)
+	if len(s.Jobs) == 0 || (c.NotifyOn == "failure" && !s.Failed) {
+		return
+	}
+	if dryRun {
+		notifyLog.infof("[dry-run] would notify %d webhooks", len(webhooks))
+		return
+	}
+	for _, h := range webhooks {
+		var payload interface{}
+		switch h.format {
+		case "discord":
+			payload = discordPayload(s)
+		case "slack":
+			payload = slackPayload(s)
+		default:
+			payload = s
+		}
+		if err := postWebhook(h.url, payload); err != nil {
+			notifyLog.with("format", h.format).errorf("couldn't send the notification: %v", err)
+		}
+	}
+}
+
+func postWebhook(target string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := webhookClient.Post(target, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// don't log the URL, which often contains a token
+		if uerr, ok := err.(*url.Error); ok {
+			return uerr.Err
+		}
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"abc", 3, "abc"},
+		{"abcd", 3, "ab…"},
+		{"ééé", 3, "ééé"},
+		{"éééé", 3, "éé…"},
+	}
+	for _, test := range tests {
+		if got := truncate(test.s, test.n); got != test.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", test.s, test.n, got, test.want)
+		}
+	}
+}
+
+// TestPayloadsTruncated checks that a long error doesn't make the values of
+// the fields longer than discord and slack allow.
+func TestPayloadsTruncated(t *testing.T) {
+	s := runSummary{RunID: "1", Host: "host", Failed: true, Jobs: []jobRunSummary{
+		{Job: "CalculatePP", Status: statusFailed, Error: strings.Repeat("é", 5000)},
+	}}
+	tests := []struct {
+		name    string
+		payload interface{}
+		key     string
+		max     int
+	}{
+		{"discord", discordPayload(s), "embeds", discordMaxValue},
+		{"slack", slackPayload(s), "attachments", slackMaxValue},
+	}
+	for _, test := range tests {
+		data, err := json.Marshal(test.payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var payload map[string]json.RawMessage
+		var embeds []struct {
+			Fields []struct {
+				Value string `json:"value"`
+			} `json:"fields"`
+		}
+		if err := json.Unmarshal(data, &payload); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(payload[test.key], &embeds); err != nil {
+			t.Fatal(err)
+		}
+		value := embeds[0].Fields[0].Value
+		if n := utf8.RuneCountInString(value); n != test.max || !strings.HasSuffix(value, "…") {
+			t.Errorf("%s: got a value of %d characters ending with %q, want %d ending with an ellipsis",
+				test.name, n, value[len(value)-6:], test.max)
+		}
+	}
+}
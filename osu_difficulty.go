@@ -0,0 +1,341 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// The mods of the scores which change their pp.
+const (
+	modNoFail     = 1
+	modEasy       = 2
+	modHidden     = 8
+	modHardRock   = 16
+	modDoubleTime = 64
+	modHalfTime   = 256
+	modNightcore  = 512
+	modFlashlight = 1024
+	modSpunOut    = 4096
+)
+
+// modsDifficulty is the part of the mods which changes the difficulty of a
+// beatmap, and not only the pp of the scores.
+const modsDifficulty = modEasy | modHardRock | modDoubleTime | modHalfTime | modNightcore
+
+// speedMultiplier returns how much faster the beatmap is played with mods.
+func speedMultiplier(mods int) float64 {
+	switch {
+	case mods&(modDoubleTime|modNightcore) != 0:
+		return 1.5
+	case mods&modHalfTime != 0:
+		return 0.75
+	}
+	return 1
+}
+
+// mapStats are the difficulty settings of a beatmap, once the mods are
+// applied.
+type mapStats struct {
+	cs, od, ar, hp float64
+	speed          float64
+}
+
+// applyMods returns the settings of b played with mods.
+func (b *osuBeatmap) applyMods(mods int) mapStats {
+	s := mapStats{cs: b.cs, od: b.od, ar: b.ar, hp: b.hp, speed: speedMultiplier(mods)}
+	multiplier := 1.0
+	if mods&modHardRock != 0 {
+		multiplier = 1.4
+		s.cs = math.Min(s.cs*1.3, 10)
+	}
+	if mods&modEasy != 0 {
+		multiplier = 0.5
+		s.cs *= 0.5
+	}
+	s.od = math.Min(s.od*multiplier, 10)
+	s.ar = math.Min(s.ar*multiplier, 10)
+	s.hp = math.Min(s.hp*multiplier, 10)
+
+	// the speed changes the approach time and the hit windows, which give
+	// the AR and the OD
+	arMS := 1200 - 150*(s.ar-5)
+	if s.ar < 5 {
+		arMS = 1800 - 120*s.ar
+	}
+	arMS /= s.speed
+	if arMS > 1200 {
+		s.ar = (1800 - arMS) / 120
+	} else {
+		s.ar = 5 + (1200-arMS)/150
+	}
+	odMS := (80 - 6*s.od) / s.speed
+	s.od = (80 - odMS) / 6
+	return s
+}
+
+// beatmapDifficulty is the difficulty of a beatmap with some mods.
+type beatmapDifficulty struct {
+	stats mapStats
+	stars float64
+	// aim and speed are the star rating of the aim and speed skills, in std.
+	aim, speed float64
+}
+
+// The strains are computed over sections of strainStep ms, and the strain
+// of each section is weighted by decayWeight^n, n being its rank.
+const (
+	strainStep  = 400
+	decayWeight = 0.9
+)
+
+// weightedStrains returns the difficulty given by the highest strain of each
+// section of the beatmap. strains[i] is the strain at the time of objects[i],
+// which decays with decay, the part remaining after one second.
+func weightedStrains(objects []osuHitObject, strains []float64, decay, speed float64) float64 {
+	step := strainStep * speed
+	intervalEnd := math.Ceil(objects[0].time/step) * step
+	var highest []float64
+	var max float64
+	for i, o := range objects {
+		for o.time > intervalEnd {
+			highest = append(highest, max)
+			if i > 0 {
+				max = strains[i-1] * math.Pow(decay, (intervalEnd-objects[i-1].time)/speed/1000)
+			} else {
+				max = 0
+			}
+			intervalEnd += step
+		}
+		max = math.Max(max, strains[i])
+	}
+	highest = append(highest, max)
+
+	sort.Sort(sort.Reverse(sort.Float64Slice(highest)))
+	var difficulty, weight float64 = 0, 1
+	for _, strain := range highest {
+		difficulty += strain * weight
+		weight *= decayWeight
+	}
+	return difficulty
+}
+
+// The constants of the std difficulty.
+const (
+	stdStarScaling        = 0.0675
+	stdExtremeScaling     = 0.5
+	stdSingleSpacing      = 125
+	stdMinSpeedBonus      = 75
+	stdMaxSpeedBonus      = 45
+	stdAngleBonusScale    = 90
+	stdAimTimingThreshold = 107
+	stdSpeedAngleBegin    = 5 * math.Pi / 6
+	stdAimAngleBegin      = math.Pi / 3
+)
+
+// stdDifficulty computes the aim and speed difficulty of a std beatmap.
+func stdDifficulty(b *osuBeatmap, mods int) beatmapDifficulty {
+	d := beatmapDifficulty{stats: b.applyMods(mods)}
+
+	// the positions are scaled so that the circles have a radius of 52
+	radius := 32 * (1 - 0.7*(d.stats.cs-5)/5)
+	scale := 52 / radius
+	if radius < 30 {
+		scale *= 1 + math.Min(30-radius, 5)/50
+	}
+
+	objects := b.stackedObjects(mods)
+	n := len(objects)
+	aimStrains := make([]float64, n)
+	speedStrains := make([]float64, n)
+	var prevDistance, prevDelta float64
+	for i := 1; i < n; i++ {
+		o, prev := objects[i], objects[i-1]
+		delta := (o.time - prev.time) / d.stats.speed
+		var distance float64
+		angle := math.NaN()
+		if !o.is(objSpinner) && !prev.is(objSpinner) {
+			distance = o.pos.mul(scale).dist(prev.end.mul(scale))
+			if i > 1 && !objects[i-2].is(objSpinner) {
+				v1 := objects[i-2].end.sub(prev.pos)
+				v2 := o.pos.sub(prev.end)
+				angle = math.Abs(math.Atan2(v1.cross(v2), v1.dot(v2)))
+			}
+		}
+		var aim, speed float64
+		if !o.is(objSpinner) {
+			aim = stdAimValue(distance, delta, prevDistance, prevDelta, angle)
+			speed = stdSpeedValue(distance, delta, angle)
+		}
+		elapsed := delta / 1000
+		aimStrains[i] = aimStrains[i-1]*math.Pow(0.15, elapsed) + aim*26.25
+		speedStrains[i] = speedStrains[i-1]*math.Pow(0.3, elapsed) + speed*1400
+		prevDistance, prevDelta = distance, delta
+	}
+
+	d.aim = math.Sqrt(weightedStrains(objects, aimStrains, 0.15, d.stats.speed)) * stdStarScaling
+	d.speed = math.Sqrt(weightedStrains(objects, speedStrains, 0.3, d.stats.speed)) * stdStarScaling
+	d.stars = d.aim + d.speed + math.Abs(d.speed-d.aim)*stdExtremeScaling
+	return d
+}
+
+func stdSpeedValue(distance, delta, angle float64) float64 {
+	strainTime := math.Max(delta, 50)
+	distance = math.Min(distance, stdSingleSpacing)
+	delta = math.Max(delta, stdMaxSpeedBonus)
+	speedBonus := 1.0
+	if delta < stdMinSpeedBonus {
+		speedBonus += math.Pow((stdMinSpeedBonus-delta)/40, 2)
+	}
+	angleBonus := 1.0
+	if !math.IsNaN(angle) && angle < stdSpeedAngleBegin {
+		s := math.Sin(1.5 * (stdSpeedAngleBegin - angle))
+		angleBonus += s * s / 3.57
+		if angle < math.Pi/2 {
+			angleBonus = 1.28
+			if distance < stdAngleBonusScale {
+				f := math.Min((stdAngleBonusScale-distance)/10, 1)
+				if angle >= math.Pi/4 {
+					f *= math.Sin((math.Pi/2 - angle) * 4 / math.Pi)
+				}
+				angleBonus += (1 - angleBonus) * f
+			}
+		}
+	}
+	return (1 + (speedBonus-1)*0.75) * angleBonus *
+		(0.95 + speedBonus*math.Pow(distance/stdSingleSpacing, 3.5)) / strainTime
+}
+
+func stdAimValue(distance, delta, prevDistance, prevDelta, angle float64) float64 {
+	strainTime := math.Max(delta, 50)
+	prevStrainTime := math.Max(prevDelta, 50)
+	var result float64
+	if !math.IsNaN(angle) && angle > stdAimAngleBegin {
+		s := math.Sin(angle - stdAimAngleBegin)
+		angleBonus := math.Sqrt(math.Max(prevDistance-stdAngleBonusScale, 0) * s * s *
+			math.Max(distance-stdAngleBonusScale, 0))
+		result = 1.5 * math.Pow(angleBonus, 0.99) / math.Max(stdAimTimingThreshold, prevStrainTime)
+	}
+	weightedDistance := math.Pow(distance, 0.99)
+	return math.Max(result+weightedDistance/math.Max(stdAimTimingThreshold, strainTime),
+		weightedDistance/strainTime)
+}
+
+// taikoDifficulty computes the difficulty of a taiko beatmap, or of a std
+// beatmap converted to taiko. Only the notes (the circles) give strain: the
+// drum rolls and the spinners don't.
+func taikoDifficulty(b *osuBeatmap, mods int) beatmapDifficulty {
+	d := beatmapDifficulty{stats: b.applyMods(mods)}
+	const (
+		colourChangeBonus = 0.75
+		rhythmChangeBonus = 1
+	)
+
+	var notes []osuHitObject
+	for _, o := range b.objects {
+		if o.is(objCircle) {
+			notes = append(notes, o)
+		}
+	}
+	if len(notes) < 2 {
+		return d
+	}
+	strains := make([]float64, len(notes))
+	strains[0] = 1
+	var (
+		// sameColour is the number of notes of the same colour in a row
+		sameColour int
+		// lastSwitchEven is whether the previous series of notes of the
+		// same colour had an even length
+		lastSwitchEven = -1
+		prevDelta      float64
+	)
+	isKat := func(o osuHitObject) bool { return o.hitSound&(soundWhistle|soundClap) != 0 }
+	for i := 1; i < len(notes); i++ {
+		o, prev := notes[i], notes[i-1]
+		delta := (o.time - prev.time) / d.stats.speed
+		addition := 1.0
+		if delta < 1000 {
+			if isKat(o) != isKat(prev) {
+				even := sameColour % 2
+				if lastSwitchEven >= 0 && even != lastSwitchEven {
+					addition += colourChangeBonus
+				}
+				lastSwitchEven = even
+				sameColour = 0
+			}
+			sameColour++
+			// a change of rhythm, more than a 10% difference between
+			// the intervals
+			if prevDelta > 0 && delta > 0 {
+				ratio := delta / prevDelta
+				if ratio > 1.1 || ratio < 1/1.1 {
+					addition += rhythmChangeBonus
+				}
+			}
+		}
+		additionFactor := 1.0
+		if delta < 50 {
+			additionFactor = 0.4 + 0.6*delta/50
+		}
+		strains[i] = strains[i-1]*math.Pow(0.3, delta/1000) + addition*additionFactor
+		prevDelta = delta
+	}
+	d.stars = weightedStrains(notes, strains, 0.3, d.stats.speed) * 0.04125
+	return d
+}
+
+// maniaDifficulty computes the difficulty of a mania beatmap, whose number
+// of keys is its circle size.
+func maniaDifficulty(b *osuBeatmap, mods int) beatmapDifficulty {
+	d := beatmapDifficulty{stats: b.applyMods(mods)}
+	// the circle size is the number of keys, it isn't changed by the mods
+	keys := int(math.Round(b.cs))
+	if keys < 1 {
+		keys = 1
+	}
+	const (
+		individualDecay = 0.125
+		overallDecay    = 0.3
+	)
+
+	n := len(b.objects)
+	strains := make([]float64, n)
+	individual := make([]float64, keys)
+	heldUntil := make([]float64, keys)
+	var overall float64
+	for i, o := range b.objects {
+		column := int(o.pos.x * float64(keys) / 512)
+		if column >= keys {
+			column = keys - 1
+		} else if column < 0 {
+			column = 0
+		}
+		var elapsed float64
+		if i > 0 {
+			elapsed = (o.time - b.objects[i-1].time) / d.stats.speed / 1000
+		}
+
+		// the notes are harder while other keys are held
+		holdAddition, holdFactor := 0.0, 1.0
+		for k := range heldUntil {
+			if o.time < heldUntil[k] && o.endTime < heldUntil[k] {
+				holdFactor = 1.25
+			}
+			if o.time < heldUntil[k] && o.endTime > heldUntil[k] {
+				holdAddition = 1
+			}
+		}
+		heldUntil[column] = o.endTime
+
+		for k := range individual {
+			individual[k] *= math.Pow(individualDecay, elapsed)
+		}
+		individual[column] += 2 * holdFactor
+		overall = overall*math.Pow(overallDecay, elapsed) + (1+holdAddition)*holdFactor
+		strains[i] = individual[column] + overall
+	}
+	// both strains decay, individual faster than overall: decaying the sum
+	// with overallDecay is close enough between the objects
+	d.stars = weightedStrains(b.objects, strains, overallDecay, d.stats.speed) * 0.018
+	return d
+}
@@ -0,0 +1,525 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The types of the hit objects, as in the .osu files.
+const (
+	objCircle  = 1
+	objSlider  = 2
+	objSpinner = 8
+	objHold    = 128
+)
+
+// The hit sounds of the hit objects, which give the colour of the taiko notes.
+const (
+	soundWhistle = 2
+	soundFinish  = 4
+	soundClap    = 8
+)
+
+type vector struct{ x, y float64 }
+
+func (v vector) sub(w vector) vector     { return vector{v.x - w.x, v.y - w.y} }
+func (v vector) add(w vector) vector     { return vector{v.x + w.x, v.y + w.y} }
+func (v vector) mul(f float64) vector    { return vector{v.x * f, v.y * f} }
+func (v vector) dot(w vector) float64    { return v.x*w.x + v.y*w.y }
+func (v vector) length() float64         { return math.Sqrt(v.dot(v)) }
+func (v vector) dist(w vector) float64   { return v.sub(w).length() }
+func (v vector) cross(w vector) float64  { return v.x*w.y - v.y*w.x }
+func lerp(v, w vector, t float64) vector { return v.add(w.sub(v).mul(t)) }
+
+// osuHitObject is a hit object of a .osu file. For sliders, end is the
+// position where the slider ends, and for holds (mania) endTime is when they
+// end.
+type osuHitObject struct {
+	pos      vector
+	end      vector
+	time     float64
+	endTime  float64
+	kind     int
+	hitSound int
+	// tail is where the path of a slider ends, which is end if it's not
+	// repeated, or an even number of times.
+	tail vector
+	// ticks is the number of slider ticks, repeats included, which count
+	// towards the max combo.
+	ticks int
+}
+
+func (o osuHitObject) is(kind int) bool { return o.kind&kind != 0 }
+
+// osuBeatmap is the part of a .osu file needed to compute the difficulty of
+// the beatmap.
+type osuBeatmap struct {
+	// version is the version of the .osu file format.
+	version          int
+	mode             int
+	stackLeniency    float64
+	hp, cs, od, ar   float64
+	sliderMultiplier float64
+	sliderTickRate   float64
+	objects          []osuHitObject
+	circles, sliders int
+	spinners         int
+	maxCombo         int
+}
+
+type osuTimingPoint struct {
+	time       float64
+	beatLength float64
+	inherited  bool
+}
+
+// parseOsuFile parses a .osu file.
+func parseOsuFile(rd io.Reader) (*osuBeatmap, error) {
+	b := &osuBeatmap{ar: -1, stackLeniency: 0.7, sliderMultiplier: 1.4, sliderTickRate: 1}
+	var (
+		section string
+		timing  []osuTimingPoint
+		rawObjs []string
+	)
+	sc := bufio.NewScanner(rd)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "//") {
+			continue
+		}
+		if section == "" && strings.HasPrefix(line, "osu file format v") {
+			b.version, _ = strconv.Atoi(strings.TrimPrefix(line, "osu file format v"))
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = line[1 : len(line)-1]
+			continue
+		}
+		switch section {
+		case "General", "Difficulty":
+			kv := strings.SplitN(line, ":", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			value, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+			if err != nil {
+				continue
+			}
+			switch strings.TrimSpace(kv[0]) {
+			case "Mode":
+				b.mode = int(value)
+			case "StackLeniency":
+				b.stackLeniency = value
+			case "HPDrainRate":
+				b.hp = value
+			case "CircleSize":
+				b.cs = value
+			case "OverallDifficulty":
+				b.od = value
+			case "ApproachRate":
+				b.ar = value
+			case "SliderMultiplier":
+				b.sliderMultiplier = value
+			case "SliderTickRate":
+				b.sliderTickRate = value
+			}
+		case "TimingPoints":
+			parts := strings.Split(line, ",")
+			if len(parts) < 2 {
+				continue
+			}
+			t, err1 := strconv.ParseFloat(parts[0], 64)
+			beatLength, err2 := strconv.ParseFloat(parts[1], 64)
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("invalid timing point %q", line)
+			}
+			// the beat length of the inherited timing points is a negative
+			// percentage of the slider velocity
+			tp := osuTimingPoint{time: t, beatLength: beatLength, inherited: beatLength < 0}
+			if len(parts) >= 7 && parts[6] == "0" {
+				tp.inherited = true
+			}
+			timing = append(timing, tp)
+		case "HitObjects":
+			rawObjs = append(rawObjs, line)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	// the beatmaps from before ApproachRate existed used the OD
+	if b.ar < 0 {
+		b.ar = b.od
+	}
+	sort.SliceStable(timing, func(i, j int) bool { return timing[i].time < timing[j].time })
+
+	for _, line := range rawObjs {
+		o, err := b.parseHitObject(line, timing)
+		if err != nil {
+			return nil, err
+		}
+		b.objects = append(b.objects, o)
+	}
+	sort.SliceStable(b.objects, func(i, j int) bool { return b.objects[i].time < b.objects[j].time })
+	if len(b.objects) == 0 {
+		return nil, fmt.Errorf("the beatmap has no hit objects")
+	}
+	return b, nil
+}
+
+func (b *osuBeatmap) parseHitObject(line string, timing []osuTimingPoint) (osuHitObject, error) {
+	parts := strings.Split(line, ",")
+	if len(parts) < 5 {
+		return osuHitObject{}, fmt.Errorf("invalid hit object %q", line)
+	}
+	var o osuHitObject
+	x, err1 := strconv.ParseFloat(parts[0], 64)
+	y, err2 := strconv.ParseFloat(parts[1], 64)
+	t, err3 := strconv.ParseFloat(parts[2], 64)
+	kind, err4 := strconv.Atoi(parts[3])
+	hitSound, err5 := strconv.Atoi(parts[4])
+	for _, err := range []error{err1, err2, err3, err4, err5} {
+		if err != nil {
+			return o, fmt.Errorf("invalid hit object %q", line)
+		}
+	}
+	o.pos, o.end, o.tail, o.time, o.endTime, o.kind, o.hitSound = vector{x, y}, vector{x, y}, vector{x, y}, t, t, kind, hitSound
+
+	switch {
+	case o.is(objCircle):
+		b.circles++
+		b.maxCombo++
+	case o.is(objSpinner):
+		b.spinners++
+		b.maxCombo++
+		if len(parts) > 5 {
+			o.endTime, _ = strconv.ParseFloat(parts[5], 64)
+		}
+	case o.is(objHold):
+		// mania holds count as a note, like circles
+		b.circles++
+		b.maxCombo++
+		if len(parts) > 5 {
+			o.endTime, _ = strconv.ParseFloat(strings.SplitN(parts[5], ":", 2)[0], 64)
+		}
+	case o.is(objSlider):
+		if len(parts) < 8 {
+			return o, fmt.Errorf("invalid slider %q", line)
+		}
+		repeats, err1 := strconv.Atoi(parts[6])
+		pixelLength, err2 := strconv.ParseFloat(parts[7], 64)
+		if err1 != nil || err2 != nil || repeats < 1 {
+			return o, fmt.Errorf("invalid slider %q", line)
+		}
+		b.sliders++
+		o.tail = sliderTail(o.pos, parts[5], pixelLength)
+		if repeats%2 == 1 {
+			o.end = o.tail
+		}
+
+		beatLength, velocity := timingAt(timing, t)
+		pxPerBeat := b.sliderMultiplier * 100 * velocity
+		beats := pixelLength * float64(repeats) / pxPerBeat
+		o.endTime = t + beats*beatLength
+
+		// the ticks of each span, the repeats and the end
+		ticks := int(math.Ceil((beats-0.1)/float64(repeats)*b.sliderTickRate)) - 1
+		if ticks < 0 {
+			ticks = 0
+		}
+		o.ticks = ticks*repeats + repeats
+		b.maxCombo += 1 + o.ticks
+	}
+	return o, nil
+}
+
+// timingAt returns the beat length of the uninherited timing point active at
+// t, and the slider velocity multiplier of the inherited one.
+func timingAt(timing []osuTimingPoint, t float64) (beatLength, velocity float64) {
+	beatLength, velocity = 1000, 1
+	for i, tp := range timing {
+		if tp.time > t && i > 0 {
+			break
+		}
+		if tp.inherited {
+			if tp.beatLength < 0 {
+				velocity = -100 / tp.beatLength
+			}
+		} else {
+			beatLength = tp.beatLength
+			velocity = 1
+		}
+	}
+	return beatLength, velocity
+}
+
+// sliderEnd returns where a slider with the given curve ends, which is its
+// start if it goes back and forth an even number of times.
+func sliderEnd(start vector, curve string, pixelLength float64, repeats int) vector {
+	if repeats%2 == 0 {
+		return start
+	}
+	return sliderTail(start, curve, pixelLength)
+}
+
+// sliderTail returns where the path of a slider with the given curve ends.
+func sliderTail(start vector, curve string, pixelLength float64) vector {
+	parts := strings.Split(curve, "|")
+	kind := parts[0]
+	points := []vector{start}
+	for _, p := range parts[1:] {
+		xy := strings.SplitN(p, ":", 2)
+		if len(xy) != 2 {
+			continue
+		}
+		x, err1 := strconv.ParseFloat(xy[0], 64)
+		y, err2 := strconv.ParseFloat(xy[1], 64)
+		if err1 == nil && err2 == nil {
+			points = append(points, vector{x, y})
+		}
+	}
+	if len(points) < 2 {
+		return start
+	}
+
+	var path []vector
+	switch kind {
+	case "P":
+		if len(points) == 3 {
+			path = circleArc(points[0], points[1], points[2])
+		}
+		if path == nil {
+			path = bezierPath(points)
+		}
+	case "B":
+		path = bezierPath(points)
+	case "C":
+		path = catmullPath(points)
+	default:
+		path = points
+	}
+	return pointAtLength(path, pixelLength)
+}
+
+// catmullPath approximates a Catmull-Rom spline going through points with
+// segments, like osu! does.
+func catmullPath(points []vector) []vector {
+	const steps = 50
+	path := make([]vector, 0, (len(points)-1)*(steps+1))
+	for i := 0; i < len(points)-1; i++ {
+		v1 := points[i]
+		if i > 0 {
+			v1 = points[i-1]
+		}
+		v2 := points[i]
+		v3 := v2.mul(2).sub(v1)
+		if i < len(points)-1 {
+			v3 = points[i+1]
+		}
+		v4 := v3.mul(2).sub(v2)
+		if i < len(points)-2 {
+			v4 = points[i+2]
+		}
+		for s := 0; s <= steps; s++ {
+			t := float64(s) / steps
+			t2, t3 := t*t, t*t*t
+			// 0.5 * (2 v2 + (v3 - v1) t + (2 v1 - 5 v2 + 4 v3 - v4) t² + (3 v2 - v1 - 3 v3 + v4) t³)
+			p := v2.mul(2).
+				add(v3.sub(v1).mul(t)).
+				add(v1.mul(2).sub(v2.mul(5)).add(v3.mul(4)).sub(v4).mul(t2)).
+				add(v2.mul(3).sub(v1).sub(v3.mul(3)).add(v4).mul(t3))
+			path = append(path, p.mul(0.5))
+		}
+	}
+	return path
+}
+
+// stackDistance is the distance under which osu! stacks the objects.
+const stackDistance = 3
+
+// stackedObjects returns the std objects of b played with mods, moved up and
+// to the left like osu! does when they're stacked on top of each other.
+func (b *osuBeatmap) stackedObjects(mods int) []osuHitObject {
+	objs := append([]osuHitObject(nil), b.objects...)
+	heights := make([]int, len(objs))
+	// the stacks depend on the approach time in the beatmap's time, which
+	// the speed of the mods doesn't change
+	stats := b.applyMods(mods &^ (modDoubleTime | modHalfTime | modNightcore))
+	ar, cs := stats.ar, stats.cs
+	preempt := 1200 - 150*(ar-5)
+	if ar < 5 {
+		preempt = 1800 - 120*ar
+	}
+	threshold := preempt * b.stackLeniency
+	if b.version >= 6 {
+		stackObjects(objs, heights, threshold)
+	} else {
+		stackObjectsOld(objs, heights, threshold)
+	}
+
+	radius := 32 * (1 - 0.7*(cs-5)/5)
+	for i := range objs {
+		offset := vector{-1, -1}.mul(float64(heights[i]) * radius / 10)
+		objs[i].pos = objs[i].pos.add(offset)
+		objs[i].end = objs[i].end.add(offset)
+		objs[i].tail = objs[i].tail.add(offset)
+	}
+	return objs
+}
+
+// stackObjects computes the stack heights of objs, as osu! does for the
+// beatmaps since version 6: going backwards, each object is stacked under
+// the later ones at the same place, and the objects after the end of a
+// slider are stacked the other way.
+func stackObjects(objs []osuHitObject, heights []int, threshold float64) {
+	for i := len(objs) - 1; i > 0; i-- {
+		if heights[i] != 0 || objs[i].is(objSpinner) {
+			continue
+		}
+		cur := i
+		if objs[cur].is(objCircle) {
+			for n := i - 1; n >= 0; n-- {
+				if objs[n].is(objSpinner) {
+					continue
+				}
+				if objs[cur].time-objs[n].endTime > threshold {
+					break
+				}
+				if objs[n].is(objSlider) && objs[n].end.dist(objs[cur].pos) < stackDistance {
+					offset := heights[cur] - heights[n] + 1
+					for j := n + 1; j <= i; j++ {
+						if objs[n].end.dist(objs[j].pos) < stackDistance {
+							heights[j] -= offset
+						}
+					}
+					break
+				}
+				if objs[n].pos.dist(objs[cur].pos) < stackDistance {
+					heights[n] = heights[cur] + 1
+					cur = n
+				}
+			}
+		} else if objs[cur].is(objSlider) {
+			for n := i - 1; n >= 0; n-- {
+				if objs[n].is(objSpinner) {
+					continue
+				}
+				if objs[cur].time-objs[n].time > threshold {
+					break
+				}
+				if objs[n].end.dist(objs[cur].pos) < stackDistance {
+					heights[n] = heights[cur] + 1
+					cur = n
+				}
+			}
+		}
+	}
+}
+
+// stackObjectsOld computes the stack heights of objs, as osu! does for the
+// beatmaps before version 6.
+func stackObjectsOld(objs []osuHitObject, heights []int, threshold float64) {
+	for i := range objs {
+		if heights[i] != 0 && !objs[i].is(objSlider) {
+			continue
+		}
+		startTime := objs[i].endTime
+		sliderStack := 0
+		for j := i + 1; j < len(objs); j++ {
+			if objs[j].time-threshold > startTime {
+				break
+			}
+			if objs[j].pos.dist(objs[i].pos) < stackDistance {
+				heights[i]++
+				startTime = objs[j].endTime
+			} else if objs[j].pos.dist(objs[i].tail) < stackDistance {
+				sliderStack++
+				heights[j] -= sliderStack
+				startTime = objs[j].endTime
+			}
+		}
+	}
+}
+
+// bezierPath approximates a bezier curve, made of several curves separated
+// by repeated points, with segments.
+func bezierPath(points []vector) []vector {
+	var path []vector
+	start := 0
+	for i := 1; i <= len(points); i++ {
+		if i < len(points) && points[i] != points[i-1] {
+			continue
+		}
+		curve := points[start:i]
+		start = i
+		if len(curve) < 2 {
+			continue
+		}
+		const steps = 50
+		tmp := make([]vector, len(curve))
+		for s := 0; s <= steps; s++ {
+			copy(tmp, curve)
+			t := float64(s) / steps
+			// de Casteljau
+			for n := len(tmp) - 1; n > 0; n-- {
+				for k := 0; k < n; k++ {
+					tmp[k] = lerp(tmp[k], tmp[k+1], t)
+				}
+			}
+			path = append(path, tmp[0])
+		}
+	}
+	return path
+}
+
+// circleArc approximates the arc going through a, b and c with segments, or
+// returns nil if they're aligned.
+func circleArc(a, b, c vector) []vector {
+	d := 2 * (a.x*(b.y-c.y) + b.x*(c.y-a.y) + c.x*(a.y-b.y))
+	if math.Abs(d) < 1e-3 {
+		return nil
+	}
+	aSq, bSq, cSq := a.dot(a), b.dot(b), c.dot(c)
+	center := vector{
+		(aSq*(b.y-c.y) + bSq*(c.y-a.y) + cSq*(a.y-b.y)) / d,
+		(aSq*(c.x-b.x) + bSq*(a.x-c.x) + cSq*(b.x-a.x)) / d,
+	}
+	radius := a.dist(center)
+	startAngle := math.Atan2(a.y-center.y, a.x-center.x)
+	// go from a towards c through b, around the whole circle: the path is
+	// cut to the length of the slider anyway
+	dir := 1.0
+	if b.sub(a).cross(c.sub(a)) < 0 {
+		dir = -1
+	}
+	endAngle := startAngle + dir*2*math.Pi
+	const steps = 100
+	path := make([]vector, 0, steps+1)
+	for s := 0; s <= steps; s++ {
+		angle := startAngle + (endAngle-startAngle)*float64(s)/steps
+		path = append(path, vector{center.x + radius*math.Cos(angle), center.y + radius*math.Sin(angle)})
+	}
+	return path
+}
+
+// pointAtLength returns the point at the given distance along path. If path
+// is shorter, it's extended in the direction of its last segment.
+func pointAtLength(path []vector, length float64) vector {
+	for i := 1; i < len(path); i++ {
+		seg := path[i].dist(path[i-1])
+		if seg >= length || i == len(path)-1 {
+			if seg == 0 {
+				return path[i]
+			}
+			return lerp(path[i-1], path[i], length/seg)
+		}
+		length -= seg
+	}
+	return path[len(path)-1]
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+const testOsuHeader = `osu file format v14
+
+[General]
+Mode: 0
+
+[Difficulty]
+HPDrainRate:5
+CircleSize:4
+OverallDifficulty:8
+ApproachRate:9
+SliderMultiplier:1.4
+SliderTickRate:1
+
+[TimingPoints]
+0,500,4,2,0,50,1,0
+10000,-50,4,2,0,50,0,0
+
+[HitObjects]
+`
+
+func closeTo(v, w vector, tolerance float64) bool {
+	return v.dist(w) <= tolerance
+}
+
+func TestParseOsuFile(t *testing.T) {
+	b, err := parseOsuFile(strings.NewReader(testOsuHeader + `256,192,1000,1,0
+0,0,2000,2,0,L|100:0,1,140
+0,0,3000,2,0,L|100:0,1,280
+0,0,4000,6,0,L|100:0,2,140
+0,0,10000,2,0,L|100:0,1,140
+256,192,12000,12,0,14000
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.mode != 0 || b.cs != 4 || b.od != 8 || b.ar != 9 || b.hp != 5 {
+		t.Errorf("wrong difficulty settings: %+v", b)
+	}
+	if b.circles != 1 || b.sliders != 4 || b.spinners != 1 {
+		t.Errorf("got %d circles, %d sliders and %d spinners, want 1, 4 and 1", b.circles, b.sliders, b.spinners)
+	}
+
+	tests := []struct {
+		end     vector
+		endTime float64
+		ticks   int
+	}{
+		{vector{256, 192}, 1000, 0},
+		// 140px is a beat at 1.4x: no tick, only the end
+		{vector{140, 0}, 2500, 1},
+		// two beats, with a tick in the middle
+		{vector{280, 0}, 4000, 2},
+		// back to the start, with the repeat and the end
+		{vector{0, 0}, 5000, 2},
+		// twice as fast after the inherited timing point at 10000
+		{vector{140, 0}, 10250, 1},
+		{vector{256, 192}, 14000, 0},
+	}
+	for i, test := range tests {
+		o := b.objects[i]
+		if !closeTo(o.end, test.end, 0.01) || o.endTime != test.endTime || o.ticks != test.ticks {
+			t.Errorf("object %d: got end %v at %v with %d ticks, want %v at %v with %d ticks",
+				i, o.end, o.endTime, o.ticks, test.end, test.endTime, test.ticks)
+		}
+	}
+	// 1 + 2 + 3 + 3 + 2 + 1
+	if b.maxCombo != 12 {
+		t.Errorf("got max combo %d, want 12", b.maxCombo)
+	}
+}
+
+func TestParseOsuFileWithoutApproachRate(t *testing.T) {
+	b, err := parseOsuFile(strings.NewReader(strings.Replace(testOsuHeader, "ApproachRate:9\n", "", 1) + "256,192,1000,1,0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.ar != 8 {
+		t.Errorf("got AR %v, want the OD (8)", b.ar)
+	}
+}
+
+func TestParseOsuFileErrors(t *testing.T) {
+	for _, objects := range []string{
+		"",
+		"256,192\n",
+		"256,192,1000,x,0\n",
+		"0,0,2000,2,0,L|100:0,0,140\n",
+		"0,0,2000,2,0,L|100:0\n",
+	} {
+		if _, err := parseOsuFile(strings.NewReader(testOsuHeader + objects)); err == nil {
+			t.Errorf("%q: no error", objects)
+		}
+	}
+}
+
+func TestSliderEnd(t *testing.T) {
+	tests := []struct {
+		curve   string
+		length  float64
+		repeats int
+		want    vector
+	}{
+		{"L|100:0", 50, 1, vector{50, 0}},
+		// the path is extended if it's too short
+		{"L|100:0", 150, 1, vector{150, 0}},
+		{"L|100:0", 50, 2, vector{0, 0}},
+		{"L|100:0|100:100", 150, 1, vector{100, 50}},
+		// two linear bezier curves, separated by the repeated point
+		{"B|100:0|100:0|100:100", 150, 1, vector{100, 50}},
+		// the middle of a quadratic bezier curve of length 229.56
+		{"B|100:100|200:0", 229.5587 / 2, 1, vector{100, 50}},
+		// a half circle of radius 100, going up first
+		{"P|100:100|200:0", 100 * math.Pi, 1, vector{200, 0}},
+		{"P|100:100|200:0", 50 * math.Pi, 1, vector{100, 100}},
+		// going down first
+		{"P|100:-100|200:0", 50 * math.Pi, 1, vector{100, -100}},
+		// aligned points aren't a circle
+		{"P|100:0|200:0", 150, 1, vector{150, 0}},
+		// a catmull curve through two points is a line
+		{"C|100:0", 50, 1, vector{50, 0}},
+		{"L", 50, 1, vector{0, 0}},
+	}
+	for _, test := range tests {
+		got := sliderEnd(vector{0, 0}, test.curve, test.length, test.repeats)
+		if !closeTo(got, test.want, 0.5) {
+			t.Errorf("%s of length %v, %d repeats: got %v, want %v", test.curve, test.length, test.repeats, got, test.want)
+		}
+	}
+}
+
+func TestCatmullPath(t *testing.T) {
+	points := []vector{{0, 0}, {100, 100}, {200, 0}}
+	path := catmullPath(points)
+	// the curve goes through every point, unlike a bezier curve
+	for _, p := range points {
+		found := false
+		for _, q := range path {
+			found = found || closeTo(p, q, 0.01)
+		}
+		if !found {
+			t.Errorf("the path doesn't go through %v", p)
+		}
+	}
+	// and is longer than the lines between them, as it's curved
+	var length float64
+	for i := 1; i < len(path); i++ {
+		length += path[i].dist(path[i-1])
+	}
+	if length <= 2*100*math.Sqrt2 {
+		t.Errorf("the path is %v long, want more than the lines between the points", length)
+	}
+	if end := sliderEnd(points[0], "C|100:100|200:0", length, 1); !closeTo(end, points[2], 0.5) {
+		t.Errorf("the slider along the whole path ends at %v, want %v", end, points[2])
+	}
+}
+
+func TestStackedObjects(t *testing.T) {
+	// at CS 4, a stack moves each object by a tenth of the radius of 36.48
+	const offset = 3.648
+	tests := []struct {
+		name, version, objects string
+		want                   []vector
+	}{
+		{
+			name: "circles on top of each other",
+			objects: `256,192,1000,1,0
+256,192,1100,1,0
+256,192,1200,1,0
+`,
+			want: []vector{{256 - 2*offset, 192 - 2*offset}, {256 - offset, 192 - offset}, {256, 192}},
+		},
+		{
+			name: "circles too far apart in time",
+			// the stack leniency of 0.7 at AR 9 stacks the objects 420ms apart
+			objects: `256,192,1000,1,0
+256,192,1500,1,0
+`,
+			want: []vector{{256, 192}, {256, 192}},
+		},
+		{
+			name: "circle at the end of a slider",
+			objects: `0,0,2000,2,0,L|100:0,1,140
+140,0,2600,1,0
+`,
+			want: []vector{{0, 0}, {140 + offset, offset}},
+		},
+		{
+			name:    "circles on top of each other, old format",
+			version: "osu file format v5",
+			objects: `256,192,1000,1,0
+256,192,1100,1,0
+256,192,1200,1,0
+`,
+			want: []vector{{256 - 2*offset, 192 - 2*offset}, {256 - offset, 192 - offset}, {256, 192}},
+		},
+		{
+			name:    "circle at the end of a slider, old format",
+			version: "osu file format v5",
+			objects: `0,0,2000,2,0,L|100:0,1,140
+140,0,2600,1,0
+`,
+			want: []vector{{0, 0}, {140 + offset, offset}},
+		},
+	}
+	for _, test := range tests {
+		header := testOsuHeader
+		if test.version != "" {
+			header = strings.Replace(header, "osu file format v14", test.version, 1)
+		}
+		b, err := parseOsuFile(strings.NewReader(header + test.objects))
+		if err != nil {
+			t.Fatal(err)
+		}
+		objs := b.stackedObjects(0)
+		for i, want := range test.want {
+			if !closeTo(objs[i].pos, want, 0.01) {
+				t.Errorf("%s: object %d is at %v, want %v", test.name, i, objs[i].pos, want)
+			}
+		}
+	}
+}
+
+func TestCircleArc(t *testing.T) {
+	a, b, c := vector{0, 0}, vector{100, 100}, vector{200, 0}
+	path := circleArc(a, b, c)
+	if path == nil {
+		t.Fatal("no arc")
+	}
+	if !closeTo(path[0], a, 0.01) {
+		t.Errorf("the arc starts at %v, want %v", path[0], a)
+	}
+	for _, p := range path {
+		if r := p.dist(vector{100, 0}); math.Abs(r-100) > 0.01 {
+			t.Fatalf("%v is at %v from the center, want 100", p, r)
+		}
+	}
+	if circleArc(a, vector{100, 0}, c) != nil {
+		t.Error("got an arc through aligned points")
+	}
+}
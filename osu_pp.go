@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// The difficulty and the pp are computed with the formulas osu!stable used
+// from 2019 until the 2021 rework (as in oppai-ng), with simplifications: the
+// taiko rhythm bonus is simplified, and the sliders' paths are approximated
+// with segments. The results aren't exactly the ones of osu!, which is why
+// RecalculateScoresPP only writes them with RecalculatePPWrite, and skips the
+// ones too far from the old pp. osu_pp_test.go pins the results on test
+// beatmaps.
+
+// scoreHits are the hits, combo and mods of a score, which give its pp.
+type scoreHits struct {
+	mode                        int
+	mods                        int
+	score                       int64
+	maxCombo                    int
+	count300, count100, count50 int
+	misses                      int
+}
+
+// scoreDifficulty returns the difficulty of b played in mode with mods. The
+// std beatmaps can be played in std and taiko, and the taiko and mania
+// beatmaps in their own mode; the other conversions, and ctb, aren't
+// supported.
+func scoreDifficulty(b *osuBeatmap, mode, mods int) (beatmapDifficulty, error) {
+	switch {
+	case mode == 0 && b.mode == 0:
+		return stdDifficulty(b, mods), nil
+	case mode == 1 && (b.mode == 0 || b.mode == 1):
+		return taikoDifficulty(b, mods), nil
+	case mode == 3 && b.mode == 3:
+		return maniaDifficulty(b, mods), nil
+	}
+	return beatmapDifficulty{}, fmt.Errorf("%s scores on %s beatmaps are not supported", modeToString(mode), modeToString(b.mode))
+}
+
+// scorePP returns the pp of a score set on b, whose difficulty with the mods
+// of the score is d.
+func scorePP(b *osuBeatmap, d beatmapDifficulty, s scoreHits) float64 {
+	var pp float64
+	switch s.mode {
+	case 0:
+		pp = stdPP(b, d, s)
+	case 1:
+		pp = taikoPP(d, s)
+	case 3:
+		pp = maniaPP(b, d, s)
+	}
+	if math.IsNaN(pp) || math.IsInf(pp, 0) || pp < 0 {
+		return 0
+	}
+	return pp
+}
+
+func stdPP(b *osuBeatmap, d beatmapDifficulty, s scoreHits) float64 {
+	objects := float64(b.circles + b.sliders + b.spinners)
+	hits := s.count300 + s.count100 + s.count50 + s.misses
+	if hits == 0 {
+		return 0
+	}
+	accuracy := float64(s.count300*300+s.count100*100+s.count50*50) / float64(hits*300)
+
+	lengthBonus := 0.95 + 0.4*math.Min(1, objects/2000)
+	if objects > 2000 {
+		lengthBonus += math.Log10(objects/2000) * 0.5
+	}
+	missPenalty := math.Pow(0.97, float64(s.misses))
+	comboBreak := 1.0
+	if b.maxCombo > 0 {
+		comboBreak = math.Min(1, math.Pow(float64(s.maxCombo), 0.8)/math.Pow(float64(b.maxCombo), 0.8))
+	}
+	ar, od := d.stats.ar, d.stats.od
+	arBonus := 1.0
+	if ar > 10.33 {
+		arBonus += 0.3 * (ar - 10.33)
+	} else if ar < 8 {
+		arBonus += 0.01 * (8 - ar)
+	}
+	hdBonus := 1.0
+	if s.mods&modHidden != 0 {
+		hdBonus += 0.04 * (12 - ar)
+	}
+
+	aim := math.Pow(5*math.Max(1, d.aim/stdStarScaling)-4, 3) / 100000
+	aim *= lengthBonus * missPenalty * comboBreak * arBonus * hdBonus
+	if s.mods&modFlashlight != 0 {
+		flBonus := 1 + 0.35*math.Min(1, objects/200)
+		if objects > 200 {
+			flBonus += 0.3 * math.Min(1, (objects-200)/300)
+		}
+		if objects > 500 {
+			flBonus += (objects - 500) / 1200
+		}
+		aim *= flBonus
+	}
+	aim *= (0.5 + accuracy/2) * (0.98 + od*od/2500)
+
+	speed := math.Pow(5*math.Max(1, d.speed/stdStarScaling)-4, 3) / 100000
+	speed *= lengthBonus * missPenalty * comboBreak * hdBonus
+	if ar > 10.33 {
+		speed *= arBonus
+	}
+	speed *= (0.95 + od*od/750) * math.Pow(accuracy, (14.5-math.Max(od, 8))/2)
+	if n50 := float64(s.count50) - objects/500; n50 > 0 {
+		speed *= math.Pow(0.98, n50)
+	}
+
+	// the accuracy only counts on the circles
+	circles := float64(b.circles)
+	var realAccuracy float64
+	if circles > 0 {
+		realAccuracy = (float64(s.count300-b.sliders-b.spinners)*6 + float64(s.count100*2+s.count50)) / (circles * 6)
+		realAccuracy = math.Max(0, realAccuracy)
+	}
+	acc := math.Pow(1.52163, od) * math.Pow(realAccuracy, 24) * 2.83
+	acc *= math.Min(1.15, math.Pow(circles/1000, 0.3))
+	if s.mods&modHidden != 0 {
+		acc *= 1.08
+	}
+	if s.mods&modFlashlight != 0 {
+		acc *= 1.02
+	}
+
+	multiplier := 1.12
+	if s.mods&modNoFail != 0 {
+		multiplier *= math.Max(0.9, 1-0.02*float64(s.misses))
+	}
+	if s.mods&modSpunOut != 0 {
+		multiplier *= 0.95
+	}
+	return math.Pow(math.Pow(aim, 1.1)+math.Pow(speed, 1.1)+math.Pow(acc, 1.1), 1/1.1) * multiplier
+}
+
+func taikoPP(d beatmapDifficulty, s scoreHits) float64 {
+	hits := float64(s.count300 + s.count100 + s.misses)
+	if hits == 0 {
+		return 0
+	}
+	accuracy := float64(s.count300*2+s.count100) / (hits * 2)
+
+	strain := math.Pow(5*math.Max(1, d.stars/0.0075)-4, 2) / 100000
+	lengthBonus := 1 + 0.1*math.Min(1, hits/1500)
+	strain *= lengthBonus * math.Pow(0.985, float64(s.misses))
+	if s.mods&modHidden != 0 {
+		strain *= 1.025
+	}
+	if s.mods&modFlashlight != 0 {
+		strain *= 1.05 * lengthBonus
+	}
+	strain *= accuracy
+
+	// the 300 hit window, which is shorter with a higher OD
+	hitWindow := math.Floor(49.5-3*d.stats.od) / d.stats.speed
+	var acc float64
+	if hitWindow > 0 {
+		acc = math.Pow(150/hitWindow, 1.1) * math.Pow(accuracy, 15) * 22
+		acc *= math.Min(1.15, math.Pow(hits/1500, 0.3))
+	}
+
+	multiplier := 1.1
+	if s.mods&modNoFail != 0 {
+		multiplier *= 0.9
+	}
+	if s.mods&modHidden != 0 {
+		multiplier *= 1.1
+	}
+	return math.Pow(math.Pow(strain, 1.1)+math.Pow(acc, 1.1), 1/1.1) * multiplier
+}
+
+func maniaPP(b *osuBeatmap, d beatmapDifficulty, s scoreHits) float64 {
+	// the score is scaled back to what it would be without the mods
+	// lowering it
+	score := float64(s.score)
+	for _, mod := range [...]int{modEasy, modNoFail, modHalfTime} {
+		if s.mods&mod != 0 {
+			score /= 0.5
+		}
+	}
+	notes := float64(b.circles)
+
+	strain := math.Pow(5*math.Max(1, d.stars/0.2)-4, 2.2) / 135
+	strain *= 1 + 0.1*math.Min(1, notes/1500)
+	switch {
+	case score <= 500000:
+		strain = 0
+	case score <= 600000:
+		strain *= (score - 500000) / 100000 * 0.3
+	case score <= 700000:
+		strain *= 0.3 + (score-600000)/100000*0.25
+	case score <= 800000:
+		strain *= 0.55 + (score-700000)/100000*0.2
+	case score <= 900000:
+		strain *= 0.75 + (score-800000)/100000*0.15
+	default:
+		strain *= 0.9 + (score-900000)/100000*0.1
+	}
+
+	// the OD of mania isn't changed by the mods, the hit windows are
+	hitWindow := 34 + 3*math.Min(10, math.Max(0, 10-b.od))
+	if s.mods&modEasy != 0 {
+		hitWindow *= 1.4
+	} else if s.mods&modHardRock != 0 {
+		hitWindow /= 1.4
+	}
+	hitWindow /= d.stats.speed
+	acc := math.Max(0, 0.2-(hitWindow-34)*0.006667) * strain *
+		math.Pow(math.Max(0, score-960000)/40000, 1.1)
+
+	multiplier := 0.8
+	if s.mods&modNoFail != 0 {
+		multiplier *= 0.9
+	}
+	if s.mods&modEasy != 0 {
+		multiplier *= 0.5
+	}
+	return math.Pow(math.Pow(strain, 1.1)+math.Pow(acc, 1.1), 1/1.1) * multiplier
+}
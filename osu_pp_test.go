@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+// The expected values of TestApplyMods follow from the formulas of the
+// approach time (1800ms at AR0, 1200ms at AR5, 450ms at AR10) and of the 300
+// hit window (80ms at OD0, 20ms at OD10) of osu!, with DT and HT changing the
+// speed, and HR and EZ multiplying CS by 1.3 and 0.5 and the rest by 1.4 and
+// 0.5, up to 10.
+func TestApplyMods(t *testing.T) {
+	b := &osuBeatmap{cs: 4, od: 8, ar: 9, hp: 5}
+	tests := []struct {
+		mods           int
+		cs, od, ar, hp float64
+	}{
+		{0, 4, 8, 9, 5},
+		{modHardRock, 5.2, 10, 10, 7},
+		{modEasy, 2, 4, 4.5, 2.5},
+		{modDoubleTime, 4, 9.7778, 10.3333, 5},
+		{modNightcore, 4, 9.7778, 10.3333, 5},
+		{modHalfTime, 4, 6.2222, 7.6667, 5},
+		{modHardRock | modDoubleTime, 5.2, 11.1111, 11, 7},
+		{modEasy | modHalfTime, 2, 0.8889, 1, 2.5},
+		{modHidden | modFlashlight, 4, 8, 9, 5},
+	}
+	for _, test := range tests {
+		s := b.applyMods(test.mods)
+		for _, v := range [...][3]interface{}{
+			{"cs", s.cs, test.cs}, {"od", s.od, test.od}, {"ar", s.ar, test.ar}, {"hp", s.hp, test.hp},
+		} {
+			if math.Abs(v[1].(float64)-v[2].(float64)) > 0.0001 {
+				t.Errorf("mods %d: got %s %v, want %v", test.mods, v[0], v[1], v[2])
+			}
+		}
+	}
+}
+
+// testBeatmap returns a beatmap of the given mode with n objects, every 150ms.
+func testBeatmap(t *testing.T, mode, n int) *osuBeatmap {
+	header := strings.Replace(testOsuHeader, "Mode: 0", fmt.Sprintf("Mode: %d", mode), 1)
+	var objs strings.Builder
+	for i := 0; i < n; i++ {
+		time := 1000 + i*150
+		switch {
+		case mode == 3:
+			fmt.Fprintf(&objs, "%d,192,%d,1,0\n", 64+128*(i%4), time)
+		case i%10 == 9:
+			fmt.Fprintf(&objs, "100,100,%d,2,0,B|200:50|300:100,1,140\n", time)
+		default:
+			// jumps, with every colour of taiko notes
+			fmt.Fprintf(&objs, "%d,%d,%d,1,%d\n", 100+300*(i%2), 100+(i%3)*80, time, (i%4)*2)
+		}
+	}
+	b, err := parseOsuFile(strings.NewReader(header + objs.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// testScore returns a full combo of b with 98% of 300s, in mode with mods.
+func testScore(b *osuBeatmap, mode, mods int) scoreHits {
+	hits := b.circles + b.sliders + b.spinners
+	s := scoreHits{mode: mode, mods: mods, maxCombo: b.maxCombo, score: 980000}
+	s.count100 = hits / 50
+	s.count300 = hits - s.count100
+	// the scores set with these mods are halved by each of them
+	for _, mod := range [...]int{modEasy, modNoFail, modHalfTime} {
+		if mods&mod != 0 {
+			s.score /= 2
+		}
+	}
+	return s
+}
+
+func testPP(t *testing.T, b *osuBeatmap, s scoreHits) float64 {
+	d, err := scoreDifficulty(b, s.mode, s.mods)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return scorePP(b, d, s)
+}
+
+// TestScorePPMods checks that the mods change the pp of each mode in the
+// right direction.
+func TestScorePPMods(t *testing.T) {
+	beatmaps := map[int]*osuBeatmap{
+		0: testBeatmap(t, 0, 500),
+		1: testBeatmap(t, 1, 500),
+		3: testBeatmap(t, 3, 500),
+	}
+	tests := []struct {
+		mode, mods int
+		more       bool
+	}{
+		{0, modHardRock, true},
+		{0, modDoubleTime, true},
+		{0, modHidden, true},
+		{0, modFlashlight, true},
+		{0, modEasy, false},
+		{0, modHalfTime, false},
+		{0, modNoFail, false},
+		{0, modSpunOut, false},
+		{1, modHardRock, true},
+		{1, modDoubleTime, true},
+		{1, modHidden, true},
+		{1, modFlashlight, true},
+		{1, modEasy, false},
+		{1, modHalfTime, false},
+		{3, modHardRock, true},
+		{3, modDoubleTime, true},
+		{3, modEasy, false},
+		{3, modHalfTime, false},
+	}
+	for _, test := range tests {
+		b := beatmaps[test.mode]
+		nomod := testPP(t, b, testScore(b, test.mode, 0))
+		pp := testPP(t, b, testScore(b, test.mode, test.mods))
+		if nomod <= 0 || pp <= 0 {
+			t.Errorf("%s with mods %d: got %v pp, and %v without mods", modeToString(test.mode), test.mods, pp, nomod)
+		} else if (pp > nomod) != test.more {
+			t.Errorf("%s with mods %d: got %v pp, and %v without mods: want more: %v", modeToString(test.mode), test.mods, pp, nomod, test.more)
+		}
+	}
+}
+
+// TestScorePPHits checks that the misses, the combo and the score lower the
+// pp.
+func TestScorePPHits(t *testing.T) {
+	for _, mode := range []int{0, 1, 3} {
+		b := testBeatmap(t, mode, 500)
+		fc := testScore(b, mode, 0)
+		worse := fc
+		worse.count300 -= 5
+		worse.misses += 5
+		worse.maxCombo /= 2
+		worse.score = 900000
+		if fcPP, worsePP := testPP(t, b, fc), testPP(t, b, worse); worsePP >= fcPP {
+			t.Errorf("%s: got %v pp with misses, and %v with a full combo", modeToString(mode), worsePP, fcPP)
+		}
+	}
+
+	b := testBeatmap(t, 3, 500)
+	s := testScore(b, 3, 0)
+	s.score = 500000
+	if pp := testPP(t, b, s); pp != 0 {
+		t.Errorf("mania: got %v pp for a score of 500000, want 0", pp)
+	}
+	if pp := testPP(t, testBeatmap(t, 0, 500), scoreHits{mode: 0}); pp != 0 {
+		t.Errorf("got %v pp without hits, want 0", pp)
+	}
+}
+
+func TestScoreDifficultyModes(t *testing.T) {
+	tests := []struct {
+		beatmapMode, mode int
+		ok                bool
+	}{
+		{0, 0, true},
+		{0, 1, true},
+		{1, 1, true},
+		{3, 3, true},
+		{0, 2, false},
+		{2, 2, false},
+		{0, 3, false},
+		{1, 0, false},
+		{3, 0, false},
+	}
+	for _, test := range tests {
+		b := testBeatmap(t, test.beatmapMode, 20)
+		if _, err := scoreDifficulty(b, test.mode, 0); (err == nil) != test.ok {
+			t.Errorf("%s scores on %s beatmaps: got error %v", modeToString(test.mode), modeToString(test.beatmapMode), err)
+		}
+	}
+}
+
+// TestScorePPRegression pins the star rating and the pp given by the
+// calculator to the test beatmaps. These are not reference values: they
+// were given by this calculator, and must be updated whenever it changes.
+func TestScorePPRegression(t *testing.T) {
+	tests := []struct {
+		mode, mods int
+		stars, pp  float64
+	}{
+		{0, 0, 6.82, 327.57},
+		{0, modHardRock, 7.28, 452.15},
+		{0, modDoubleTime, 9.92, 1004.74},
+		{0, modHidden, 6.82, 365.22},
+		{0, modFlashlight, 6.82, 475.06},
+		{0, modEasy, 6.28, 234.14},
+		{0, modHalfTime, 5.25, 146.55},
+		{1, 0, 3.64, 163.51},
+		{1, modHardRock, 3.64, 200.01},
+		{1, modDoubleTime, 5.04, 321.67},
+		{1, modHidden, 3.64, 181.52},
+		{1, modFlashlight, 3.64, 168.66},
+		{1, modEasy, 3.64, 127.71},
+		{1, modHalfTime, 2.95, 101.05},
+		{3, 0, 1.59, 16.61},
+		{3, modHardRock, 1.59, 17.05},
+		{3, modDoubleTime, 2.22, 38.15},
+		{3, modEasy, 1.59, 8.02},
+		{3, modHalfTime, 1.29, 9.46},
+	}
+	for _, test := range tests {
+		b := testBeatmap(t, test.mode, 500)
+		s := testScore(b, test.mode, test.mods)
+		d, err := scoreDifficulty(b, test.mode, test.mods)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pp := scorePP(b, d, s)
+		if math.Abs(d.stars-test.stars) > 0.01 || math.Abs(pp-test.pp) > 0.01 {
+			t.Errorf("%s with mods %d: got %.2f stars and %.2f pp, want %.2f and %.2f",
+				modeToString(test.mode), test.mods, d.stars, pp, test.stars, test.pp)
+		}
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/jmoiron/sqlx"
+	redis "gopkg.in/redis.v5"
+)
+
+func init() {
+	registerJob(&basicJob{
+		name:        "SnapshotPPHistory",
+		description: "Saves the pp, global rank and country rank of every active user, once a day, so that they can be graphed.",
+		enabled:     func(c *config) bool { return c.SnapshotPPHistory },
+		deps:        []string{"CalculatePP"},
+		run:         opSnapshotPPHistory,
+	})
+}
+
+// ppHistoryTable is created by SnapshotPPHistory when PPHistoryStore is table,
+// if it doesn't exist.
+const ppHistoryTable = `CREATE TABLE IF NOT EXISTS users_pp_history (
+	user_id INT UNSIGNED NOT NULL,
+	mode TINYINT UNSIGNED NOT NULL,
+	relax TINYINT UNSIGNED NOT NULL,
+	date DATE NOT NULL,
+	pp INT UNSIGNED NOT NULL,
+	global_rank INT UNSIGNED NOT NULL,
+	country_rank INT UNSIGNED NOT NULL,
+	PRIMARY KEY (user_id, mode, relax, date),
+	KEY date (date)
+)`
+
+func checkPPHistoryStore(s string) error {
+	switch s {
+	case "redis", "table":
+		return nil
+	}
+	return fmt.Errorf("unknown store %q, must be redis or table", s)
+}
+
+// ppSnapshot is the pp and the ranks of a user in a mode on a day.
+type ppSnapshot struct {
+	Date        string `json:"date"`
+	Mode        string `json:"mode"`
+	Relax       bool   `json:"relax"`
+	PP          int64  `json:"pp"`
+	GlobalRank  int    `json:"global_rank"`
+	CountryRank int    `json:"country_rank"`
+}
+
+// ppHistoryKey is the redis sorted set holding the history of a user in a
+// mode, when PPHistoryStore is redis. The members are date:pp:global
+// rank:country rank, and the scores the UNIX timestamp of the date.
+func ppHistoryKey(userID, mode int, relax bool) string {
+	key := "ripple:pp_history:" + strconv.Itoa(userID) + ":" + modes[mode]
+	if relax {
+		key += ":relax"
+	}
+	return key
+}
+
+func opSnapshotPPHistory(ctx context.Context) error {
+	cfg := configFromContext(ctx)
+	if cfg.PPHistoryStore == "table" {
+		if dryRun {
+			reportContextWrite(ctx, "users_pp_history", "create the table if it doesn't exist")
+		} else if _, err := db.ExecContext(ctx, ppHistoryTable); err != nil {
+			queryError(ctx, err, ppHistoryTable)
+			return err
+		}
+	}
+
+	// the snapshots are taken once a day: running the job again on the
+	// same day replaces them
+	day := time.Now().UTC().Truncate(24 * time.Hour)
+	for _, relax := range [...]bool{false, true} {
+		if err := snapshotPPHistory(ctx, cfg, day, relax); err != nil {
+			return err
+		}
+	}
+
+	if cfg.PPHistoryRetentionDays > 0 {
+		cutoff := day.AddDate(0, 0, -cfg.PPHistoryRetentionDays)
+		if cfg.PPHistoryStore == "table" {
+			opSync(ctx, "DELETE FROM users_pp_history WHERE date < ?", cutoff.Format("2006-01-02"))
+		}
+		// with redis, the old snapshots are removed along with each new one
+	}
+
+	logFor(ctx).infof("done!")
+	return nil
+}
+
+type rankedUser struct {
+	id      int
+	country string
+	pp      int64
+}
+
+// snapshotPPHistory saves the snapshots of the classic or relax stats of the
+// active users.
+func snapshotPPHistory(ctx context.Context, cfg *config, day time.Time, relax bool) error {
+	table := "users_stats"
+	if relax {
+		table = "users_stats_relax"
+	}
+	// the same users as in the leaderboards of PopulateRedis
+	initQuery := `
+SELECT
+	users_stats.id, full_stats.country, users_stats.pp_std,
+	users_stats.pp_taiko, users_stats.pp_ctb, users_stats.pp_mania,
+	users_stats.playcount_std, users_stats.playcount_taiko, users_stats.playcount_ctb, users_stats.playcount_mania,
+	users.latest_activity
+FROM ` + table + ` AS users_stats JOIN users_stats AS full_stats USING(id) INNER JOIN users USING(id) WHERE is_public = 1`
+	rows, err := db.QueryContext(ctx, initQuery)
+	if err != nil {
+		queryError(ctx, err, initQuery)
+		return err
+	}
+	defer rows.Close()
+
+	currentSeconds := time.Now().Unix()
+	var users [4][]rankedUser
+	for rows.Next() {
+		countRows(ctx, 1)
+		var (
+			u              rankedUser
+			pp             [4]int64
+			playcount      [4]int
+			latestActivity int64
+		)
+		err := rows.Scan(
+			&u.id, &u.country, &pp[0],
+			&pp[1], &pp[2], &pp[3],
+			&playcount[0], &playcount[1], &playcount[2], &playcount[3],
+			&latestActivity,
+		)
+		if err != nil {
+			queryError(ctx, err, initQuery)
+			continue
+		}
+		u.country = strings.ToLower(u.country)
+		for mode := range pp {
+			if pp[mode] <= 0 || isInactive(float64(currentSeconds-latestActivity), playcount[mode]) {
+				continue
+			}
+			u.pp = pp[mode]
+			users[mode] = append(users[mode], u)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		queryError(ctx, err, initQuery)
+		return err
+	}
+
+	date := day.Format("2006-01-02")
+	relaxInt := 0
+	if relax {
+		relaxInt = 1
+	}
+	var cutoff string
+	if cfg.PPHistoryRetentionDays > 0 {
+		cutoff = "(" + strconv.FormatInt(day.AddDate(0, 0, -cfg.PPHistoryRetentionDays).Unix(), 10)
+	}
+	// the snapshots saved to redis are sent by pipelines of
+	// ppHistoryPipelineSize users, instead of a round-trip per command
+	var (
+		pipe    *redis.Pipeline
+		pending int
+	)
+	flush := func() {
+		if pipe == nil {
+			return
+		}
+		if !dryRun {
+			if _, err := pipe.Exec(); err != nil {
+				queryError(ctx, err, fmt.Sprintf("the pipeline of the snapshots of %d users", pending))
+			}
+		}
+		pipe.Close()
+		pipe, pending = nil, 0
+	}
+	defer flush()
+	for mode, modeUsers := range users {
+		sort.SliceStable(modeUsers, func(i, j int) bool { return modeUsers[i].pp > modeUsers[j].pp })
+		var globalRank int
+		// like the global ranks, users with the same pp have the same
+		// country rank
+		type countryState struct {
+			users, rank int
+			pp          int64
+		}
+		countries := make(map[string]*countryState)
+		for i, u := range modeUsers {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if i == 0 || u.pp != modeUsers[i-1].pp {
+				globalRank = i + 1
+			}
+			// users without a country have no country rank, as they're not
+			// in the country leaderboards
+			var countryRank int
+			if u.country != "xx" && u.country != "" {
+				cs := countries[u.country]
+				if cs == nil {
+					cs = &countryState{}
+					countries[u.country] = cs
+				}
+				cs.users++
+				if cs.users == 1 || u.pp != cs.pp {
+					cs.rank, cs.pp = cs.users, u.pp
+				}
+				countryRank = cs.rank
+			}
+			if cfg.PPHistoryStore == "table" {
+				opUpsert(ctx, "users_pp_history",
+					[]string{"user_id", "mode", "relax", "date", "pp", "global_rank", "country_rank"},
+					[]string{"pp", "global_rank", "country_rank"},
+					u.id, mode, relaxInt, date, u.pp, globalRank, countryRank)
+				continue
+			}
+
+			key := ppHistoryKey(u.id, mode, relax)
+			score := strconv.FormatInt(day.Unix(), 10)
+			z := redis.Z{
+				Score:  float64(day.Unix()),
+				Member: fmt.Sprintf("%s:%d:%d:%d", date, u.pp, globalRank, countryRank),
+			}
+			if pipe == nil {
+				pipe = r.Pipeline()
+			}
+			redisWrite(ctx, func() error {
+				return pipe.ZRemRangeByScore(key, score, score).Err()
+			}, "ZREMRANGEBYSCORE", key, score, score)
+			redisWrite(ctx, func() error {
+				return pipe.ZAdd(key, z).Err()
+			}, "ZADD", key, z.Score, z.Member)
+			if cutoff != "" {
+				redisWrite(ctx, func() error {
+					return pipe.ZRemRangeByScore(key, "-inf", cutoff).Err()
+				}, "ZREMRANGEBYSCORE", key, "-inf", cutoff)
+			}
+			pending++
+			if pending == ppHistoryPipelineSize {
+				flush()
+			}
+		}
+		flush()
+		logFor(ctx).with("mode", modeToString(mode), "relax", relax, "users", len(modeUsers)).debugf("saved the snapshots")
+	}
+	return nil
+}
+
+// ppHistoryPipelineSize is the number of users whose snapshots are sent to
+// redis together.
+const ppHistoryPipelineSize = 1000
+
+// readPPHistory returns the snapshots of a user, from the oldest. mode is -1
+// for every mode, and relax nil for both classic and relax.
+func readPPHistory(userID, mode int, relax *bool) ([]ppSnapshot, error) {
+	var history []ppSnapshot
+	if c.PPHistoryStore == "table" {
+		q := "SELECT DATE_FORMAT(date, '%Y-%m-%d'), mode, relax, pp, global_rank, country_rank FROM users_pp_history WHERE user_id = ?"
+		args := []interface{}{userID}
+		if mode >= 0 {
+			q += " AND mode = ?"
+			args = append(args, mode)
+		}
+		if relax != nil {
+			q += " AND relax = ?"
+			args = append(args, *relax)
+		}
+		rows, err := db.Query(q+" ORDER BY date, relax, mode", args...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var s ppSnapshot
+			var m int
+			if err := rows.Scan(&s.Date, &m, &s.Relax, &s.PP, &s.GlobalRank, &s.CountryRank); err != nil {
+				return nil, err
+			}
+			s.Mode = modeToString(m)
+			history = append(history, s)
+		}
+		return history, rows.Err()
+	}
+
+	for _, rx := range [...]bool{false, true} {
+		if relax != nil && *relax != rx {
+			continue
+		}
+		for m := range modes {
+			if mode >= 0 && mode != m {
+				continue
+			}
+			members, err := r.ZRange(ppHistoryKey(userID, m, rx), 0, -1).Result()
+			if err != nil {
+				return nil, err
+			}
+			for _, member := range members {
+				s := ppSnapshot{Mode: modes[m], Relax: rx}
+				if _, err := fmt.Sscanf(strings.Replace(member, ":", " ", -1), "%s %d %d %d",
+					&s.Date, &s.PP, &s.GlobalRank, &s.CountryRank); err != nil {
+					return nil, fmt.Errorf("invalid snapshot %q: %v", member, err)
+				}
+				history = append(history, s)
+			}
+		}
+	}
+	sort.SliceStable(history, func(i, j int) bool { return history[i].Date < history[j].Date })
+	return history, nil
+}
+
+// parsePPHistoryFilters parses the mode (a name, or empty for every mode)
+// and the relax flag (classic, relax, or empty for both) used to filter the
+// history of a user.
+func parsePPHistoryFilters(modeName, relaxName string) (int, *bool, error) {
+	mode := -1
+	if modeName != "" {
+		if mode = modeFromString(strings.ToLower(modeName)); mode < 0 {
+			return 0, nil, fmt.Errorf("unknown mode %q, must be std, taiko, ctb or mania", modeName)
+		}
+	}
+	var relax *bool
+	switch strings.ToLower(relaxName) {
+	case "":
+	case "classic", "0", "false":
+		relax = new(bool)
+	case "relax", "1", "true":
+		relax = new(bool)
+		*relax = true
+	default:
+		return 0, nil, fmt.Errorf("unknown value %q, must be classic or relax", relaxName)
+	}
+	return mode, relax, nil
+}
+
+// cmdPPHistory handles the pp-history command, which exports the history of a
+// user as CSV.
+func cmdPPHistory(args []string) int {
+	if len(args) < 1 || len(args) > 3 {
+		color.Red("Usage: pp-history <user id> [mode] [classic|relax]")
+		return exitConfig
+	}
+	userID, err := strconv.Atoi(args[0])
+	if err != nil {
+		color.Red("%q is not a user id.", args[0])
+		return exitConfig
+	}
+	args = append(args, "", "")
+	mode, relax, err := parsePPHistoryFilters(args[1], args[2])
+	if err != nil {
+		color.Red("%v.", err)
+		return exitConfig
+	}
+	if !loadConfig() {
+		return exitConfig
+	}
+	if err := checkPPHistoryStore(c.PPHistoryStore); err != nil {
+		color.Red("PPHistoryStore is invalid: %v.", err)
+		return exitConfig
+	}
+	db, err = sqlx.Open("mysql", c.DSN)
+	if err != nil {
+		color.Red("couldn't start MySQL connection: %v.", err)
+		return exitConfig
+	}
+	defer db.Close()
+	r = redis.NewClient(&redis.Options{
+		Addr:     c.RedisAddr,
+		Password: c.RedisPassword,
+	})
+	defer r.Close()
+
+	history, err := readPPHistory(userID, mode, relax)
+	if err != nil {
+		color.Red("couldn't get the history: %v.", err)
+		return exitConnection
+	}
+	w := csv.NewWriter(os.Stdout)
+	w.Write([]string{"date", "mode", "relax", "pp", "global_rank", "country_rank"})
+	for _, s := range history {
+		w.Write([]string{
+			s.Date, s.Mode, strconv.FormatBool(s.Relax), strconv.FormatInt(s.PP, 10),
+			strconv.Itoa(s.GlobalRank), strconv.Itoa(s.CountryRank),
+		})
+	}
+	w.Flush()
+	return exitOK
+}
+
+// apiPPHistory handles GET /pp-history/<user id>?mode=std&relax=classic.
+func apiPPHistory(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	userID, err := strconv.Atoi(strings.TrimPrefix(req.URL.Path, "/pp-history/"))
+	if err != nil {
+		apiError(w, http.StatusNotFound, "not found")
+		return
+	}
+	q := req.URL.Query()
+	mode, relax, err := parsePPHistoryFilters(q.Get("mode"), q.Get("relax"))
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	history, err := readPPHistory(userID, mode, relax)
+	if err != nil {
+		apiLog.errorf("couldn't get the pp history: %v", err)
+		apiError(w, http.StatusInternalServerError, "couldn't get the history")
+		return
+	}
+	if history == nil {
+		history = []ppSnapshot{}
+	}
+	apiJSON(w, http.StatusOK, history)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ppWeighting is how CalculatePP adds up the pp of the scores of a user, in a
+// mode, into their total pp.
+type ppWeighting interface {
+	// topN returns the number of best scores which count towards the total,
+	// or 0 if all of them do.
+	topN() int
+	// total returns the total pp of a user with the given best scores,
+	// sorted from the one giving the most pp, and the given number of scores
+	// giving pp, which may be more than len(best).
+	total(best []float64, scores int) float64
+}
+
+// decayWeighting is the usual weighting: the pp of the nth best score is
+// multiplied by decay^(n-1), and bonus pp may be awarded for the number of
+// scores.
+type decayWeighting struct {
+	decay float64
+	top   int
+	// round is each (round the pp of each score, and their weighted pp),
+	// total (round the total) or none.
+	round string
+	// bonus awards 416.6667 * (1 - 0.9994^n) pp for n scores, like the
+	// official server.
+	bonus bool
+}
+
+// defaultPPWeighting is the weighting used unless PPWeighting says otherwise.
+var defaultPPWeighting = decayWeighting{decay: 0.95, top: 500, round: "each"}
+
+func (w decayWeighting) topN() int { return w.top }
+
+func (w decayWeighting) total(best []float64, scores int) float64 {
+	var total float64
+	for i, pp := range best {
+		if w.round == "each" {
+			total += round(round(pp) * math.Pow(w.decay, float64(i)))
+		} else {
+			total += pp * math.Pow(w.decay, float64(i))
+		}
+	}
+	if w.bonus {
+		bonus := 416.6667 * (1 - math.Pow(0.9994, float64(scores)))
+		if w.round == "each" {
+			bonus = round(bonus)
+		}
+		total += bonus
+	}
+	if w.round == "total" {
+		total = round(total)
+	}
+	return total
+}
+
+// ppWeightings are the weightings of each mode, for classic ([0]) and relax
+// ([1]) scores.
+type ppWeightings [2][4]ppWeighting
+
+// parsePPWeighting parses the PPWeighting config option, a semicolon-separated
+// list of target:options. target is default, a mode (std, taiko, ctb, mania),
+// or a mode prefixed by relax_ (relax_std); options is a comma-separated list
+// of key=value, with the keys decay, top, round and bonus. The options of
+// default apply to every mode, and the ones of a mode to its relax scores as
+// well, unless they're changed.
+func parsePPWeighting(s string) (*ppWeightings, error) {
+	type target struct {
+		relax bool
+		mode  int // -1 for default
+	}
+	entries := make(map[target]string)
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q: expected target:options", entry)
+		}
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		t := target{mode: -1}
+		if name != "default" {
+			t.relax = strings.HasPrefix(name, "relax_")
+			t.mode = modeFromString(strings.TrimPrefix(name, "relax_"))
+			if t.mode < 0 {
+				return nil, fmt.Errorf("%q: unknown target %q, must be default, a mode or relax_ followed by a mode", entry, name)
+			}
+		}
+		entries[t] = parts[1]
+	}
+
+	base := defaultPPWeighting
+	if opts, ok := entries[target{mode: -1}]; ok {
+		if err := base.apply(opts); err != nil {
+			return nil, fmt.Errorf("default: %v", err)
+		}
+	}
+	var ws ppWeightings
+	for mode := 0; mode < 4; mode++ {
+		classic := base
+		if opts, ok := entries[target{mode: mode}]; ok {
+			if err := classic.apply(opts); err != nil {
+				return nil, fmt.Errorf("%s: %v", modeToString(mode), err)
+			}
+		}
+		relax := classic
+		if opts, ok := entries[target{relax: true, mode: mode}]; ok {
+			if err := relax.apply(opts); err != nil {
+				return nil, fmt.Errorf("relax_%s: %v", modeToString(mode), err)
+			}
+		}
+		ws[0][mode], ws[1][mode] = classic, relax
+	}
+	return &ws, nil
+}
+
+// apply changes w as specified by opts, a comma-separated list of key=value.
+func (w *decayWeighting) apply(opts string) error {
+	for _, opt := range strings.Split(opts, ",") {
+		opt = strings.TrimSpace(opt)
+		if opt == "" {
+			continue
+		}
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("%q: expected key=value", opt)
+		}
+		key, value := strings.ToLower(strings.TrimSpace(kv[0])), strings.TrimSpace(kv[1])
+		var err error
+		switch key {
+		case "decay":
+			w.decay, err = strconv.ParseFloat(value, 64)
+			if err == nil && (w.decay <= 0 || w.decay > 1) {
+				err = fmt.Errorf("must be between 0 and 1")
+			}
+		case "top":
+			w.top, err = strconv.Atoi(value)
+			if err == nil && w.top < 0 {
+				err = fmt.Errorf("can't be negative")
+			}
+		case "round":
+			w.round = strings.ToLower(value)
+			if w.round != "each" && w.round != "total" && w.round != "none" {
+				err = fmt.Errorf("must be each, total or none")
+			}
+		case "bonus":
+			w.bonus, err = strconv.ParseBool(value)
+		default:
+			err = fmt.Errorf("unknown option, must be decay, top, round or bonus")
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestDefaultPPWeighting(t *testing.T) {
+	// 300 + round(251 * 0.95) + round(100 * 0.95^2)
+	if got := defaultPPWeighting.total([]float64{300.4, 250.6, 100.2}, 3); got != 628 {
+		t.Errorf("got %v, want 628", got)
+	}
+
+	// the total CalculatePP used to compute, before PPWeighting
+	r := rand.New(rand.NewSource(1337))
+	best := make([]float64, 500)
+	for i := range best {
+		best[i] = float64(len(best)-i) + r.Float64()
+	}
+	var want float64
+	for i, pp := range best {
+		want += round(round(pp) * math.Pow(0.95, float64(i)))
+	}
+	if got := defaultPPWeighting.total(best, 1000); got != want {
+		t.Errorf("got %v for 500 scores, want %v", got, want)
+	}
+}
+
+func TestDecayWeighting(t *testing.T) {
+	tests := []struct {
+		name   string
+		w      decayWeighting
+		best   []float64
+		scores int
+		want   float64
+	}{
+		{"decay", decayWeighting{decay: 0.5, round: "none"}, []float64{100, 100, 100}, 3, 175},
+		{"no decay", decayWeighting{decay: 1, round: "none"}, []float64{100, 100, 100}, 3, 300},
+		{"round each", decayWeighting{decay: 1, round: "each"}, []float64{10.4, 10.4}, 2, 20},
+		{"round total", decayWeighting{decay: 1, round: "total"}, []float64{10.4, 10.4}, 2, 21},
+		{"round none", decayWeighting{decay: 1, round: "none"}, []float64{10.4, 10.4}, 2, 20.8},
+		// 416.6667 * (1 - 0.9994^100)
+		{"bonus", decayWeighting{decay: 0.95, round: "none", bonus: true}, nil, 100, 24.271845611926828},
+		// the scores which aren't in best still count towards the bonus
+		{"bonus of 1000 scores", decayWeighting{decay: 1, round: "none", bonus: true}, []float64{100}, 1000, 100 + 188.03634030765238},
+		{"bonus rounded with each", decayWeighting{decay: 0.95, round: "each", bonus: true}, nil, 100, 24},
+		{"bonus rounded with total", decayWeighting{decay: 1, round: "total", bonus: true}, []float64{0.4}, 100, 25},
+	}
+	for _, test := range tests {
+		if got := test.w.total(test.best, test.scores); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDecayWeightingTop(t *testing.T) {
+	ws, err := parsePPWeighting("default:top=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := ws[0][0]
+	if w.topN() != 2 {
+		t.Fatalf("got top %d, want 2", w.topN())
+	}
+	top := topPP{n: w.topN()}
+	for _, pp := range []float64{10, 30, 20} {
+		top.add(pp)
+	}
+	// 30 + 20 * 0.95: the third score doesn't count
+	if got := w.total(top.best(), top.count); got != 49 {
+		t.Errorf("got %v, want 49", got)
+	}
+}
+
+func TestParsePPWeighting(t *testing.T) {
+	ws, err := parsePPWeighting(" default: decay=0.9 ; taiko:top=100;RELAX_std:round=none, bonus=true;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		relax, mode int
+		want        decayWeighting
+	}{
+		{0, 0, decayWeighting{decay: 0.9, top: 500, round: "each"}},
+		{1, 0, decayWeighting{decay: 0.9, top: 500, round: "none", bonus: true}},
+		{0, 1, decayWeighting{decay: 0.9, top: 100, round: "each"}},
+		// the options of the mode apply to its relax scores
+		{1, 1, decayWeighting{decay: 0.9, top: 100, round: "each"}},
+		{0, 3, decayWeighting{decay: 0.9, top: 500, round: "each"}},
+		{1, 3, decayWeighting{decay: 0.9, top: 500, round: "each"}},
+	}
+	for _, test := range tests {
+		if got := ws[test.relax][test.mode]; got != test.want {
+			t.Errorf("relax %d, %s: got %+v, want %+v", test.relax, modeToString(test.mode), got, test.want)
+		}
+	}
+
+	ws, err = parsePPWeighting("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for relax := range ws {
+		for mode := range ws[relax] {
+			if ws[relax][mode] != defaultPPWeighting {
+				t.Errorf("relax %d, %s: got %+v without PPWeighting, want the default", relax, modeToString(mode), ws[relax][mode])
+			}
+		}
+	}
+}
+
+func TestParsePPWeightingErrors(t *testing.T) {
+	tests := []struct {
+		s, err string
+	}{
+		{"std", "expected target:options"},
+		{"osu:top=1", "unknown target"},
+		{"relax_ctb:top", "relax_ctb: \"top\": expected key=value"},
+		{"default:top=-1", "default: top: can't be negative"},
+		{"std:top=x", "std: top"},
+		{"std:decay=0", "std: decay: must be between 0 and 1"},
+		{"std:decay=1.5", "std: decay: must be between 0 and 1"},
+		{"mania:round=up", "mania: round: must be each, total or none"},
+		{"taiko:bonus=maybe", "taiko: bonus"},
+		{"std:weight=1", "std: weight: unknown option"},
+	}
+	for _, test := range tests {
+		_, err := parsePPWeighting(test.s)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%q: got error %v, want %q", test.s, err, test.err)
+		}
+	}
+}
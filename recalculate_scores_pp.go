@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	registerJob(&basicJob{
+		name:        "RecalculateScoresPP",
+		description: "Re-calculates the pp of each score from the .osu files in BeatmapFolder.",
+		enabled:     func(c *config) bool { return c.RecalculateScoresPP },
+		run:         opRecalculateScoresPP,
+	})
+}
+
+// parseIDList parses a comma-separated list of IDs.
+func parseIDList(s string) ([]int, error) {
+	var ids []int
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, err := strconv.Atoi(part)
+		if err != nil || id < 0 {
+			return nil, fmt.Errorf("%q is not an ID", part)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// parseModeList parses a comma-separated list of mode names into their IDs.
+func parseModeList(s string) ([]int, error) {
+	var ids []int
+	for _, part := range strings.Split(s, ",") {
+		part = strings.ToLower(strings.TrimSpace(part))
+		if part == "" {
+			continue
+		}
+		mode := modeFromString(part)
+		if mode < 0 {
+			return nil, fmt.Errorf("unknown mode %q, must be std, taiko, ctb or mania", part)
+		}
+		ids = append(ids, mode)
+	}
+	return ids, nil
+}
+
+// parseRecalculatePPModes parses RecalculatePPModes, which can't contain ctb
+// as the calculator doesn't support it.
+func parseRecalculatePPModes(s string) ([]int, error) {
+	modes, err := parseModeList(s)
+	if err != nil {
+		return nil, err
+	}
+	for _, mode := range modes {
+		if mode == 2 {
+			return nil, fmt.Errorf("ctb is not supported")
+		}
+	}
+	return modes, nil
+}
+
+// recalculatePPWhere returns the condition on the scores which
+// RecalculateScoresPP recomputes, from the RecalculatePP* filters.
+func recalculatePPWhere(cfg *config) (string, error) {
+	// the pp of the relax scores is computed differently, which the
+	// calculator doesn't do: they're left untouched
+	where := "scores.completed = 3 AND scores.is_relax = 0 AND beatmaps.ranked >= 2 AND beatmaps.disable_pp = 0"
+	filters := []struct {
+		option, col, value string
+		parse              func(string) ([]int, error)
+	}{
+		{"RecalculatePPBeatmaps", "beatmaps.beatmap_id", cfg.RecalculatePPBeatmaps, parseIDList},
+		{"RecalculatePPUsers", "scores.userid", cfg.RecalculatePPUsers, parseIDList},
+		{"RecalculatePPModes", "scores.play_mode", cfg.RecalculatePPModes, parseRecalculatePPModes},
+	}
+	for _, f := range filters {
+		ids, err := f.parse(f.value)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", f.option, err)
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		// the IDs are integers, so they can be put in the query
+		strs := make([]string, len(ids))
+		for i, id := range ids {
+			strs[i] = strconv.Itoa(id)
+		}
+		where += " AND " + f.col + " IN (" + strings.Join(strs, ", ") + ")"
+	}
+	return where, nil
+}
+
+// beatmapCacheSize is the largest number of beatmaps kept parsed by
+// RecalculateScoresPP. The scores are read ordered by id, so the same
+// beatmaps come back often, but not in order.
+const beatmapCacheSize = 2000
+
+type cachedBeatmap struct {
+	b   *osuBeatmap
+	err error
+	// logged is set once err has been logged.
+	logged bool
+	// unsupported are the modes in which the scores on the beatmap can't
+	// be computed, which have been logged.
+	unsupported map[int]bool
+	// difficulties are the difficulties computed for each mode and
+	// combination of the mods changing it.
+	difficulties map[[2]int]beatmapDifficulty
+}
+
+// beatmapCache parses the .osu files of the beatmaps, named <beatmap id>.osu,
+// and keeps them with the difficulties computed, or the error which
+// happened, so that each beatmap is only read once.
+type beatmapCache struct {
+	folder   string
+	beatmaps map[string]*cachedBeatmap
+}
+
+func (bc *beatmapCache) get(beatmapID int, md5sum string) *cachedBeatmap {
+	if cb := bc.beatmaps[md5sum]; cb != nil {
+		return cb
+	}
+	if len(bc.beatmaps) >= beatmapCacheSize {
+		bc.beatmaps = make(map[string]*cachedBeatmap, beatmapCacheSize)
+	}
+	cb := &cachedBeatmap{
+		difficulties: make(map[[2]int]beatmapDifficulty),
+		unsupported:  make(map[int]bool),
+	}
+	cb.b, cb.err = bc.load(beatmapID, md5sum)
+	bc.beatmaps[md5sum] = cb
+	return cb
+}
+
+func (bc *beatmapCache) load(beatmapID int, md5sum string) (*osuBeatmap, error) {
+	data, err := ioutil.ReadFile(filepath.Join(bc.folder, strconv.Itoa(beatmapID)+".osu"))
+	if err != nil {
+		return nil, err
+	}
+	// the file may be of an older version of the beatmap
+	sum := md5.Sum(data)
+	if hex.EncodeToString(sum[:]) != md5sum {
+		return nil, fmt.Errorf("the file is not the version of the beatmap with md5 %s", md5sum)
+	}
+	return parseOsuFile(bytes.NewReader(data))
+}
+
+// difficulty returns the difficulty of the beatmap played in mode with mods.
+func (cb *cachedBeatmap) difficulty(mode, mods int) (beatmapDifficulty, error) {
+	key := [2]int{mode, mods & modsDifficulty}
+	if d, ok := cb.difficulties[key]; ok {
+		return d, nil
+	}
+	d, err := scoreDifficulty(cb.b, mode, mods)
+	if err != nil {
+		return d, err
+	}
+	cb.difficulties[key] = d
+	return d, nil
+}
+
+// ppChange is a change of the pp of a score found by RecalculateScoresPP.
+type ppChange struct {
+	scoreID   int64
+	beatmapID int
+	old, new  float64
+}
+
+func (pc ppChange) diff() float64 { return math.Abs(pc.new - pc.old) }
+
+// largestPPChanges keeps the n largest changes of pp.
+type largestPPChanges struct {
+	n       int
+	changes []ppChange
+}
+
+func (lc *largestPPChanges) add(pc ppChange) {
+	i := sort.Search(len(lc.changes), func(i int) bool { return lc.changes[i].diff() < pc.diff() })
+	if i >= lc.n {
+		return
+	}
+	if len(lc.changes) < lc.n {
+		lc.changes = append(lc.changes, ppChange{})
+	}
+	copy(lc.changes[i+1:], lc.changes[i:])
+	lc.changes[i] = pc
+}
+
+func opRecalculateScoresPP(ctx context.Context) error {
+	cfg := configFromContext(ctx)
+	where, err := recalculatePPWhere(cfg)
+	if err != nil {
+		return err
+	}
+	if !cfg.RecalculatePPWrite {
+		logFor(ctx).infof("RecalculatePPWrite is not set: only reporting the changes")
+	}
+
+	cp := newCheckpointer(ctx, where)
+	cursor, err := cp.resume(nil)
+	if err != nil {
+		return err
+	}
+
+	rows := newScoreScanner(ctx, scanQuery{
+		cols: "scores.userid, beatmaps.beatmap_id, scores.beatmap_md5, scores.play_mode, scores.mods, scores.score, " +
+			"scores.max_combo, scores.300_count, scores.100_count, scores.50_count, scores.misses_count, scores.pp",
+		from:  "scores JOIN beatmaps USING(beatmap_md5)",
+		where: where,
+	}, cursor)
+	defer rows.Close()
+	cache := &beatmapCache{folder: cfg.BeatmapFolder, beatmaps: make(map[string]*cachedBeatmap)}
+	// the users whose scores were updated. CalculatePP, which runs after this
+	// job, must see the new pp, and recompute the pp of these users even
+	// with IncrementalPP
+	users := make(map[int]bool)
+	defer func() {
+		if len(users) > 0 {
+			waitOperations(ctx)
+			markPPDirty(ctx, users)
+		}
+	}()
+	var (
+		count, updated, skipped, tooLarge int
+		totalDiff                         float64
+		largest                           = largestPPChanges{n: 10}
+	)
+	for rows.Next() {
+		countRows(ctx, 1)
+		if count%100000 == 0 {
+			logFor(ctx).with("rows_processed", count, "updated", updated, "skipped", skipped).debugf("processed")
+		}
+		count++
+		var (
+			userID    int
+			beatmapID int
+			md5sum    string
+			s         scoreHits
+			oldPP     *float64
+		)
+		err := rows.Scan(&userID, &beatmapID, &md5sum, &s.mode, &s.mods, &s.score,
+			&s.maxCombo, &s.count300, &s.count100, &s.count50, &s.misses, &oldPP)
+		if err != nil {
+			queryError(ctx, err, rows.Query())
+			continue
+		}
+		cb := cache.get(beatmapID, md5sum)
+		if cb.err != nil {
+			if !cb.logged {
+				l := logFor(ctx).with("beatmap_id", beatmapID)
+				if os.IsNotExist(cb.err) {
+					l.debugf("no .osu file, skipping its scores")
+				} else {
+					l.warnf("can't read the .osu file, skipping its scores: %v", cb.err)
+				}
+				cb.logged = true
+			}
+			skipped++
+			continue
+		}
+		d, err := cb.difficulty(s.mode, s.mods)
+		if err != nil {
+			if !cb.unsupported[s.mode] {
+				logFor(ctx).with("beatmap_id", beatmapID, "mode", modeToString(s.mode)).infof("skipping the scores: %v", err)
+				cb.unsupported[s.mode] = true
+			}
+			skipped++
+			continue
+		}
+		pp := scorePP(cb.b, d, s)
+		if oldPP == nil || math.Abs(pp-*oldPP) >= 0.001 {
+			pc := ppChange{scoreID: rows.Cursor(), beatmapID: beatmapID, new: pp}
+			if oldPP != nil {
+				pc.old = *oldPP
+			}
+			l := logFor(ctx).with("score_id", pc.scoreID, "beatmap_id", beatmapID, "old_pp", pc.old, "new_pp", pp)
+			// the calculator is approximate: a large change is more likely
+			// to be an error of the calculator than of the old pp
+			if oldPP != nil && cfg.RecalculatePPMaxChange > 0 && pc.diff() > float64(cfg.RecalculatePPMaxChange) {
+				l.warnf("the pp would change by more than RecalculatePPMaxChange, skipping the score")
+				tooLarge++
+				cp.maybeSave(rows.Cursor(), nil)
+				continue
+			}
+			l.debugf("pp changed")
+			largest.add(pc)
+			totalDiff += pc.diff()
+			if cfg.RecalculatePPWrite {
+				opUpdate(ctx, "scores", "id", pc.scoreID, []string{"pp"}, pp)
+				users[userID] = true
+			}
+			updated++
+		}
+		cp.maybeSave(rows.Cursor(), nil)
+	}
+	if err := rows.Err(); err != nil {
+		queryError(ctx, err, rows.Query())
+		cp.save(rows.Cursor(), nil)
+		return err
+	}
+
+	for _, pc := range largest.changes {
+		logFor(ctx).with("score_id", pc.scoreID, "beatmap_id", pc.beatmapID, "old_pp", pc.old, "new_pp", pc.new).infof("one of the largest changes")
+	}
+	l := logFor(ctx).with("scores", count, "changed", updated, "skipped", skipped, "too_large", tooLarge)
+	if updated > 0 {
+		l = l.with("mean_change", totalDiff/float64(updated))
+	}
+	cp.clear()
+	if !cfg.RecalculatePPWrite {
+		l.infof("done! Nothing was written: set RecalculatePPWrite to update the pp of the scores")
+		return nil
+	}
+	l.infof("done!")
+	return nil
+}
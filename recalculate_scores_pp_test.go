@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRecalculatePPWhere(t *testing.T) {
+	tests := []struct {
+		beatmaps, users, modes string
+		want                   string
+		err                    string
+	}{
+		{want: "scores.completed = 3 AND scores.is_relax = 0 AND beatmaps.ranked >= 2 AND beatmaps.disable_pp = 0"},
+		{beatmaps: "75, 129891", users: "1000", modes: "std,Mania",
+			want: " AND beatmaps.beatmap_id IN (75, 129891) AND scores.userid IN (1000) AND scores.play_mode IN (0, 3)"},
+		{users: "1000,x", err: "RecalculatePPUsers"},
+		{beatmaps: "-1", err: "RecalculatePPBeatmaps"},
+		{modes: "osu", err: "RecalculatePPModes"},
+		{modes: "std,ctb", err: "RecalculatePPModes: ctb is not supported"},
+	}
+	for _, test := range tests {
+		cfg := &config{RecalculatePPBeatmaps: test.beatmaps, RecalculatePPUsers: test.users, RecalculatePPModes: test.modes}
+		where, err := recalculatePPWhere(cfg)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%+v: got error %v, want %q", test, err, test.err)
+			}
+			continue
+		}
+		if err != nil || !strings.HasSuffix(where, test.want) {
+			t.Errorf("%+v: got %q (%v), want it to end with %q", test, where, err, test.want)
+		}
+	}
+}
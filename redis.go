@@ -1,40 +1,57 @@
 package main
 
 import (
+	"context"
 	"math"
 	"strings"
 	"time"
 
-	"github.com/fatih/color"
 	redis "gopkg.in/redis.v5"
 )
 
-func opPopulateRedis() {
-	defer wg.Done()
+func init() {
+	registerJob(&basicJob{
+		name:        "PopulateRedis",
+		description: "Rebuilds the leaderboards and the country list in redis.",
+		enabled:     func(c *config) bool { return c.PopulateRedis },
+		deps:        []string{"CalculatePP"},
+		run:         opPopulateRedis,
+	})
+}
 
+func opPopulateRedis(ctx context.Context) error {
 	s, err := r.Keys("ripple:leaderboard:*").Result()
 	if err != nil {
-		color.Red("> PopulateRedis: %v", err)
-		return
+		logFor(ctx).errorf("%v", err)
+		return err
 	}
 
 	if len(s) > 0 {
-		err = r.Eval("return redis.call('del', unpack(redis.call('keys', 'ripple:leaderboard:*')))", nil).Err()
+		err = redisWrite(ctx, func() error {
+			return r.Eval("return redis.call('del', unpack(redis.call('keys', 'ripple:leaderboard:*')))", nil).Err()
+		}, "DEL", "ripple:leaderboard:*")
 		if err != nil {
-			color.Red("> PopulateRedis: %v", err)
-			return
+			logFor(ctx).errorf("%v", err)
+			return err
 		}
 	}
 
-	r.Del("hanayo:country_list")
+	redisWrite(ctx, func() error {
+		return r.Del("hanayo:country_list").Err()
+	}, "DEL", "hanayo:country_list")
 
-	populateLeaderboard(false)
-	populateLeaderboard(true)
+	if err := populateLeaderboard(ctx, false); err != nil {
+		return err
+	}
+	if err := populateLeaderboard(ctx, true); err != nil {
+		return err
+	}
 
-	color.Green("> PopulateRedis: done!")
+	logFor(ctx).infof("done!")
+	return nil
 }
 
-func populateLeaderboard(relax bool) {
+func populateLeaderboard(ctx context.Context, relax bool) error {
 	var table string
 	var suffix string
 	if relax {
@@ -52,10 +69,10 @@ SELECT
 	users.latest_activity
 FROM ` + table + ` AS users_stats JOIN users_stats AS full_stats USING(id) INNER JOIN users USING(id) WHERE is_public = 1`
 
-	rows, err := db.Query(initQuery)
+	rows, err := db.QueryContext(ctx, initQuery)
 	if err != nil {
-		queryError(err, initQuery)
-		return
+		queryError(ctx, err, initQuery)
+		return err
 	}
 
 	currentSeconds := time.Now().Unix()
@@ -68,6 +85,7 @@ FROM ` + table + ` AS users_stats JOIN users_stats AS full_stats USING(id) INNER
 		latestActivity int64
 	)
 	for rows.Next() {
+		countRows(ctx, 1)
 		err = rows.Scan(
 			&uid, &country, &pp[0],
 			&pp[1], &pp[2], &pp[3],
@@ -75,32 +93,39 @@ FROM ` + table + ` AS users_stats JOIN users_stats AS full_stats USING(id) INNER
 			&latestActivity,
 		)
 		if err != nil {
-			queryError(err, initQuery)
+			queryError(ctx, err, initQuery)
 			continue
 		}
 
 		country = strings.ToLower(country)
 
 		if country != "xx" && country != "" {
-			r.ZIncrBy("hanayo:country_list", 1, country)
+			redisWrite(ctx, func() error {
+				return r.ZIncrBy("hanayo:country_list", 1, country).Err()
+			}, "ZINCRBY", "hanayo:country_list", 1, country)
 		}
 
 		for k, v := range pp {
 			if isInactive(float64(currentSeconds-latestActivity), playcount[k]) {
 				continue
 			}
-			r.ZAdd("ripple:leaderboard:"+modes[k]+suffix, redis.Z{
+			z := redis.Z{
 				Member: uid,
 				Score:  float64(v),
-			})
+			}
+			key := "ripple:leaderboard:" + modes[k] + suffix
+			redisWrite(ctx, func() error {
+				return r.ZAdd(key, z).Err()
+			}, "ZADD", key, z.Score, uid)
 			if country != "xx" && country != "" {
-				r.ZAdd("ripple:leaderboard:"+modes[k]+":"+country+suffix, redis.Z{
-					Member: uid,
-					Score:  float64(v),
-				})
+				key := "ripple:leaderboard:" + modes[k] + ":" + country + suffix
+				redisWrite(ctx, func() error {
+					return r.ZAdd(key, z).Err()
+				}, "ZADD", key, z.Score, uid)
 			}
 		}
 	}
+	return nil
 }
 
 func isInactive(secondsInactive float64, playcount int) bool {
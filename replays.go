@@ -1,18 +1,24 @@
 package main
 
 import (
+	"context"
 	"os"
 	"strconv"
 	"strings"
-
-	"github.com/fatih/color"
 )
 
-func opCleanReplays() {
-	defer wg.Done()
+func init() {
+	registerJob(&basicJob{
+		name:        "CleanReplays",
+		description: "Deletes the replays of scores which are not completed = 3 from the replay folder.",
+		enabled:     func(c *config) bool { return c.CleanReplays },
+		run:         opCleanReplays,
+	})
+}
 
+func opCleanReplays(ctx context.Context) error {
 	if c.ReplayFolder == "" {
-		return
+		return nil
 	}
 
 	// we're using os.Open instead of ioutil.Readdir
@@ -20,15 +26,15 @@ func opCleanReplays() {
 	// memory)
 	dir, err := os.Open(c.ReplayFolder)
 	if err != nil {
-		color.Red("> CleanReplays: can't read dir %v", err)
-		return
+		logFor(ctx).errorf("can't read dir %v", err)
+		return err
 	}
 
 	names, err := dir.Readdirnames(-1)
 	dir.Close()
 	if err != nil {
-		color.Red("> CleanReplays: can't read names of dir %v", err)
-		return
+		logFor(ctx).errorf("can't read names of dir %v", err)
+		return err
 	}
 
 	repsFolder := replaysToIntSlice(names)
@@ -36,11 +42,12 @@ func opCleanReplays() {
 	// get ids of all scores in database
 	var repsDB []int
 	const scoresQuery = "SELECT id FROM scores WHERE completed = 3"
-	err = db.Select(&repsDB, scoresQuery)
+	err = db.SelectContext(ctx, &repsDB, scoresQuery)
 	if err != nil {
-		queryError(err, scoresQuery)
-		return
+		queryError(ctx, err, scoresQuery)
+		return err
 	}
+	countRows(ctx, len(repsDB))
 
 	// remove from repsFolder all replays
 	for _, i := range repsDB {
@@ -54,13 +61,17 @@ func opCleanReplays() {
 	}
 
 	for _, r := range repsFolder {
-		err = os.Remove(c.ReplayFolder + "/replay_" + strconv.Itoa(r) + ".osr")
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		err = removeFile(ctx, c.ReplayFolder+"/replay_"+strconv.Itoa(r)+".osr")
 		if err != nil {
-			color.Red("> CleanReplays: %s: %v", r, err)
+			logFor(ctx).errorf("%d: %v", r, err)
 		}
 	}
 
-	color.Green("> CleanReplays: done!")
+	logFor(ctx).infof("done!")
+	return nil
 }
 
 func replaysToIntSlice(replays []string) []int {
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// readDB is the database the jobs read their data from in bulk: the replica
+// at ReadDSN if it's set, or else db. The writes always go to db.
+//
+// The jobs reading what another job of the same run has just written, such
+// as PopulateRedis, and the ones deleting files which aren't in the database,
+// such as CleanReplays, keep reading from db, as the replica may not have
+// caught up yet. The others read through readDBFor, which does the same when
+// one of their dependencies wrote in the same run.
+var readDB *sqlx.DB
+
+// jobWrites holds, for each job which has written to the database, the ID of
+// the last run in which it did.
+var jobWrites = struct {
+	sync.Mutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+// recordWrites records that jr has written to the database, once its
+// operations have been executed.
+func recordWrites(jr *jobRun) {
+	if atomic.LoadInt64(&jr.opsExecuted) == 0 {
+		return
+	}
+	jobWrites.Lock()
+	jobWrites.m[jr.job.Name()] = jr.runID
+	jobWrites.Unlock()
+}
+
+// readDBFor returns the database the job running with ctx must read from:
+// db if one of its dependencies wrote in the same run, as the replica may not
+// have its writes yet, or else readDB.
+func readDBFor(ctx context.Context) *sqlx.DB {
+	jr := jobRunFromContext(ctx)
+	if readDB == db || jr == nil {
+		return readDB
+	}
+	jobWrites.Lock()
+	defer jobWrites.Unlock()
+	for _, dep := range jr.job.Dependencies() {
+		if runID, ok := jobWrites.m[dep]; ok && runID == jr.runID {
+			return db
+		}
+	}
+	return readDB
+}
+
+// openReadDB connects to ReadDSN, and checks that the replica is no more than
+// MaxReadLag seconds behind. If ReadDSN is empty, readDB is set to db.
+func openReadDB() error {
+	if c.ReadDSN == "" {
+		readDB = db
+		return nil
+	}
+	var err error
+	readDB, err = sqlx.Open("mysql", c.ReadDSN)
+	if err != nil {
+		return err
+	}
+	if err := readDB.Ping(); err != nil {
+		readDB.Close()
+		return err
+	}
+	if c.MaxReadLag > 0 {
+		lag, err := replicationLag(readDB)
+		if err != nil {
+			readDB.Close()
+			return fmt.Errorf("couldn't get the replication lag: %v", err)
+		}
+		if lag > c.MaxReadLag {
+			readDB.Close()
+			return fmt.Errorf("the replica is %d seconds behind, more than MaxReadLag (%d)", lag, c.MaxReadLag)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func TestReadDBFor(t *testing.T) {
+	oldDB, oldReadDB := db, readDB
+	defer func() { db, readDB = oldDB, oldReadDB }()
+	db, readDB = sqlx.NewDb(&sql.DB{}, "mysql"), sqlx.NewDb(&sql.DB{}, "mysql")
+
+	dep := &basicJob{name: "testReadDBForDep"}
+	j := &basicJob{name: "testReadDBFor", deps: []string{dep.name}}
+	ctx := withJobRun(context.Background(), &jobRun{job: j, runID: "2"})
+	if got := readDBFor(ctx); got != readDB {
+		t.Error("read from the primary, without writes of the dependencies")
+	}
+	recordWrites(&jobRun{job: dep, runID: "1", opsExecuted: 1})
+	if got := readDBFor(ctx); got != readDB {
+		t.Error("read from the primary, with writes of the dependencies in another run")
+	}
+	recordWrites(&jobRun{job: dep, runID: "2"})
+	if got := readDBFor(ctx); got != readDB {
+		t.Error("read from the primary, without writes of the dependencies in the run")
+	}
+	recordWrites(&jobRun{job: dep, runID: "2", opsExecuted: 1})
+	if got := readDBFor(ctx); got != db {
+		t.Error("read from the replica, with writes of the dependencies in the run")
+	}
+	if got := readDBFor(context.Background()); got != readDB {
+		t.Error("read from the primary outside of a job")
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// retryableErrors are the MySQL error codes of the errors which may not
+// happen again if the query is retried.
+var retryableErrors = map[uint16]bool{
+	1040: true, // too many connections
+	1053: true, // server shutdown in progress
+	1205: true, // lock wait timeout exceeded
+	1213: true, // deadlock found when trying to get lock
+	1317: true, // query execution was interrupted
+	2006: true, // MySQL server has gone away
+	2013: true, // lost connection to MySQL server during query
+}
+
+// isRetryable reports whether a query which failed with err may succeed if it
+// is retried, as opposed to errors such as syntax errors or duplicate keys.
+func isRetryable(err error) bool {
+	switch err := err.(type) {
+	case *mysql.MySQLError:
+		return retryableErrors[err.Number]
+	case net.Error:
+		return true
+	}
+	return err == driver.ErrBadConn || err == mysql.ErrInvalidConn || err == io.ErrUnexpectedEOF
+}
+
+// maxRetryBackoff is the longest ripple-cron-go waits between two attempts.
+const maxRetryBackoff = 30 * time.Second
+
+// retryBackoff is the parsed RetryBackoff config option.
+var retryBackoff time.Duration
+
+// execWithRetry executes the query, retrying it up to Retries times if it
+// fails with a retryable error. The time between attempts starts at
+// RetryBackoff, and doubles after each attempt. job is the name of the job
+// the query belongs to. A write which lost its connection may have been
+// applied before being retried: the queued writes must be idempotent, which
+// they all are, as they set columns to values, or delete rows.
+func execWithRetry(l logger, job, query string, params ...interface{}) (sql.Result, error) {
+	var res sql.Result
+	err := withRetry(l.with("query", query), job, func() error {
+		var err error
+		res, err = db.Exec(query, params...)
+		return err
+	})
+	return res, err
+}
+
+// withRetry calls f until it succeeds, it fails with an error which is not
+// retryable, or it has been retried Retries times, like execWithRetry.
+func withRetry(l logger, job string, f func() error) error {
+	backoff := retryBackoff
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt > c.Retries || !isRetryable(err) {
+			return err
+		}
+		l.with("attempt", attempt, "error", err).warnf("retrying query in %s", backoff)
+		queryRetriesTotal.WithLabelValues(job).Inc()
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+// deadLetter is an operation which failed, saved to DeadLetterFile so that it
+// can be replayed later.
+type deadLetter struct {
+	Time   time.Time     `json:"time"`
+	RunID  string        `json:"run_id,omitempty"`
+	Job    string        `json:"job,omitempty"`
+	Query  string        `json:"query"`
+	Params []interface{} `json:"params"`
+	Error  string        `json:"error"`
+}
+
+var deadLetterMu sync.Mutex
+
+// deadLetterTimeLayout is the format of the time.Time parameters saved to
+// DeadLetterFile, which MySQL reads as DATETIME values.
+const deadLetterTimeLayout = "2006-01-02 15:04:05"
+
+// deadLetterLocation returns the time zone the time.Time parameters are sent
+// to MySQL in, which is the loc of DSN, UTC by default.
+func deadLetterLocation() *time.Location {
+	if cfg, err := mysql.ParseDSN(c.DSN); err == nil && cfg.Loc != nil {
+		return cfg.Loc
+	}
+	return time.UTC
+}
+
+// saveDeadLetters appends the given operations to DeadLetterFile.
+func saveDeadLetters(path string, letters ...deadLetter) error {
+	deadLetterMu.Lock()
+	defer deadLetterMu.Unlock()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	loc := deadLetterLocation()
+	for _, dl := range letters {
+		for i, p := range dl.Params {
+			switch p := p.(type) {
+			case []byte:
+				// it would be encoded as base64
+				dl.Params[i] = string(p)
+			case time.Time:
+				// it would be encoded in RFC 3339, which MySQL doesn't
+				// parse as a DATETIME when it's replayed
+				dl.Params[i] = p.In(loc).Format(deadLetterTimeLayout)
+			}
+		}
+		if err := enc.Encode(dl); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// deadLetterOperation saves op, which failed with err, to DeadLetterFile.
+func deadLetterOperation(l logger, op operation, err error) {
+	if c.DeadLetterFile == "" {
+		return
+	}
+	dl := deadLetter{
+		Time:   time.Now(),
+		Query:  op.query,
+		Params: append([]interface{}(nil), op.params...),
+		Error:  err.Error(),
+	}
+	if op.run != nil {
+		dl.RunID = op.run.runID
+		dl.Job = op.run.job.Name()
+	}
+	if err := saveDeadLetters(c.DeadLetterFile, dl); err != nil {
+		l.with("query", op.query, "params", op.params).errorf("couldn't save the failed operation to %s: %v", c.DeadLetterFile, err)
+	}
+}
+
+// readDeadLetters reads the operations saved in the file at path.
+func readDeadLetters(path string) ([]deadLetter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var letters []deadLetter
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 16*1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		dec := json.NewDecoder(bytes.NewReader(sc.Bytes()))
+		// keep integers as integers, rather than float64
+		dec.UseNumber()
+		var dl deadLetter
+		if err := dec.Decode(&dl); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		for i, p := range dl.Params {
+			if n, ok := p.(json.Number); ok {
+				if v, err := n.Int64(); err == nil {
+					dl.Params[i] = v
+				} else if v, err := n.Float64(); err == nil {
+					dl.Params[i] = v
+				}
+			}
+		}
+		letters = append(letters, dl)
+	}
+	return letters, sc.Err()
+}
+
+// cmdDeadLetter handles the dead-letter command.
+func cmdDeadLetter(args []string) int {
+	if len(args) != 1 || (args[0] != "replay" && args[0] != "list") {
+		baseLog.errorf("Usage: dead-letter list|replay")
+		return exitConfig
+	}
+	if !loadConfig() {
+		return exitConfig
+	}
+	if err := setupLogging(&c); err != nil {
+		baseLog.errorf("LogFormat or LogLevel is invalid: %v.", err)
+		return exitConfig
+	}
+	if c.DeadLetterFile == "" {
+		baseLog.errorf("DeadLetterFile is not set.")
+		return exitConfig
+	}
+	if args[0] == "list" {
+		letters, err := readDeadLetters(c.DeadLetterFile)
+		if err != nil && !os.IsNotExist(err) {
+			baseLog.errorf("couldn't read %s: %v.", c.DeadLetterFile, err)
+			return exitConfig
+		}
+		for _, dl := range letters {
+			baseLog.with("job", dl.Job, "run_id", dl.RunID, "time", dl.Time.Format(time.RFC3339),
+				"params", dl.Params, "error", dl.Error).infof("%s", dl.Query)
+		}
+		baseLog.infof("%d failed operations in %s", len(letters), c.DeadLetterFile)
+		return exitOK
+	}
+	return replayDeadLetters()
+}
+
+// replayDeadLetters executes again the operations in DeadLetterFile. The
+// file is renamed before being read, so that the operations failing in the
+// meantime are not lost; the ones which fail again are saved to it again.
+func replayDeadLetters() int {
+	var err error
+	retryBackoff, err = parseDuration(c.RetryBackoff)
+	if err != nil {
+		baseLog.errorf("RetryBackoff is invalid: %v.", err)
+		return exitConfig
+	}
+	db, err = sqlx.Open("mysql", c.DSN)
+	if err != nil {
+		baseLog.errorf("couldn't start MySQL connection: %v.", err)
+		return exitConfig
+	}
+	defer db.Close()
+	if err := db.Ping(); err != nil {
+		baseLog.errorf("couldn't connect to MySQL: %v.", err)
+		return exitConnection
+	}
+
+	if dryRun {
+		letters, err := readDeadLetters(c.DeadLetterFile)
+		if err != nil && !os.IsNotExist(err) {
+			baseLog.errorf("couldn't read %s: %v.", c.DeadLetterFile, err)
+			return exitConfig
+		}
+		for _, dl := range letters {
+			baseLog.with("job", dl.Job).infof("[dry-run] would execute %s | params: %v", dl.Query, dl.Params)
+		}
+		return exitOK
+	}
+
+	replaying := c.DeadLetterFile + ".replaying"
+	if _, err := os.Stat(replaying); os.IsNotExist(err) {
+		if err := os.Rename(c.DeadLetterFile, replaying); err != nil {
+			if os.IsNotExist(err) {
+				baseLog.infof("There are no failed operations to replay.")
+				return exitOK
+			}
+			baseLog.errorf("couldn't rename %s: %v.", c.DeadLetterFile, err)
+			return exitConfig
+		}
+	} else {
+		// a previous replay was stopped before it was done
+		baseLog.warnf("Resuming the replay of %s.", replaying)
+	}
+
+	letters, err := readDeadLetters(replaying)
+	if err != nil {
+		baseLog.errorf("couldn't read %s: %v.", replaying, err)
+		return exitConfig
+	}
+	var failed []deadLetter
+	for _, dl := range letters {
+		job := dl.Job
+		if job == "" {
+			job = "(none)"
+		}
+		l := baseLog.with("job", job)
+		if _, err := execWithRetry(l, job, dl.Query, dl.Params...); err != nil {
+			logQueryError(l, err, dl.Query, dl.Params...)
+			dl.Error = err.Error()
+			failed = append(failed, dl)
+		}
+	}
+	if len(failed) > 0 {
+		if err := saveDeadLetters(c.DeadLetterFile, failed...); err != nil {
+			baseLog.errorf("couldn't save the operations which failed again, which are still in %s: %v.", replaying, err)
+			return exitFailed
+		}
+	}
+	os.Remove(replaying)
+	baseLog.with("replayed", len(letters)-len(failed), "failed", len(failed)).infof("Replayed the failed operations")
+	if len(failed) > 0 {
+		return exitFailed
+	}
+	return exitOK
+}
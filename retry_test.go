@@ -0,0 +1,70 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err       error
+		retryable bool
+	}{
+		{&mysql.MySQLError{Number: 1213}, true},
+		{&mysql.MySQLError{Number: 1205}, true},
+		{&mysql.MySQLError{Number: 2013}, true},
+		{&net.OpError{Op: "read", Err: errors.New("connection reset by peer")}, true},
+		{driver.ErrBadConn, true},
+		{mysql.ErrInvalidConn, true},
+		{io.ErrUnexpectedEOF, true},
+		{&mysql.MySQLError{Number: 1062}, false},
+		{errors.New("syntax error"), false},
+	}
+	for _, test := range tests {
+		if got := isRetryable(test.err); got != test.retryable {
+			t.Errorf("isRetryable(%v) = %v, want %v", test.err, got, test.retryable)
+		}
+	}
+}
+
+func TestDeadLettersRoundTrip(t *testing.T) {
+	defer func(old string) { c.DSN = old }(c.DSN)
+	path := filepath.Join(t.TempDir(), "dead_letter.jsonl")
+	at := time.Date(2026, 10, 18, 12, 30, 5, 0, time.FixedZone("CEST", 2*60*60))
+	tests := []struct {
+		dsn  string
+		want string
+	}{
+		{"root@/ripple", "2026-10-18 10:30:05"},
+		{"root@/ripple?loc=Europe%2FRome", "2026-10-18 12:30:05"},
+	}
+	for i, test := range tests {
+		c.DSN = test.dsn
+		dl := deadLetter{
+			Query:  "DELETE FROM tokens WHERE private = 1 AND last_updated < ?",
+			Params: []interface{}{at, []byte("abc"), 42, 1.5, "x"},
+		}
+		if err := saveDeadLetters(path, dl); err != nil {
+			t.Fatal(err)
+		}
+		letters, err := readDeadLetters(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(letters) != i+1 {
+			t.Fatalf("read %d operations, want %d", len(letters), i+1)
+		}
+		want := []interface{}{test.want, "abc", int64(42), 1.5, "x"}
+		if got := letters[i].Params; !reflect.DeepEqual(got, want) {
+			t.Errorf("DSN %s: got params %#v, want %#v", test.dsn, got, want)
+		}
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// jobStatus is the outcome of a jobRun.
+type jobStatus string
+
+const (
+	statusRunning     jobStatus = "running"
+	statusFinished    jobStatus = "finished"
+	statusInterrupted jobStatus = "interrupted"
+	statusTimedOut    jobStatus = "timed out"
+	statusFailed      jobStatus = "failed"
+	statusNotStarted  jobStatus = "not started"
+	statusLocked      jobStatus = "locked by another instance"
+)
+
+// jobRun is a single run of a Job. It is stored in the context passed to
+// Job.Run, so that op and opSync can keep track of the operations queued by
+// the job.
+type jobRun struct {
+	job    Job
+	start  time.Time
+	end    time.Time
+	status jobStatus
+	// runID is the ID of the run the job is part of.
+	runID string
+	// log is the logger of the job, with the job and the run ID as fields.
+	log logger
+
+	// ops counts the operations queued by the job which have not been
+	// executed yet.
+	ops sync.WaitGroup
+	// rowsRead, rowsAffected, opsQueued, opsExecuted, opsFailed, opsDropped
+	// and errors must be accessed atomically. rowsAffected counts the rows
+	// changed by the operations, opsDropped counts the operations which were
+	// not queued because the run was interrupted, and errors counts every
+	// failed query, including the failed operations.
+	rowsRead     int64
+	rowsAffected int64
+	opsQueued    int64
+	opsExecuted  int64
+	opsFailed    int64
+	opsDropped   int64
+	errors       int64
+
+	// err is the error returned by Job.Run.
+	err          error
+	errorsMu     sync.Mutex
+	errorSamples []string
+}
+
+// maxErrorSamples is the number of errors kept by a jobRun.
+const maxErrorSamples = 5
+
+// addError records that a query of the job failed.
+func (jr *jobRun) addError(err error, query string) {
+	atomic.AddInt64(&jr.errors, 1)
+	queryErrorsTotal.WithLabelValues(jr.job.Name()).Inc()
+	jr.errorsMu.Lock()
+	if len(jr.errorSamples) < maxErrorSamples {
+		jr.errorSamples = append(jr.errorSamples, fmt.Sprintf("%s: %v", query, err))
+	}
+	jr.errorsMu.Unlock()
+}
+
+// countRows records that the job running with ctx has read n rows from the
+// database.
+func countRows(ctx context.Context, n int) {
+	if jr := jobRunFromContext(ctx); jr != nil {
+		atomic.AddInt64(&jr.rowsRead, int64(n))
+		rowsProcessedTotal.WithLabelValues(jr.job.Name()).Add(float64(n))
+	}
+}
+
+type jobRunKey struct{}
+
+func withJobRun(ctx context.Context, jr *jobRun) context.Context {
+	return context.WithValue(ctx, jobRunKey{}, jr)
+}
+
+// jobRunFromContext returns the jobRun stored in ctx, or nil if there is none.
+func jobRunFromContext(ctx context.Context) *jobRun {
+	jr, _ := ctx.Value(jobRunKey{}).(*jobRun)
+	return jr
+}
+
+type configKey struct{}
+
+// withConfig returns a copy of ctx carrying cfg, which replaces c for the jobs
+// run with it.
+func withConfig(ctx context.Context, cfg *config) context.Context {
+	return context.WithValue(ctx, configKey{}, cfg)
+}
+
+// configFromContext returns the config of the run ctx belongs to, which is c
+// unless some options have been overridden for the run.
+func configFromContext(ctx context.Context) *config {
+	if cfg, ok := ctx.Value(configKey{}).(*config); ok {
+		return cfg
+	}
+	return &c
+}
+
+// runningJobs contains the jobs currently running, each with a channel which
+// is closed once it's done.
+var runningJobs = struct {
+	sync.Mutex
+	m map[Job]chan struct{}
+}{m: make(map[Job]chan struct{})}
+
+// runJob runs j, and waits for all the operations it queued to be executed.
+// If any of the jobs j depends on is running, runJob waits for it to finish
+// before starting j. If j is already running, runJob returns nil straight
+// away. If onStart is not nil, it is called with the run before j starts, so
+// that its progress can be followed.
+func runJob(ctx context.Context, j Job, onStart func(*jobRun)) *jobRun {
+	runningJobs.Lock()
+	if _, ok := runningJobs.m[j]; ok {
+		runningJobs.Unlock()
+		return nil
+	}
+	done := make(chan struct{})
+	runningJobs.m[j] = done
+	runningJobs.Unlock()
+
+	defer func() {
+		runningJobs.Lock()
+		delete(runningJobs.m, j)
+		runningJobs.Unlock()
+		close(done)
+	}()
+
+	l := logFor(ctx).with("job", j.Name())
+	for _, dep := range j.Dependencies() {
+		runningJobs.Lock()
+		ch := runningJobs.m[findJob(dep)]
+		runningJobs.Unlock()
+		if ch != nil {
+			l.debugf("waiting for %s to finish", dep)
+			<-ch
+		}
+	}
+
+	jr := &jobRun{job: j, start: time.Now(), status: statusRunning, runID: runIDFromContext(ctx), log: l}
+	defer observeRun(jr)
+	if onStart != nil {
+		onStart(jr)
+	}
+	if ctx.Err() != nil {
+		jr.status = statusNotStarted
+		jr.end = jr.start
+		return jr
+	}
+	if c.LockJobs && !dryRun {
+		lock, lockCtx, err := acquireLock(ctx, j.Name())
+		if err != nil {
+			jr.end = time.Now()
+			jr.status = statusNotStarted
+			switch err := err.(type) {
+			case errLocked:
+				l.warnf("skipped, %v", err)
+				jr.status = statusLocked
+			default:
+				if ctx.Err() == nil {
+					l.errorf("couldn't take the lock: %v", err)
+				}
+			}
+			return jr
+		}
+		defer lock.release()
+		ctx = lockCtx
+	}
+	if timeout := jobTimeouts[j]; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	jr.err = j.Run(withJobRun(ctx, jr))
+	jr.ops.Wait()
+	recordWrites(jr)
+	jr.end = time.Now()
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		jr.status = statusTimedOut
+	case ctx.Err() != nil:
+		jr.status = statusInterrupted
+	case jr.err != nil, atomic.LoadInt64(&jr.errors) > int64(configFromContext(ctx).MaxErrors):
+		jr.status = statusFailed
+	default:
+		jr.status = statusFinished
+	}
+	return jr
+}
+
+// jobTimeouts contains the timeout of each job, as set in the Timeouts config
+// option.
+var jobTimeouts map[Job]time.Duration
+
+// maxRunDuration is the parsed MaxRunDuration config option.
+var maxRunDuration time.Duration
+
+func parseTimeouts(s string) (map[Job]time.Duration, error) {
+	opts, err := parseJobOptions(s)
+	if err != nil {
+		return nil, err
+	}
+	timeouts := make(map[Job]time.Duration, len(opts))
+	for j, v := range opts {
+		d, err := parseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", j.Name(), err)
+		}
+		timeouts[j] = d
+	}
+	return timeouts, nil
+}
+
+// parseDuration is like time.ParseDuration, but an empty string is 0.
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("%s is negative", s)
+	}
+	return d, nil
+}
+
+// runJobs runs all the jobs in js, each as soon as the jobs it depends on are
+// done, and waits for all of them to finish. Dependencies which are not in js
+// are only waited for if they are running. The runs are returned in the same
+// order as js; a run is nil if the job was already running.
+func runJobs(ctx context.Context, js []Job) ([]*jobRun, error) {
+	if _, err := sortJobs(js); err != nil {
+		return nil, err
+	}
+
+	done := make(map[Job]chan struct{}, len(js))
+	for _, j := range js {
+		done[j] = make(chan struct{})
+	}
+
+	runs := make([]*jobRun, len(js))
+	var wg sync.WaitGroup
+	for i, j := range js {
+		wg.Add(1)
+		go func(i int, j Job) {
+			defer wg.Done()
+			defer close(done[j])
+			for _, dep := range j.Dependencies() {
+				if ch, ok := done[findJob(dep)]; ok {
+					<-ch
+				}
+			}
+			runs[i] = runJob(ctx, j, nil)
+		}(i, j)
+	}
+	wg.Wait()
+	return runs, nil
+}
+
+// printRun logs the outcome of jr.
+func printRun(jr *jobRun) {
+	l := jr.log.with("status", jr.status)
+	if jr.status != statusNotStarted {
+		l = l.with("duration", jr.end.Sub(jr.start).Round(time.Millisecond),
+			"rows_processed", atomic.LoadInt64(&jr.rowsRead),
+			"operations_executed", atomic.LoadInt64(&jr.opsExecuted),
+			"rows_affected", atomic.LoadInt64(&jr.rowsAffected))
+	}
+	if dropped := atomic.LoadInt64(&jr.opsDropped); dropped > 0 {
+		l = l.with("operations_not_queued", dropped)
+	}
+	if errors := atomic.LoadInt64(&jr.errors); errors > 0 {
+		l = l.with("queries_failed", errors)
+	}
+	if jr.err != nil && jr.status == statusFailed {
+		l = l.with("error", jr.err)
+	}
+	switch jr.status {
+	case statusFinished:
+		l.infof("%s", jr.status)
+	case statusFailed:
+		l.errorf("%s", jr.status)
+	default:
+		l.warnf("%s", jr.status)
+	}
+}
+
+// printSummary prints the outcome of every run in runs.
+func printSummary(runs []*jobRun) {
+	for _, jr := range runs {
+		if jr != nil {
+			printRun(jr)
+		}
+	}
+}
+
+// sortJobs returns js sorted so that each job comes after the jobs it depends
+// on. An error is returned if a dependency does not exist, or if there is a
+// dependency cycle.
+func sortJobs(js []Job) ([]Job, error) {
+	in := make(map[Job]bool, len(js))
+	for _, j := range js {
+		in[j] = true
+	}
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[Job]int, len(js))
+	sorted := make([]Job, 0, len(js))
+
+	var visit func(j Job) error
+	visit = func(j Job) error {
+		switch state[j] {
+		case visiting:
+			return fmt.Errorf("dependency cycle involving %s", j.Name())
+		case visited:
+			return nil
+		}
+		state[j] = visiting
+		for _, depName := range j.Dependencies() {
+			dep := findJob(depName)
+			if dep == nil {
+				return fmt.Errorf("%s depends on %s, which does not exist", j.Name(), depName)
+			}
+			if !in[dep] {
+				continue
+			}
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		state[j] = visited
+		sorted = append(sorted, j)
+		return nil
+	}
+
+	for _, j := range js {
+		if err := visit(j); err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
+}
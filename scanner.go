@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// scanQuery describes the rows of scores read by a scoreScanner:
+// "SELECT cols FROM from WHERE where".
+type scanQuery struct {
+	cols string
+	// from must contain the scores table, as scores.
+	from  string
+	where string
+	// desc makes the scanner walk the scores from the most recent one.
+	desc bool
+}
+
+// String returns the query of a chunk, which is logged if it fails.
+func (q scanQuery) String() string {
+	s := "SELECT scores.id, " + q.cols + " FROM " + q.from + " WHERE "
+	if q.desc {
+		s += "scores.id < ?"
+	} else {
+		s += "scores.id > ?"
+	}
+	if q.where != "" {
+		s += " AND (" + q.where + ")"
+	}
+	if q.desc {
+		return s + " ORDER BY scores.id DESC LIMIT ?"
+	}
+	return s + " ORDER BY scores.id LIMIT ?"
+}
+
+// scoreScanner reads the scores in chunks of ScanChunkSize rows ordered by id,
+// so that no query holds a result set (and its locks) open for the whole job.
+// Each chunk is a separate query, which is retried like the queued writes if
+// the connection drops, even while the chunk is being read. It's used like sql.Rows:
+//
+//	sc := newScoreScanner(ctx, q, 0)
+//	defer sc.Close()
+//	for sc.Next() {
+//		err := sc.Scan(&a, &b)
+//	}
+//	if err := sc.Err(); err != nil {
+//
+// The scanner can be resumed from where it was by passing its Cursor to
+// newScoreScanner.
+type scoreScanner struct {
+	ctx   context.Context
+	query string
+	desc  bool
+	chunk int
+
+	cursor int64
+	rows   *sql.Rows
+	// read is the number of rows read from the current chunk.
+	read int
+	// retries is the number of times the current chunk was fetched again,
+	// after the connection dropped while it was being read.
+	retries int
+	done    bool
+	err     error
+}
+
+// newScoreScanner returns a scanner of the rows of q, starting after the score
+// with the given id. If after is 0, it starts from the first score.
+func newScoreScanner(ctx context.Context, q scanQuery, after int64) *scoreScanner {
+	chunk := configFromContext(ctx).ScanChunkSize
+	if chunk < 1 {
+		chunk = 10000
+	}
+	return &scoreScanner{
+		ctx:    ctx,
+		query:  q.String(),
+		desc:   q.desc,
+		chunk:  chunk,
+		cursor: after,
+	}
+}
+
+// Next prepares the next row, fetching the next chunk if needed. It returns
+// false once all the rows have been read, or an error happened.
+func (s *scoreScanner) Next() bool {
+	if s.done {
+		return false
+	}
+	if s.rows != nil {
+		if s.rows.Next() {
+			s.read++
+			return true
+		}
+		err := s.rows.Err()
+		s.rows.Close()
+		s.rows = nil
+		switch {
+		case err != nil && s.ctx.Err() == nil && isRetryable(err) && s.retries < c.Retries:
+			// the connection dropped in the middle of the chunk: the
+			// rest of it is fetched again, from the last row read
+			backoff := retryBackoff << uint(s.retries)
+			if backoff > maxRetryBackoff {
+				backoff = maxRetryBackoff
+			}
+			s.retries++
+			logFor(s.ctx).with("query", s.query, "cursor", s.cursor, "attempt", s.retries, "error", err).
+				warnf("lost the chunk, fetching it again in %s", backoff)
+			queryRetriesTotal.WithLabelValues(jobLabel(jobRunFromContext(s.ctx))).Inc()
+			time.Sleep(backoff)
+		case err != nil:
+			return s.fail(err)
+		case s.read < s.chunk:
+			s.done = true
+			return false
+		default:
+			s.retries = 0
+		}
+	}
+	if err := s.fetch(); err != nil {
+		return s.fail(err)
+	}
+	return s.Next()
+}
+
+// fetch queries the chunk after the cursor.
+func (s *scoreScanner) fetch() error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	cursor := s.cursor
+	if s.desc && cursor == 0 {
+		cursor = 1<<63 - 1
+	}
+	s.read = 0
+	l := logFor(s.ctx)
+	if logEnabled(levelTrace) {
+		l.with("query", s.query, "cursor", cursor).tracef("fetching chunk")
+	}
+	return withRetry(l.with("query", s.query), jobLabel(jobRunFromContext(s.ctx)), func() error {
+		var err error
+		s.rows, err = readDBFor(s.ctx).QueryContext(s.ctx, s.query, cursor, s.chunk)
+		return err
+	})
+}
+
+func (s *scoreScanner) fail(err error) bool {
+	s.err = err
+	s.done = true
+	return false
+}
+
+// Scan copies the columns of the current row into dest, like sql.Rows.Scan.
+// scores.id, which is selected first, is not included.
+func (s *scoreScanner) Scan(dest ...interface{}) error {
+	return s.rows.Scan(append([]interface{}{&s.cursor}, dest...)...)
+}
+
+// Err returns the error which stopped the scanner, if any.
+func (s *scoreScanner) Err() error {
+	return s.err
+}
+
+// Query returns the query of the chunks, to be logged with the errors.
+func (s *scoreScanner) Query() string {
+	return s.query
+}
+
+// Cursor returns the id of the last score read, from which a new scanner can
+// be resumed.
+func (s *scoreScanner) Cursor() int64 {
+	return s.cursor
+}
+
+// Close stops the scanner.
+func (s *scoreScanner) Close() error {
+	s.done = true
+	if s.rows != nil {
+		err := s.rows.Close()
+		s.rows = nil
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// TestScoreScannerRetry checks that a chunk interrupted by a dropped
+// connection is fetched again from the last row read.
+func TestScoreScannerRetry(t *testing.T) {
+	mock := setupMockDB(t, 2)
+	c.ScanChunkSize = 3
+	q := scanQuery{cols: "pp", from: "scores"}
+	mock.ExpectQuery(regexp.QuoteMeta(q.String())).WithArgs(0, 3).WillReturnRows(sqlmock.NewRows([]string{"id", "pp"}).
+		AddRow(1, 10).AddRow(2, 20).AddRow(3, 30).RowError(1, mysql.ErrInvalidConn))
+	mock.ExpectQuery(regexp.QuoteMeta(q.String())).WithArgs(1, 3).WillReturnRows(sqlmock.NewRows([]string{"id", "pp"}).
+		AddRow(2, 20).AddRow(3, 30).AddRow(4, 40))
+	mock.ExpectQuery(regexp.QuoteMeta(q.String())).WithArgs(4, 3).WillReturnRows(sqlmock.NewRows([]string{"id", "pp"}).
+		AddRow(5, 50))
+
+	sc := newScoreScanner(context.Background(), q, 0)
+	defer sc.Close()
+	var got []int
+	for sc.Next() {
+		var pp int
+		if err := sc.Scan(&pp); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, pp)
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{10, 20, 30, 40, 50}; !equalInts(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestScoreScannerRetryLimit checks that the scanner fails once the chunk was
+// fetched again Retries times.
+func TestScoreScannerRetryLimit(t *testing.T) {
+	mock := setupMockDB(t, 1)
+	c.ScanChunkSize = 3
+	q := scanQuery{cols: "pp", from: "scores"}
+	for _, after := range []int{0, 1} {
+		mock.ExpectQuery(regexp.QuoteMeta(q.String())).WithArgs(after, 3).WillReturnRows(sqlmock.NewRows([]string{"id", "pp"}).
+			AddRow(after+1, 10).AddRow(after+2, 20).RowError(1, driver.ErrBadConn))
+	}
+
+	sc := newScoreScanner(context.Background(), q, 0)
+	defer sc.Close()
+	for sc.Next() {
+		var pp int
+		if err := sc.Scan(&pp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sc.Err() != driver.ErrBadConn {
+		t.Errorf("got error %v, want %v", sc.Err(), driver.ErrBadConn)
+	}
+	if sc.Cursor() != 2 {
+		t.Errorf("got cursor %d, want 2", sc.Cursor())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// setupMockDB makes db and readDB a mock, on which the queries are retried up
+// to retries times without waiting. The changes to c are undone after the
+// test.
+func setupMockDB(t *testing.T, retries int) sqlmock.Sqlmock {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldDB, oldReadDB, oldC, oldBackoff := db, readDB, c, retryBackoff
+	t.Cleanup(func() {
+		mockDB.Close()
+		db, readDB, c, retryBackoff = oldDB, oldReadDB, oldC, oldBackoff
+	})
+	db = sqlx.NewDb(mockDB, "mysql")
+	readDB = db
+	c.Retries = retries
+	retryBackoff = 0
+	return mock
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
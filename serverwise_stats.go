@@ -1,18 +1,25 @@
 package main
 
 import (
-	"github.com/fatih/color"
+	"context"
 )
 
+func init() {
+	registerJob(&basicJob{
+		name:        "CalculateServerWiseStats",
+		description: "Re-calculates some server-wise cached stats (mostly displayed in RAP).",
+		enabled:     func(c *config) bool { return c.CalculateServerWiseStats },
+		run:         opServerwiseStats,
+	})
+}
+
 type statType struct {
 	query    string
 	redisKey string
 	value    int
 }
 
-func opServerwiseStats() {
-	defer wg.Done()
-
+func opServerwiseStats(ctx context.Context) error {
 	stats := []statType {
 		statType {
 			query: "SELECT COUNT(id) AS c FROM scores LIMIT 1",
@@ -28,10 +35,13 @@ func opServerwiseStats() {
 		},
 	}
 	for _, v := range stats {
-		db.QueryRow(v.query).Scan(&v.value)
-		r.Set(v.redisKey, v.value, 0)
+		db.QueryRowContext(ctx, v.query).Scan(&v.value)
+		redisWrite(ctx, func() error {
+			return r.Set(v.redisKey, v.value, 0).Err()
+		}, "SET", v.redisKey, v.value)
 	}
 
 
-	color.Green("> Server-wise Stats: done!")
+	logFor(ctx).infof("done!")
+	return nil
 }
\ No newline at end of file
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// rateLimiter spaces out writes so that no more than a given number of them
+// are executed per second.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(perSecond int) *rateLimiter {
+	return &rateLimiter{interval: time.Second / time.Duration(perSecond)}
+}
+
+// waitN waits until n more writes can be executed.
+func (l *rateLimiter) waitN(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(l.interval * time.Duration(n))
+	l.mu.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+var (
+	// writeLimiter is the limiter of WriteRateLimit, if it's set.
+	writeLimiter *rateLimiter
+	// tableLimiters are the limiters of TableRateLimits, by table.
+	tableLimiters map[string]*rateLimiter
+)
+
+// parseTableRateLimits parses the TableRateLimits config option, a
+// semicolon-separated list of table=writes per second.
+func parseTableRateLimits(s string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q: expected table=writes per second", entry)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("%q: the limit must be a positive number", entry)
+		}
+		limits[strings.ToLower(strings.TrimSpace(parts[0]))] = n
+	}
+	return limits, nil
+}
+
+// setupRateLimits creates the limiters of WriteRateLimit and TableRateLimits.
+func setupRateLimits(cfg *config) error {
+	limits, err := parseTableRateLimits(cfg.TableRateLimits)
+	if err != nil {
+		return err
+	}
+	writeLimiter = nil
+	if cfg.WriteRateLimit > 0 {
+		writeLimiter = newRateLimiter(cfg.WriteRateLimit)
+	}
+	tableLimiters = make(map[string]*rateLimiter, len(limits))
+	for table, n := range limits {
+		tableLimiters[table] = newRateLimiter(n)
+	}
+	return nil
+}
+
+// throttleWrites waits until ops can be executed: until the writes are no
+// longer paused by monitorThrottle, and until they are within the rate limits.
+func throttleWrites(ops []operation) {
+	if dryRun {
+		return
+	}
+	writesGate.wait()
+	if writeLimiter != nil {
+		writeLimiter.waitN(len(ops))
+	}
+	if len(tableLimiters) == 0 {
+		return
+	}
+	perTable := make(map[string]int)
+	for _, op := range ops {
+		if op.row != nil {
+			perTable[op.row.table]++
+		} else {
+			perTable[queryTarget(op.query)]++
+		}
+	}
+	for table, n := range perTable {
+		if l := tableLimiters[table]; l != nil {
+			l.waitN(n)
+		}
+	}
+}
+
+// gate blocks the writes while it's closed.
+type gate struct {
+	mu sync.Mutex
+	// open is nil while the gate is open, and closed when it's opened again.
+	open chan struct{}
+}
+
+var writesGate gate
+
+func (g *gate) wait() {
+	g.mu.Lock()
+	open := g.open
+	g.mu.Unlock()
+	if open != nil {
+		<-open
+	}
+}
+
+// set closes the gate if closed is set, or opens it otherwise. It reports
+// whether the gate changed.
+func (g *gate) set(closed bool) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if closed == (g.open != nil) {
+		return false
+	}
+	if closed {
+		g.open = make(chan struct{})
+		writesPaused.Set(1)
+	} else {
+		close(g.open)
+		g.open = nil
+		writesPaused.Set(0)
+	}
+	return true
+}
+
+var throttleLog = baseLog.with("component", "Throttle")
+
+// throttleEnabled reports whether the writes are paused when MySQL is under
+// load.
+func throttleEnabled(cfg *config) bool {
+	return cfg.MaxThreadsRunning > 0 || cfg.MaxReplicationLag > 0
+}
+
+// monitorThrottle checks every ThrottleCheckInterval whether MySQL is under
+// load, in which case it pauses the writes until it no longer is: when
+// Threads_running is above MaxThreadsRunning, or the replica at
+// ThrottleReplicaDSN (or ReadDSN) lags behind by more than MaxReplicationLag
+// seconds, or its lag can't be known. The writes are resumed once ctx is
+// done.
+func monitorThrottle(ctx context.Context, interval time.Duration) {
+	defer writesGate.set(false)
+
+	var replica *sqlx.DB
+	switch {
+	case c.MaxReplicationLag <= 0:
+	case c.ThrottleReplicaDSN == "":
+		replica = readDB
+	default:
+		var err error
+		replica, err = sqlx.Open("mysql", c.ThrottleReplicaDSN)
+		if err != nil {
+			throttleLog.errorf("couldn't connect to ThrottleReplicaDSN, the replication lag won't be checked: %v", err)
+		} else {
+			defer replica.Close()
+		}
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		var reasons []string
+		if c.MaxThreadsRunning > 0 {
+			n, err := threadsRunning()
+			if err != nil {
+				throttleLog.warnf("couldn't get Threads_running: %v", err)
+			} else if n > c.MaxThreadsRunning {
+				reasons = append(reasons, fmt.Sprintf("Threads_running is %d", n))
+			}
+		}
+		if replica != nil {
+			lag, err := replicationLag(replica)
+			if err != nil {
+				// the replica may be far behind, e.g. if its replication
+				// stopped
+				reasons = append(reasons, fmt.Sprintf("couldn't get the replication lag (%v)", err))
+			} else if lag > c.MaxReplicationLag {
+				reasons = append(reasons, fmt.Sprintf("the replica is %d seconds behind", lag))
+			}
+		}
+		if writesGate.set(len(reasons) > 0) {
+			if len(reasons) > 0 {
+				throttleLog.warnf("pausing the writes: %s", strings.Join(reasons, ", "))
+			} else {
+				throttleLog.infof("resuming the writes")
+			}
+		}
+
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func threadsRunning() (int, error) {
+	var name string
+	var n int
+	err := db.QueryRow("SHOW GLOBAL STATUS LIKE 'Threads_running'").Scan(&name, &n)
+	return n, err
+}
+
+// replicationLag returns the Seconds_Behind_Master of the replica. It fails if
+// the replica is not replicating.
+func replicationLag(replica *sqlx.DB) (int, error) {
+	rows, err := replica.Query("SHOW SLAVE STATUS")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+		return 0, fmt.Errorf("the server is not a replica")
+	}
+	values := make([]sql.RawBytes, len(cols))
+	dest := make([]interface{}, len(cols))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return 0, err
+	}
+	for i, col := range cols {
+		if col != "Seconds_Behind_Master" {
+			continue
+		}
+		if values[i] == nil {
+			return 0, fmt.Errorf("replication is not running")
+		}
+		return strconv.Atoi(string(values[i]))
+	}
+	return 0, fmt.Errorf("SHOW SLAVE STATUS has no Seconds_Behind_Master")
+}
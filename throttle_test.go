@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// gateClosed reports whether the writes are paused.
+func gateClosed() bool {
+	writesGate.mu.Lock()
+	defer writesGate.mu.Unlock()
+	return writesGate.open != nil
+}
+
+func TestMonitorThrottleReplicationLagError(t *testing.T) {
+	mock := setupMockDB(t, 0)
+	c.MaxReplicationLag, c.ThrottleReplicaDSN = 10, ""
+	mock.ExpectQuery("SHOW SLAVE STATUS").WillReturnError(errors.New("connection refused"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		monitorThrottle(ctx, time.Hour)
+		close(done)
+	}()
+	for deadline := time.Now().Add(time.Second); !gateClosed(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			cancel()
+			t.Fatal("the writes weren't paused when the replication lag couldn't be known")
+		}
+	}
+
+	// the workers waiting for the writes to resume are released once
+	// ctx is done
+	waiting := make(chan struct{})
+	go func() {
+		writesGate.wait()
+		close(waiting)
+	}()
+	cancel()
+	select {
+	case <-waiting:
+	case <-time.After(time.Second):
+		t.Fatal("the writes weren't resumed once ctx was done")
+	}
+	<-done
+}